@@ -0,0 +1,262 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"share/utils"
+)
+
+// maxHistory caps the number of transfers remembered per user.
+const maxHistory = 200
+
+var (
+	// ErrUserExists indicates a username that is already taken.
+	ErrUserExists = errors.New("username already taken")
+	// ErrUserNotFound indicates an unknown username.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInvalidUsername indicates a username with unsupported characters.
+	ErrInvalidUsername = errors.New("usernames must be 3-32 letters, digits, dots, dashes or underscores")
+	// ErrWeakPassword indicates a password that is too short.
+	ErrWeakPassword = errors.New("passwords must be at least 8 characters")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9._-]{3,32}$`)
+
+// Transfer statuses recorded in a user's history.
+const (
+	StatusActive   = "active"
+	StatusExpired  = "expired"
+	StatusDeclined = "declined"
+	StatusRevoked  = "revoked"
+)
+
+// User is a local account.
+type User struct {
+	Username     string         `json:"username"`
+	PasswordHash string         `json:"passwordHash"`
+	Quota        int64          `json:"quota,omitempty"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	History      []HistoryEntry `json:"history,omitempty"`
+}
+
+// HistoryEntry records a transfer created by a user.
+type HistoryEntry struct {
+	TransferID string    `json:"transferId"`
+	Category   string    `json:"category"`
+	Files      int       `json:"files"`
+	Bytes      int64     `json:"bytes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Status is empty while the transfer is active and set once it has been
+	// removed for a known reason; entries without a status whose transfer
+	// no longer exists have expired.
+	Status  string    `json:"status,omitempty"`
+	EndedAt time.Time `json:"endedAt,omitzero"`
+}
+
+// Accounts stores local users in a JSON file.
+type Accounts struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*User
+}
+
+// LoadAccounts opens the accounts file at path, creating it on first save.
+func LoadAccounts(path string) (*Accounts, error) {
+	a := &Accounts{path: path, users: make(map[string]*User)}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []*User
+	if err := json.Unmarshal(raw, &users); err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		a.users[u.Username] = u
+	}
+	return a, nil
+}
+
+// Create adds a user with the given password.
+func (a *Accounts) Create(username, password string, quota int64) (*User, error) {
+	username = normalizeUsername(username)
+	if !usernamePattern.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	if len(password) < 8 {
+		return nil, ErrWeakPassword
+	}
+	user := &User{
+		Username:     username,
+		PasswordHash: utils.HashArgon2id(password),
+		Quota:        quota,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.users[username]; ok {
+		return nil, ErrUserExists
+	}
+	a.users[username] = user
+	if err := a.saveLocked(); err != nil {
+		delete(a.users, username)
+		return nil, err
+	}
+	return copyUser(user), nil
+}
+
+// Authenticate returns the user if the password matches.
+func (a *Accounts) Authenticate(username, password string) (*User, error) {
+	username = normalizeUsername(username)
+	a.mu.RLock()
+	user, ok := a.users[username]
+	a.mu.RUnlock()
+	if !ok {
+		// Spend the same time as a real check so usernames cannot be probed.
+		utils.VerifyArgon2id(password, dummyHash())
+		return nil, ErrInvalidCredentials
+	}
+	if !utils.VerifyArgon2id(password, user.PasswordHash) {
+		return nil, ErrInvalidCredentials
+	}
+	return copyUser(user), nil
+}
+
+// User returns a copy of the named user.
+func (a *Accounts) User(username string) (*User, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	user, ok := a.users[normalizeUsername(username)]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// List returns all users sorted by name, without their history.
+func (a *Accounts) List() []*User {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	out := make([]*User, 0, len(a.users))
+	for _, user := range a.users {
+		userCopy := *user
+		userCopy.History = nil
+		out = append(out, &userCopy)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out
+}
+
+// Delete removes a user.
+func (a *Accounts) Delete(username string) error {
+	username = normalizeUsername(username)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	user, ok := a.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	delete(a.users, username)
+	if err := a.saveLocked(); err != nil {
+		a.users[username] = user
+		return err
+	}
+	return nil
+}
+
+// SetQuota changes the per-user storage quota; zero means the instance default.
+func (a *Accounts) SetQuota(username string, quota int64) error {
+	return a.update(username, func(u *User) {
+		u.Quota = quota
+	})
+}
+
+// RecordTransfer adds a newly created transfer to the user's history.
+func (a *Accounts) RecordTransfer(username string, entry HistoryEntry) error {
+	return a.update(username, func(u *User) {
+		u.History = append(u.History, entry)
+		if len(u.History) > maxHistory {
+			u.History = u.History[len(u.History)-maxHistory:]
+		}
+	})
+}
+
+// MarkTransfer records why a transfer in the user's history ended.
+func (a *Accounts) MarkTransfer(username, transferID, status string) error {
+	return a.update(username, func(u *User) {
+		for i := range u.History {
+			if u.History[i].TransferID == transferID && u.History[i].Status == "" {
+				u.History[i].Status = status
+				u.History[i].EndedAt = time.Now().UTC()
+			}
+		}
+	})
+}
+
+func (a *Accounts) update(username string, fn func(*User)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	user, ok := a.users[normalizeUsername(username)]
+	if !ok {
+		return ErrUserNotFound
+	}
+	fn(user)
+	return a.saveLocked()
+}
+
+// saveLocked writes the accounts file atomically.
+func (a *Accounts) saveLocked() error {
+	users := make([]*User, 0, len(a.users))
+	for _, user := range a.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	raw, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(a.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), ".accounts-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+func copyUser(u *User) *User {
+	out := *u
+	out.History = append([]HistoryEntry(nil), u.History...)
+	return &out
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+var dummyHash = sync.OnceValue(func() string {
+	return utils.HashArgon2id("share-go-dummy-password")
+})
@@ -0,0 +1,254 @@
+package access
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mode selects how the instance gate admits visitors.
+type Mode string
+
+const (
+	// ModeOpen disables the gate.
+	ModeOpen Mode = "open"
+	// ModePassword admits visitors who know the shared instance password.
+	ModePassword Mode = "password"
+	// ModeInvite admits visitors holding an admin-issued invite code.
+	ModeInvite Mode = "invite"
+)
+
+// ParseMode validates a configured gate mode.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "", ModeOpen:
+		return ModeOpen, nil
+	case ModePassword, ModeInvite:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown access mode %q", s)
+	}
+}
+
+var (
+	// ErrInvalidCredentials indicates a wrong password or unknown invite code.
+	ErrInvalidCredentials = errors.New("invalid password or invite code")
+	// ErrInviteExhausted indicates an invite code that expired or has no uses left.
+	ErrInviteExhausted = errors.New("invite code expired or used up")
+)
+
+// Session is an authenticated browser session.
+type Session struct {
+	ID       string
+	Admin    bool
+	Invite   string
+	Username string
+	// Subject identifies a sender signed in through the OIDC provider; Name
+	// is the display name taken from the ID token.
+	Subject   string
+	Name      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Owner returns the identity transfers and devices of this session are
+// attributed to: the local username, or the OIDC subject prefixed with
+// "oidc:" so it cannot collide with a username.
+func (s *Session) Owner() string {
+	switch {
+	case s.Username != "":
+		return s.Username
+	case s.Subject != "":
+		return "oidc:" + s.Subject
+	default:
+		return ""
+	}
+}
+
+// Gate holds the instance access configuration, sessions and invite codes.
+type Gate struct {
+	mode          Mode
+	password      string
+	adminPassword string
+	sessionTTL    time.Duration
+	accounts      *Accounts
+	sso           bool
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	invites  map[string]*Invite
+}
+
+// NewGate creates a gate. adminPassword enables the admin pages and is also
+// accepted as the instance password. A non-nil accounts store requires
+// visitors to sign in as a local user.
+func NewGate(mode Mode, password, adminPassword string, sessionTTL time.Duration, accounts *Accounts) *Gate {
+	return &Gate{
+		mode:          mode,
+		password:      password,
+		adminPassword: adminPassword,
+		sessionTTL:    sessionTTL,
+		accounts:      accounts,
+		sessions:      make(map[string]*Session),
+		invites:       make(map[string]*Invite),
+	}
+}
+
+// Mode returns the configured gate mode.
+func (g *Gate) Mode() Mode {
+	return g.mode
+}
+
+// Enabled reports whether visitors must log in.
+func (g *Gate) Enabled() bool {
+	return g.mode != ModeOpen || g.accounts != nil || g.sso
+}
+
+// EnableSSO requires senders to sign in, either through the OIDC provider
+// or with a local account. It must be called before the gate is used.
+func (g *Gate) EnableSSO() {
+	g.sso = true
+}
+
+// SSOEnabled reports whether OIDC sign-in is configured.
+func (g *Gate) SSOEnabled() bool {
+	return g.sso
+}
+
+// Accounts returns the local user store, or nil when accounts are disabled.
+func (g *Gate) Accounts() *Accounts {
+	return g.accounts
+}
+
+// Admits reports whether session may use the gated routes. With accounts
+// or SSO enabled only signed-in users and admins qualify.
+func (g *Gate) Admits(session *Session) bool {
+	if g.accounts != nil || g.sso {
+		return session.Owner() != "" || session.Admin
+	}
+	return true
+}
+
+// LoginSubject starts a session for a sender the OIDC provider has
+// authenticated.
+func (g *Gate) LoginSubject(subject, name string) *Session {
+	return g.newSession(&Session{Subject: subject, Name: name})
+}
+
+// LoginUser checks a local account password and starts a user session.
+func (g *Gate) LoginUser(username, password string) (*Session, error) {
+	if g.accounts == nil {
+		return nil, ErrInvalidCredentials
+	}
+	user, err := g.accounts.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return g.newSession(&Session{Username: user.Username}), nil
+}
+
+// LogoutUser ends every session of a user, e.g. after the account is deleted.
+func (g *Gate) LogoutUser(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for id, session := range g.sessions {
+		if session.Username == username {
+			delete(g.sessions, id)
+		}
+	}
+}
+
+// AdminEnabled reports whether an admin password is configured.
+func (g *Gate) AdminEnabled() bool {
+	return g.adminPassword != ""
+}
+
+// Login checks a password or invite code and starts a session. The admin
+// password always succeeds and yields an admin session.
+func (g *Gate) Login(secret string) (*Session, error) {
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if g.adminPassword != "" && equalSecret(secret, g.adminPassword) {
+		return g.newSession(&Session{Admin: true}), nil
+	}
+	switch g.mode {
+	case ModePassword:
+		if equalSecret(secret, g.password) {
+			return g.newSession(&Session{}), nil
+		}
+	case ModeInvite:
+		code, err := g.redeemInvite(secret)
+		if err != nil {
+			return nil, err
+		}
+		return g.newSession(&Session{Invite: code}), nil
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Session returns the live session with the given id.
+func (g *Gate) Session(id string) (*Session, bool) {
+	if id == "" {
+		return nil, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	session, ok := g.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(g.sessions, id)
+		return nil, false
+	}
+	out := *session
+	return &out, true
+}
+
+// Logout ends a session.
+func (g *Gate) Logout(id string) {
+	g.mu.Lock()
+	delete(g.sessions, id)
+	g.mu.Unlock()
+}
+
+func (g *Gate) newSession(session *Session) *Session {
+	now := time.Now().UTC()
+	session.ID = randomToken(32)
+	session.CreatedAt = now
+	session.ExpiresAt = now.Add(g.sessionTTL)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for id, s := range g.sessions {
+		if now.After(s.ExpiresAt) {
+			delete(g.sessions, id)
+		}
+	}
+	g.sessions[session.ID] = session
+	out := *session
+	return &out
+}
+
+// equalSecret compares secrets in constant time regardless of their length.
+func equalSecret(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+func randomToken(length int) string {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)[:length]
+}
@@ -0,0 +1,111 @@
+package access
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Invite is an admin-issued code that admits visitors in invite mode.
+type Invite struct {
+	Code      string
+	Label     string
+	MaxUses   int
+	Uses      int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Exhausted reports whether the invite can no longer be redeemed.
+func (i *Invite) Exhausted(now time.Time) bool {
+	if !i.ExpiresAt.IsZero() && now.After(i.ExpiresAt) {
+		return true
+	}
+	return i.MaxUses > 0 && i.Uses >= i.MaxUses
+}
+
+// CreateInvite issues a new invite code. A zero maxUses or ttl means
+// unlimited.
+func (g *Gate) CreateInvite(label string, maxUses int, ttl time.Duration) *Invite {
+	label = strings.TrimSpace(label)
+	if len(label) > 60 {
+		label = label[:60]
+	}
+	now := time.Now().UTC()
+	invite := &Invite{
+		Code:      formatInviteCode(randomToken(12)),
+		Label:     label,
+		MaxUses:   maxUses,
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		invite.ExpiresAt = now.Add(ttl)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.invites[invite.Code] = invite
+	out := *invite
+	return &out
+}
+
+// RevokeInvite deletes an invite code and ends the sessions it started.
+func (g *Gate) RevokeInvite(code string) {
+	code = normalizeInviteCode(code)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.invites, code)
+	for id, session := range g.sessions {
+		if session.Invite == code {
+			delete(g.sessions, id)
+		}
+	}
+}
+
+// Invites returns all invite codes, newest first.
+func (g *Gate) Invites() []*Invite {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]*Invite, 0, len(g.invites))
+	for _, invite := range g.invites {
+		inviteCopy := *invite
+		out = append(out, &inviteCopy)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CreatedAt.After(out[j].CreatedAt)
+	})
+	return out
+}
+
+func (g *Gate) redeemInvite(code string) (string, error) {
+	code = normalizeInviteCode(code)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	invite, ok := g.invites[code]
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+	if invite.Exhausted(time.Now()) {
+		return "", ErrInviteExhausted
+	}
+	invite.Uses++
+	return code, nil
+}
+
+// formatInviteCode groups a code as XXXX-XXXX-XXXX for easier typing.
+func formatInviteCode(raw string) string {
+	raw = strings.ToUpper(raw)
+	var parts []string
+	for len(raw) > 4 {
+		parts = append(parts, raw[:4])
+		raw = raw[4:]
+	}
+	parts = append(parts, raw)
+	return strings.Join(parts, "-")
+}
+
+func normalizeInviteCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return formatInviteCode(code)
+}
@@ -0,0 +1,352 @@
+// Command sharecli sends and receives end-to-end encrypted transfers from
+// the command line, using the same format as the browser.
+//
+//	sharecli send [-server URL] [-category CATEGORY] [-pin PIN] FILE...
+//	sharecli get [-o DIR] [-pin PIN] LINK
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"share/e2e"
+)
+
+// client never follows redirects: the server only redirects API clients
+// to its sign-in page or after a PIN was accepted.
+var client = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "send":
+		err = send(os.Args[2:])
+	case "get":
+		err = get(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sharecli:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sharecli send [-server URL] [-category CATEGORY] [-pin PIN] FILE...")
+	fmt.Fprintln(os.Stderr, "       sharecli get [-o DIR] [-pin PIN] LINK")
+	os.Exit(2)
+}
+
+func send(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	server := fs.String("server", envOr("SHARE_SERVER", "http://localhost:8080"), "server base URL")
+	category := fs.String("category", "any", "content category")
+	pin := fs.String("pin", "", "PIN receivers must enter")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("no files given")
+	}
+	paths := fs.Args()
+	infos := make([]os.FileInfo, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		infos[i] = info
+	}
+
+	key := e2e.NewKey()
+	body, w := io.Pipe()
+	form := multipart.NewWriter(w)
+	go func() {
+		w.CloseWithError(writeUpload(form, key, *category, *pin, paths, infos))
+	}()
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(*server, "/")+"/uploadFile", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	var created struct {
+		ShareLink  string `json:"shareLink"`
+		ManageLink string `json:"manageLink"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return fmt.Errorf("unexpected response: %w", err)
+	}
+	fmt.Println("Share link: ", created.ShareLink+"."+e2e.EncodeKey(key))
+	fmt.Println("Manage link:", created.ManageLink)
+	return nil
+}
+
+// writeUpload streams the multipart body, encrypting each file as it is
+// written.
+func writeUpload(form *multipart.Writer, key []byte, category, pin string, paths []string, infos []os.FileInfo) error {
+	fields := [][2]string{{"encrypted", "1"}, {"category", category}}
+	if pin != "" {
+		fields = append(fields, [2]string{"pin", pin})
+	}
+	for _, field := range fields {
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+	for i, path := range paths {
+		meta, err := e2e.SealMetadata(key, e2e.Metadata{
+			Name: filepath.Base(path),
+			Type: mimeType(path),
+			Size: infos[i].Size(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := form.WriteField("meta", meta); err != nil {
+			return err
+		}
+		part, err := form.CreateFormFile("files", fmt.Sprintf("file-%02d.sge", i+1))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = e2e.Encrypt(part, f, key)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("encrypting %s: %w", path, err)
+		}
+	}
+	return form.Close()
+}
+
+func get(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	dir := fs.String("o", ".", "directory to save files in")
+	pin := fs.String("pin", "", "PIN of a protected transfer")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one share link")
+	}
+	link, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	id := strings.TrimPrefix(link.Path, "/r/")
+	token, encodedKey, _ := strings.Cut(link.Fragment, ".")
+	if id == link.Path || id == "" || token == "" {
+		return errors.New("not a share link: expected https://HOST/r/ID#TOKEN")
+	}
+	var key []byte
+	if encodedKey != "" {
+		if key, err = e2e.DecodeKey(encodedKey); err != nil {
+			return err
+		}
+	}
+	t := &transferClient{base: link.Scheme + "://" + link.Host, id: id, token: token}
+	if *pin != "" {
+		if err := t.unlock(*pin); err != nil {
+			return err
+		}
+	}
+
+	var meta struct {
+		Encrypted bool `json:"encrypted"`
+		Files     []struct {
+			ID            string `json:"id"`
+			Name          string `json:"name"`
+			SHA256        string `json:"sha256"`
+			EncryptedMeta string `json:"encryptedMeta"`
+		} `json:"files"`
+	}
+	resp, err := t.do(http.MethodGet, "/meta", nil, "")
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&meta)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("unexpected response: %w", err)
+	}
+	if meta.Encrypted && key == nil {
+		return errors.New("the transfer is end-to-end encrypted but the link has no key")
+	}
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, file := range meta.Files {
+		name := file.Name
+		if meta.Encrypted {
+			m, err := e2e.OpenMetadata(key, file.EncryptedMeta)
+			if err != nil {
+				return fmt.Errorf("file %s: %w", file.ID, err)
+			}
+			name = m.Name
+		}
+		path := filepath.Join(*dir, safeName(name, file.ID))
+		if err := t.download(file.ID, file.SHA256, path, key); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Println(path)
+	}
+	return nil
+}
+
+// transferClient talks to the server on behalf of one share link.
+type transferClient struct {
+	base    string
+	id      string
+	token   string
+	cookies []*http.Cookie
+}
+
+func (t *transferClient) do(method, path string, query url.Values, form string) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("id", t.id)
+	var body io.Reader
+	if form != "" {
+		body = strings.NewReader(form)
+	}
+	req, err := http.NewRequest(method, t.base+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Share-Token", t.token)
+	if form != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, cookie := range t.cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && !(form != "" && resp.StatusCode == http.StatusSeeOther) {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// unlock enters the PIN and keeps the access cookie the server hands out.
+func (t *transferClient) unlock(pin string) error {
+	resp, err := t.do(http.MethodPost, "/incoming", nil, url.Values{"pin": {pin}}.Encode())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		return errors.New("incorrect PIN")
+	}
+	t.cookies = resp.Cookies()
+	return nil
+}
+
+// download saves one file to path, decrypting it when key is set. The
+// received bytes must match the SHA-256 the server recorded at upload, and
+// the file only appears under its final name once it has been verified.
+func (t *transferClient) download(fileID, sum, path string, key []byte) error {
+	resp, err := t.do(http.MethodGet, "/file", url.Values{"file": {fileID}}, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := os.CreateTemp(filepath.Dir(path), ".sharecli-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	h := sha256.New()
+	body := io.TeeReader(resp.Body, h)
+	if key != nil {
+		err = e2e.Decrypt(out, body, key)
+	} else {
+		_, err = io.Copy(out, body)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if sum != "" && hex.EncodeToString(h.Sum(nil)) != sum {
+		return errors.New("checksum mismatch, the download is damaged")
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	return os.Rename(out.Name(), path)
+}
+
+func responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusSeeOther || resp.StatusCode == http.StatusFound {
+		if strings.HasPrefix(resp.Header.Get("Location"), "/login") {
+			return errors.New("the server requires signing in, which sharecli does not support")
+		}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		msg = nil
+	}
+	return fmt.Errorf("server returned %s %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// safeName keeps only the last element of a sender-chosen name so files
+// cannot be written outside the target directory.
+func safeName(name, fallback string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." || name == "" {
+		return fallback
+	}
+	return name
+}
+
+func mimeType(path string) string {
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,349 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"share/access"
+)
+
+// Scan policies decide which scanned files can be downloaded.
+const (
+	// ScanBlockInfected withholds only files the scanner flagged.
+	ScanBlockInfected = "block-infected"
+	// ScanRequireClean also withholds files that could not be scanned, and
+	// refuses end-to-end encrypted uploads, which cannot be.
+	ScanRequireClean = "require-clean"
+)
+
+// Config holds the runtime settings of a share-go instance. Every field can be
+// overridden through a SHARE_* environment variable.
+type Config struct {
+	Port            string
+	UploadsDir      string
+	TransferTTL     time.Duration
+	CleanupInterval time.Duration
+	ShutdownTimeout time.Duration
+	MaxDevices      int
+
+	// DiskFreeThreshold is the free space, in bytes, below which the
+	// readiness check reports the instance as not ready.
+	DiskFreeThreshold int64
+	// StorageQuota caps the bytes held by all transfers; zero disables it.
+	StorageQuota int64
+	// FreeSpaceReserve is the free disk space uploads must leave untouched.
+	FreeSpaceReserve int64
+	// MaxUploadSize caps the request body of a single upload.
+	MaxUploadSize int64
+
+	// RateLimit is the sustained requests per second each client may make to
+	// the upload and device endpoints; zero disables limiting.
+	RateLimit float64
+	RateBurst int
+
+	// AccessMode gates the upload, device and admin routes behind a shared
+	// password or invite codes.
+	AccessMode     access.Mode
+	AccessPassword string
+	AdminPassword  string
+	SessionTTL     time.Duration
+	// GateShareLinks also requires a session for receivers opening share
+	// links; by default id+token links work without logging in.
+	GateShareLinks bool
+
+	// AccountsFile enables local user accounts stored in this JSON file.
+	AccountsFile string
+	// AllowSignup lets visitors create their own accounts.
+	AllowSignup bool
+	// UserQuota is the default per-user storage quota; zero disables it.
+	UserQuota int64
+
+	// OIDCIssuer enables signing in senders through an OpenID Connect
+	// provider. OIDCRedirectURL defaults to /auth/oidc/callback on the
+	// request host.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+
+	// SigningKeyFile holds the server secret for signed download links and
+	// PIN access cookies; it is created on first start.
+	SigningKeyFile string
+	// ChecksumBLAKE3 stores a BLAKE3 checksum of every file next to the
+	// SHA-256 one.
+	ChecksumBLAKE3 bool
+	// PolicyFile holds the rules deciding which files are accepted, by
+	// extension, detected type, size and category.
+	PolicyFile string
+	// EnforceCategory rejects uploads whose files do not match the chosen
+	// category. Otherwise senders are only warned about them.
+	EnforceCategory bool
+	// StripMetadata removes EXIF, XMP and IPTC metadata from JPEG and PNG
+	// uploads by default; senders can change it per upload.
+	StripMetadata bool
+
+	// EncryptionKey (hex) or EncryptionKeyFile enables encryption at rest of
+	// uploaded files. The key file is created on first start; keep it off
+	// the volume that holds the uploads.
+	EncryptionKey     string
+	EncryptionKeyFile string
+
+	// ClamdAddress or ScanCommand enables malware scanning of uploads, with
+	// a clamd daemon or an external command. ScanPolicy is one of
+	// ScanBlockInfected and ScanRequireClean.
+	ClamdAddress string
+	ScanCommand  []string
+	ScanTimeout  time.Duration
+	ScanPolicy   string
+
+	// DownloadLinkTTL is the default lifetime of signed per-file download
+	// links, capped at the transfer's expiry.
+	DownloadLinkTTL time.Duration
+	// PreviewMaxBytes is how much of a text or Markdown file the preview
+	// page shows.
+	PreviewMaxBytes int64
+
+	LogLevel  string
+	LogFormat string
+}
+
+// Load returns the configuration built from defaults and environment variables.
+func Load() (*Config, error) {
+	cfg := &Config{
+		Port:            envString("SHARE_PORT", "8080"),
+		UploadsDir:      envString("SHARE_UPLOADS_DIR", "uploads"),
+		LogLevel:        strings.ToLower(envString("SHARE_LOG_LEVEL", "info")),
+		LogFormat:       strings.ToLower(envString("SHARE_LOG_FORMAT", "text")),
+		TransferTTL:     2 * time.Hour,
+		CleanupInterval: 15 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		MaxDevices:      50,
+
+		DiskFreeThreshold: 512 << 20,
+		FreeSpaceReserve:  256 << 20,
+		MaxUploadSize:     10 << 30,
+
+		RateLimit: 2,
+		RateBurst: 40,
+
+		AccessPassword: os.Getenv("SHARE_ACCESS_PASSWORD"),
+		AdminPassword:  os.Getenv("SHARE_ADMIN_PASSWORD"),
+		SessionTTL:     24 * time.Hour,
+
+		AccountsFile: strings.TrimSpace(os.Getenv("SHARE_ACCOUNTS_FILE")),
+
+		OIDCIssuer:       strings.TrimSpace(os.Getenv("SHARE_OIDC_ISSUER")),
+		OIDCClientID:     strings.TrimSpace(os.Getenv("SHARE_OIDC_CLIENT_ID")),
+		OIDCClientSecret: os.Getenv("SHARE_OIDC_CLIENT_SECRET"),
+		OIDCRedirectURL:  strings.TrimSpace(os.Getenv("SHARE_OIDC_REDIRECT_URL")),
+		OIDCScopes:       strings.Fields(envString("SHARE_OIDC_SCOPES", "openid profile email")),
+
+		EncryptionKey:     strings.TrimSpace(os.Getenv("SHARE_ENCRYPTION_KEY")),
+		EncryptionKeyFile: strings.TrimSpace(os.Getenv("SHARE_ENCRYPTION_KEY_FILE")),
+
+		PolicyFile: strings.TrimSpace(os.Getenv("SHARE_POLICY_FILE")),
+
+		ClamdAddress: strings.TrimSpace(os.Getenv("SHARE_CLAMD_ADDRESS")),
+		ScanCommand:  strings.Fields(os.Getenv("SHARE_SCAN_COMMAND")),
+		ScanTimeout:  2 * time.Minute,
+		ScanPolicy:   strings.ToLower(envString("SHARE_SCAN_POLICY", ScanBlockInfected)),
+
+		DownloadLinkTTL: 24 * time.Hour,
+		PreviewMaxBytes: 1 << 20,
+	}
+	cfg.SigningKeyFile = envString("SHARE_SIGNING_KEY_FILE", filepath.Join(cfg.UploadsDir, ".signing-key"))
+
+	var err error
+	if cfg.TransferTTL, err = envDuration("SHARE_TRANSFER_TTL", cfg.TransferTTL); err != nil {
+		return nil, err
+	}
+	if cfg.CleanupInterval, err = envDuration("SHARE_CLEANUP_INTERVAL", cfg.CleanupInterval); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownTimeout, err = envDuration("SHARE_SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.MaxDevices, err = envInt("SHARE_MAX_DEVICES", cfg.MaxDevices); err != nil {
+		return nil, err
+	}
+	if cfg.DiskFreeThreshold, err = envBytes("SHARE_DISK_FREE_THRESHOLD", cfg.DiskFreeThreshold); err != nil {
+		return nil, err
+	}
+	if cfg.StorageQuota, err = envBytes("SHARE_STORAGE_QUOTA", cfg.StorageQuota); err != nil {
+		return nil, err
+	}
+	if cfg.FreeSpaceReserve, err = envBytes("SHARE_FREE_SPACE_RESERVE", cfg.FreeSpaceReserve); err != nil {
+		return nil, err
+	}
+	if cfg.MaxUploadSize, err = envBytes("SHARE_MAX_UPLOAD_SIZE", cfg.MaxUploadSize); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimit, err = envFloat("SHARE_RATE_LIMIT", cfg.RateLimit); err != nil {
+		return nil, err
+	}
+	if cfg.RateBurst, err = envInt("SHARE_RATE_BURST", cfg.RateBurst); err != nil {
+		return nil, err
+	}
+	if cfg.AccessMode, err = access.ParseMode(os.Getenv("SHARE_ACCESS_MODE")); err != nil {
+		return nil, fmt.Errorf("SHARE_ACCESS_MODE: %w", err)
+	}
+	if cfg.SessionTTL, err = envDuration("SHARE_SESSION_TTL", cfg.SessionTTL); err != nil {
+		return nil, err
+	}
+	if cfg.GateShareLinks, err = envBool("SHARE_ACCESS_GATE_SHARE_LINKS", cfg.GateShareLinks); err != nil {
+		return nil, err
+	}
+	if cfg.ChecksumBLAKE3, err = envBool("SHARE_CHECKSUM_BLAKE3", cfg.ChecksumBLAKE3); err != nil {
+		return nil, err
+	}
+	if cfg.EnforceCategory, err = envBool("SHARE_ENFORCE_CATEGORY", cfg.EnforceCategory); err != nil {
+		return nil, err
+	}
+	if cfg.StripMetadata, err = envBool("SHARE_STRIP_METADATA", cfg.StripMetadata); err != nil {
+		return nil, err
+	}
+	if cfg.ScanTimeout, err = envDuration("SHARE_SCAN_TIMEOUT", cfg.ScanTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.DownloadLinkTTL, err = envDuration("SHARE_DOWNLOAD_LINK_TTL", cfg.DownloadLinkTTL); err != nil {
+		return nil, err
+	}
+	if cfg.PreviewMaxBytes, err = envBytes("SHARE_PREVIEW_MAX_BYTES", cfg.PreviewMaxBytes); err != nil {
+		return nil, err
+	}
+	if cfg.AllowSignup, err = envBool("SHARE_ACCOUNTS_SIGNUP", cfg.AllowSignup); err != nil {
+		return nil, err
+	}
+	if cfg.UserQuota, err = envBytes("SHARE_USER_QUOTA", cfg.UserQuota); err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.AccessMode == access.ModePassword && cfg.AccessPassword == "":
+		return nil, errors.New("SHARE_ACCESS_MODE=password requires SHARE_ACCESS_PASSWORD")
+	case cfg.AccessMode == access.ModeInvite && cfg.AdminPassword == "":
+		return nil, errors.New("SHARE_ACCESS_MODE=invite requires SHARE_ADMIN_PASSWORD to issue invites")
+	case cfg.OIDCIssuer != "" && cfg.OIDCClientID == "":
+		return nil, errors.New("SHARE_OIDC_ISSUER requires SHARE_OIDC_CLIENT_ID")
+	case cfg.EncryptionKey != "" && cfg.EncryptionKeyFile != "":
+		return nil, errors.New("set only one of SHARE_ENCRYPTION_KEY and SHARE_ENCRYPTION_KEY_FILE")
+	case cfg.ClamdAddress != "" && len(cfg.ScanCommand) > 0:
+		return nil, errors.New("set only one of SHARE_CLAMD_ADDRESS and SHARE_SCAN_COMMAND")
+	case cfg.ScanPolicy != ScanBlockInfected && cfg.ScanPolicy != ScanRequireClean:
+		return nil, fmt.Errorf("SHARE_SCAN_POLICY: unknown policy %q", cfg.ScanPolicy)
+	case cfg.ScanPolicy == ScanRequireClean && cfg.ClamdAddress == "" && len(cfg.ScanCommand) == 0:
+		return nil, errors.New("SHARE_SCAN_POLICY=require-clean requires SHARE_CLAMD_ADDRESS or SHARE_SCAN_COMMAND")
+	case cfg.TransferTTL <= 0:
+		return nil, errors.New("SHARE_TRANSFER_TTL must be positive")
+	case cfg.CleanupInterval <= 0:
+		return nil, errors.New("SHARE_CLEANUP_INTERVAL must be positive")
+	case cfg.ShutdownTimeout <= 0:
+		return nil, errors.New("SHARE_SHUTDOWN_TIMEOUT must be positive")
+	case cfg.MaxUploadSize <= 0:
+		return nil, errors.New("SHARE_MAX_UPLOAD_SIZE must be positive")
+	case cfg.PreviewMaxBytes <= 0:
+		return nil, errors.New("SHARE_PREVIEW_MAX_BYTES must be positive")
+	}
+	return cfg, nil
+}
+
+func envString(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envInt(key string, fallback int) (int, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envBool(key string, fallback bool) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
+
+func envFloat(key string, fallback float64) (float64, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return f, nil
+}
+
+// envBytes parses sizes such as "512MB", "2GiB" or a plain byte count.
+func envBytes(key string, fallback int64) (int64, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := ParseBytes(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+// ParseBytes converts a human readable size into bytes. Units are
+// case-insensitive and binary: KB and KiB both mean 1024 bytes.
+func ParseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+		{"B", 1},
+	}
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
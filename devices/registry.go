@@ -13,6 +13,7 @@ import (
 type Device struct {
 	ID           string    `json:"id"`
 	Name         string    `json:"name"`
+	Owner        string    `json:"owner,omitempty"`
 	RegisteredAt time.Time `json:"registeredAt"`
 	LastSeen     time.Time `json:"lastSeen"`
 }
@@ -58,7 +59,7 @@ func NewRegistry(maxDevices int) *Registry {
 }
 
 // Register inserts a new device with the provided friendly name.
-func (r *Registry) Register(name string) (*Device, error) {
+func (r *Registry) Register(name, owner string) (*Device, error) {
 	name = strings.TrimSpace(name)
 	if name == "" {
 		return nil, errors.New("device name cannot be empty")
@@ -70,10 +71,10 @@ func (r *Registry) Register(name string) (*Device, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	return r.registerLocked(name)
+	return r.registerLocked(name, owner)
 }
 
-func (r *Registry) registerLocked(name string) (*Device, error) {
+func (r *Registry) registerLocked(name, owner string) (*Device, error) {
 	if r.maxCount > 0 && len(r.devices) >= r.maxCount {
 		return nil, errors.New("device registry is full")
 	}
@@ -83,6 +84,7 @@ func (r *Registry) registerLocked(name string) (*Device, error) {
 	device := &Device{
 		ID:           id,
 		Name:         name,
+		Owner:        owner,
 		RegisteredAt: now,
 		LastSeen:     now,
 	}
@@ -90,8 +92,10 @@ func (r *Registry) registerLocked(name string) (*Device, error) {
 	return device, nil
 }
 
-// Update mutates an existing device name and touch timestamp.
-func (r *Registry) Update(id, name string) (*Device, error) {
+// Update mutates an existing device name and touch timestamp. Devices of
+// another owner, or unowned ones when owner is set, are reported as not
+// found, so a device cannot be claimed by its id.
+func (r *Registry) Update(id, name, owner string) (*Device, error) {
 	name = strings.TrimSpace(name)
 	if name == "" {
 		return nil, errors.New("device name cannot be empty")
@@ -103,7 +107,7 @@ func (r *Registry) Update(id, name string) (*Device, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	state, ok := r.devices[id]
-	if !ok {
+	if !ok || state.info.Owner != owner {
 		return nil, ErrDeviceNotFound
 	}
 	state.info.Name = name
@@ -112,9 +116,9 @@ func (r *Registry) Update(id, name string) (*Device, error) {
 }
 
 // Upsert updates a device if the id exists, otherwise registers a new device.
-func (r *Registry) Upsert(id, name string) (*Device, error) {
+func (r *Registry) Upsert(id, name, owner string) (*Device, error) {
 	if id != "" {
-		device, err := r.Update(id, name)
+		device, err := r.Update(id, name, owner)
 		if err == nil || !errors.Is(err, ErrDeviceNotFound) {
 			return device, err
 		}
@@ -122,21 +126,49 @@ func (r *Registry) Upsert(id, name string) (*Device, error) {
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.registerLocked(name)
+	return r.registerLocked(name, owner)
+}
+
+// Get returns a copy of the device with the given id.
+func (r *Registry) Get(id string) (*Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	state, ok := r.devices[id]
+	if !ok {
+		return nil, ErrDeviceNotFound
+	}
+	deviceCopy := *state.info
+	return &deviceCopy, nil
 }
 
-// List returns a copy of all known devices.
-func (r *Registry) List() []*Device {
+// List returns a copy of the devices of owner; an empty owner lists the
+// unowned devices.
+func (r *Registry) List(owner string) []*Device {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	out := make([]*Device, 0, len(r.devices))
 	for _, state := range r.devices {
+		if state.info.Owner != owner {
+			continue
+		}
 		deviceCopy := *state.info
 		out = append(out, &deviceCopy)
 	}
 	return out
 }
 
+// Stats returns the number of registered devices and pending notifications.
+func (r *Registry) Stats() (devices, pending int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, state := range r.devices {
+		if state.pending != nil {
+			pending++
+		}
+	}
+	return len(r.devices), pending
+}
+
 // Notify assigns a transfer to the given device.
 func (r *Registry) Notify(deviceID string, pending *PendingTransfer) error {
 	r.mu.Lock()
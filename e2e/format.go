@@ -0,0 +1,276 @@
+// Package e2e implements the end-to-end encrypted transfer format shared by
+// the browser (static/js/e2e.js) and the command line client.
+//
+// A transfer key is a random 256-bit AES-GCM key that only travels in the
+// share link's URL fragment. Each file is stored as
+//
+//	"SGE1" | chunk size (uint32, big endian) | nonce prefix (7 bytes) | chunks
+//
+// where every chunk holds up to chunk size bytes of plaintext sealed with
+// AES-GCM under the nonce prefix | chunk counter (uint32) | last flag (1 byte).
+// The last flag makes truncation and reordering detectable. File names, types
+// and sizes are sealed separately as metadata.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Magic starts every encrypted file.
+	Magic = "SGE1"
+	// HeaderSize is the length of the file header.
+	HeaderSize = len(Magic) + 4 + noncePrefixSize
+	// DefaultChunkSize is the plaintext size of each chunk.
+	DefaultChunkSize = 64 << 10
+	// MaxChunkSize bounds the chunk size a file may declare.
+	MaxChunkSize = 4 << 20
+	// KeySize is the length of a transfer key in bytes.
+	KeySize = 32
+
+	noncePrefixSize = 7
+	tagSize         = 16
+)
+
+// metadataAAD binds sealed metadata to its purpose so it can never be
+// mistaken for a file chunk.
+var metadataAAD = []byte("share-e2e-metadata-v1")
+
+var (
+	// ErrFormat indicates data that is not a valid encrypted file.
+	ErrFormat = errors.New("e2e: malformed ciphertext")
+	// ErrDecrypt indicates a wrong key or tampered data.
+	ErrDecrypt = errors.New("e2e: decryption failed")
+)
+
+// Metadata describes an encrypted file. It is sealed with the transfer key.
+type Metadata struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// NewKey returns a random transfer key.
+func NewKey() []byte {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// EncodeKey formats a key for the URL fragment.
+func EncodeKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodeKey parses a key taken from a URL fragment.
+func DecodeKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != KeySize {
+		return nil, errors.New("e2e: invalid key")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypt reads plaintext from src and writes the encrypted file to dst.
+func Encrypt(dst io.Writer, src io.Reader, key []byte) error {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	return encrypt(dst, src, key, DefaultChunkSize, prefix)
+}
+
+// encrypt is Encrypt with a given chunk size and nonce prefix.
+func encrypt(dst io.Writer, src io.Reader, key []byte, chunkSize int, prefix []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, HeaderSize)
+	copy(header, Magic)
+	binary.BigEndian.PutUint32(header[len(Magic):], uint32(chunkSize))
+	copy(header[len(Magic)+4:], prefix)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	// Read one chunk ahead so the final chunk can be flagged as last.
+	cur := make([]byte, chunkSize)
+	next := make([]byte, chunkSize)
+	n, err := io.ReadFull(src, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	out := make([]byte, 0, chunkSize+tagSize)
+	for counter := uint32(0); ; counter++ {
+		var m int
+		last := n < chunkSize
+		if !last {
+			m, err = io.ReadFull(src, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			last = m == 0
+		}
+		out = aead.Seal(out[:0], chunkNonce(prefix, counter, last), cur[:n], nil)
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if counter == ^uint32(0) {
+			return errors.New("e2e: file too large")
+		}
+		cur, next = next, cur
+		n = m
+	}
+}
+
+// ReadHeader parses an encrypted file header and returns its chunk size and
+// nonce prefix.
+func ReadHeader(r io.Reader) (chunkSize int, prefix []byte, err error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, ErrFormat
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return 0, nil, ErrFormat
+	}
+	size := binary.BigEndian.Uint32(header[len(Magic):])
+	if size == 0 || size > MaxChunkSize {
+		return 0, nil, ErrFormat
+	}
+	return int(size), header[len(Magic)+4:], nil
+}
+
+// ValidSize reports whether total is a possible length of an encrypted file
+// with the given chunk size: a header followed by full chunks and one final
+// chunk holding at least its authentication tag.
+func ValidSize(total int64, chunkSize int) bool {
+	body := total - int64(HeaderSize)
+	if body < tagSize {
+		return false
+	}
+	sealed := int64(chunkSize + tagSize)
+	lastLen := body % sealed
+	if lastLen == 0 {
+		lastLen = sealed
+	}
+	return lastLen >= tagSize
+}
+
+// Decrypt reads an encrypted file from src and writes the plaintext to dst.
+// Data is only written after its chunk has been authenticated.
+func Decrypt(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	chunkSize, prefix, err := ReadHeader(src)
+	if err != nil {
+		return err
+	}
+	sealed := chunkSize + tagSize
+	cur := make([]byte, sealed)
+	next := make([]byte, sealed)
+	n, err := io.ReadFull(src, cur)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return ErrFormat
+	}
+	var plain []byte
+	for counter := uint32(0); ; counter++ {
+		var m int
+		last := n < sealed
+		if !last {
+			m, err = io.ReadFull(src, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			last = m == 0
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(prefix, counter, last), cur[:n], nil)
+		if err != nil {
+			return ErrDecrypt
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		cur, next = next, cur
+		n = m
+	}
+}
+
+// SealMetadata encrypts file metadata for storage on the server.
+func SealMetadata(key []byte, meta Metadata) (string, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return sealMetadata(key, meta, nonce)
+}
+
+// sealMetadata is SealMetadata with a given nonce.
+func sealMetadata(key []byte, meta Metadata, nonce []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	plain, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, metadataAAD)), nil
+}
+
+// OpenMetadata decrypts metadata produced by SealMetadata or the browser.
+func OpenMetadata(key []byte, sealed string) (Metadata, error) {
+	var meta Metadata
+	aead, err := newAEAD(key)
+	if err != nil {
+		return meta, err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < aead.NonceSize()+tagSize {
+		return meta, ErrFormat
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], metadataAAD)
+	if err != nil {
+		return meta, ErrDecrypt
+	}
+	if err := json.Unmarshal(plain, &meta); err != nil {
+		return meta, fmt.Errorf("e2e: metadata: %w", err)
+	}
+	return meta, nil
+}
@@ -0,0 +1,256 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/vector.json")
+
+const testChunkSize = 64
+
+func testKey() []byte {
+	key := make([]byte, KeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func plaintext(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// sealed encrypts n bytes of plaintext in chunks of testChunkSize.
+func sealed(t *testing.T, n int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encrypt(&buf, bytes.NewReader(plaintext(n)), testKey(), testChunkSize, []byte("prefix7")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize + 1, 3 * testChunkSize, 3*testChunkSize + 17} {
+		ciphertext := sealed(t, n)
+		if !ValidSize(int64(len(ciphertext)), testChunkSize) {
+			t.Errorf("%d bytes: ValidSize(%d) = false", n, len(ciphertext))
+		}
+		var out bytes.Buffer
+		if err := Decrypt(&out, bytes.NewReader(ciphertext), testKey()); err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(out.Bytes(), plaintext(n)) {
+			t.Errorf("%d bytes: plaintext differs", n)
+		}
+	}
+
+	// The exported functions use the default chunk size and a random prefix.
+	key := NewKey()
+	plain := plaintext(2*DefaultChunkSize + 100)
+	var ciphertext, out bytes.Buffer
+	if err := Encrypt(&ciphertext, bytes.NewReader(plain), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := Decrypt(&out, &ciphertext, key); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plain) {
+		t.Error("plaintext differs")
+	}
+}
+
+func TestDecryptRejectsAlteredStreams(t *testing.T) {
+	const chunk = testChunkSize + tagSize
+	full := sealed(t, 3*testChunkSize)
+	partial := sealed(t, 2*testChunkSize+10)
+	other := sealed(t, testChunkSize)
+	chunkAt := func(c []byte, i int) []byte {
+		start := HeaderSize + i*chunk
+		return c[start:min(start+chunk, len(c))]
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	header := full[:HeaderSize]
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{"header only", header},
+		{"truncated header", full[:HeaderSize-1]},
+		{"last chunk dropped", full[:HeaderSize+2*chunk]},
+		{"partial last chunk dropped", partial[:HeaderSize+2*chunk]},
+		{"cut inside a chunk", full[:HeaderSize+chunk+10]},
+		{"cut inside the last chunk", partial[:len(partial)-1]},
+		{"chunks swapped", join(header, chunkAt(full, 1), chunkAt(full, 0), chunkAt(full, 2))},
+		{"last chunk moved", join(header, chunkAt(full, 0), chunkAt(full, 2), chunkAt(full, 1))},
+		{"chunk repeated", join(header, chunkAt(full, 0), chunkAt(full, 0), chunkAt(full, 1), chunkAt(full, 2))},
+		{"extended with a chunk", join(full, chunkAt(full, 2))},
+		{"extended after a partial chunk", join(partial, []byte{0})},
+		{"extended with another file", join(full, other[HeaderSize:])},
+		{"flipped bit", join(full[:HeaderSize+5], []byte{full[HeaderSize+5] ^ 1}, full[HeaderSize+6:])},
+		{"other prefix", join([]byte(Magic), full[4:8], []byte("prefix8"), full[HeaderSize:])},
+		{"other chunk size", join([]byte(Magic), []byte{0, 0, 0, 32}, full[8:])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Decrypt(&out, bytes.NewReader(tt.ciphertext), testKey())
+			if !errors.Is(err, ErrDecrypt) && !errors.Is(err, ErrFormat) {
+				t.Fatalf("err = %v, want ErrDecrypt or ErrFormat", err)
+			}
+		})
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		if err := Decrypt(&bytes.Buffer{}, bytes.NewReader(full), NewKey()); !errors.Is(err, ErrDecrypt) {
+			t.Fatalf("err = %v, want ErrDecrypt", err)
+		}
+	})
+	t.Run("no plaintext before authentication", func(t *testing.T) {
+		var out bytes.Buffer
+		_ = Decrypt(&out, bytes.NewReader(join(header, chunkAt(full, 1), chunkAt(full, 0))), testKey())
+		if out.Len() != 0 {
+			t.Fatalf("wrote %d bytes of unauthenticated plaintext", out.Len())
+		}
+	})
+}
+
+func TestValidSize(t *testing.T) {
+	for _, tt := range []struct {
+		total int64
+		want  bool
+	}{
+		{int64(HeaderSize), false},
+		{int64(HeaderSize + tagSize - 1), false},
+		{int64(HeaderSize + tagSize), true},
+		{int64(HeaderSize + testChunkSize + tagSize), true},
+		{int64(HeaderSize + testChunkSize + tagSize + tagSize - 1), false},
+		{int64(HeaderSize + testChunkSize + 2*tagSize), true},
+	} {
+		if got := ValidSize(tt.total, testChunkSize); got != tt.want {
+			t.Errorf("ValidSize(%d) = %v, want %v", tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	key := NewKey()
+	meta := Metadata{Name: "report.pdf", Type: "application/pdf", Size: 1234}
+	text, err := SealMetadata(key, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := OpenMetadata(key, text)
+	if err != nil || got != meta {
+		t.Fatalf("OpenMetadata = %+v, %v", got, err)
+	}
+	if _, err := OpenMetadata(NewKey(), text); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("wrong key: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := OpenMetadata(key, "AAAA"); !errors.Is(err, ErrFormat) {
+		t.Errorf("short: err = %v, want ErrFormat", err)
+	}
+}
+
+// vector is a fixed encryption that the Go and browser implementations
+// must both reproduce; testdata/check_vector.js checks the browser side.
+type vector struct {
+	Key      string     `json:"key"`
+	Metadata Metadata   `json:"metadata"`
+	Sealed   string     `json:"sealedMetadata"`
+	Files    []testFile `json:"files"`
+}
+
+type testFile struct {
+	ChunkSize  int    `json:"chunkSize"`
+	Prefix     string `json:"prefix"`
+	Plaintext  string `json:"plaintext"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+func makeVector(t *testing.T) vector {
+	t.Helper()
+	key := testKey()
+	v := vector{Key: EncodeKey(key), Metadata: Metadata{Name: "héllo wörld.txt", Type: "text/plain", Size: 70}}
+	var err error
+	if v.Sealed, err = sealMetadata(key, v.Metadata, []byte("metadatanonc")); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{70, 64, 0} {
+		prefix := []byte{1, 2, 3, 4, 5, 6, byte(n)}
+		var buf bytes.Buffer
+		if err := encrypt(&buf, bytes.NewReader(plaintext(n)), key, 32, prefix); err != nil {
+			t.Fatal(err)
+		}
+		v.Files = append(v.Files, testFile{
+			ChunkSize:  32,
+			Prefix:     hex.EncodeToString(prefix),
+			Plaintext:  hex.EncodeToString(plaintext(n)),
+			Ciphertext: hex.EncodeToString(buf.Bytes()),
+		})
+	}
+	return v
+}
+
+func TestVector(t *testing.T) {
+	path := filepath.Join("testdata", "vector.json")
+	got, err := json.MarshalIndent(makeVector(t), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("encryption no longer matches %s; the format must not change", path)
+	}
+
+	var v vector
+	if err := json.Unmarshal(want, &v); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range v.Files {
+		ciphertext, _ := hex.DecodeString(f.Ciphertext)
+		var out bytes.Buffer
+		if err := Decrypt(&out, bytes.NewReader(ciphertext), testKey()); err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(out.Bytes()) != f.Plaintext {
+			t.Errorf("%d bytes: plaintext differs", len(f.Plaintext)/2)
+		}
+	}
+}
+
+// TestBrowserVector runs the browser implementation against the vector
+// under Node.js, which provides the same WebCrypto API.
+func TestBrowserVector(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not installed")
+	}
+	cmd := exec.Command(node, filepath.Join("testdata", "check_vector.js"),
+		filepath.Join("..", "static", "js", "e2e.js"), filepath.Join("testdata", "vector.json"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
@@ -0,0 +1,86 @@
+// check_vector.js checks static/js/e2e.js against the fixed vector written
+// by the Go tests. Run by TestBrowserVector as
+//
+//	node check_vector.js <e2e.js> <vector.json>
+"use strict";
+
+const fs = require("fs");
+const vm = require("vm");
+
+const [source, vectorPath] = process.argv.slice(2);
+vm.runInThisContext(fs.readFileSync(source, "utf8") + "\nglobalThis.E2E = E2E;", { filename: source });
+const vector = JSON.parse(fs.readFileSync(vectorPath, "utf8"));
+
+const fromHex = (text) => Uint8Array.from(text.match(/../g) || [], (b) => parseInt(b, 16));
+const toHex = (bytes) => Buffer.from(bytes).toString("hex");
+
+function streamOf(bytes, pieceSize) {
+  let offset = 0;
+  return new ReadableStream({
+    pull(controller) {
+      if (offset >= bytes.length) {
+        controller.close();
+        return;
+      }
+      controller.enqueue(bytes.slice(offset, offset + pieceSize));
+      offset += pieceSize;
+    },
+  });
+}
+
+async function decrypt(bytes, key, pieceSize) {
+  const parts = [];
+  await E2E.decryptStream(streamOf(bytes, pieceSize), key, (chunk) => parts.push(chunk));
+  return Buffer.concat(parts);
+}
+
+async function expectFailure(name, promise) {
+  try {
+    await promise;
+  } catch {
+    return;
+  }
+  throw new Error(`${name}: decryption succeeded`);
+}
+
+async function main() {
+  const key = await E2E.decodeKey(vector.key);
+  const meta = await E2E.openMetadata(vector.sealedMetadata, key);
+  if (JSON.stringify(meta) !== JSON.stringify(vector.metadata)) {
+    throw new Error(`metadata: got ${JSON.stringify(meta)}`);
+  }
+  for (const file of vector.files) {
+    const plain = fromHex(file.plaintext);
+    const ciphertext = fromHex(file.ciphertext);
+    const sealed = await E2E.encryptFile(new Blob([plain]), key, file.chunkSize, fromHex(file.prefix));
+    const got = toHex(new Uint8Array(await sealed.arrayBuffer()));
+    if (got !== file.ciphertext) {
+      throw new Error(`${plain.length} bytes: ciphertext differs\n got ${got}\nwant ${file.ciphertext}`);
+    }
+    // Odd piece sizes split chunks across reads the way a network would.
+    for (const pieceSize of [1, 7, ciphertext.length || 1]) {
+      const out = await decrypt(ciphertext, key, pieceSize);
+      if (toHex(out) !== file.plaintext) {
+        throw new Error(`${plain.length} bytes: plaintext differs with reads of ${pieceSize}`);
+      }
+    }
+    const sealedSize = file.chunkSize + 16;
+    await expectFailure("truncated", decrypt(ciphertext.slice(0, ciphertext.length - 1), key, 7));
+    await expectFailure("extended", decrypt(Buffer.concat([ciphertext, ciphertext.slice(15, 15 + sealedSize)]), key, 7));
+    if (ciphertext.length > 15 + sealedSize) {
+      await expectFailure("last chunk dropped", decrypt(ciphertext.slice(0, 15 + sealedSize), key, 7));
+      const reordered = Buffer.concat([
+        ciphertext.slice(0, 15),
+        ciphertext.slice(15 + sealedSize, 15 + 2 * sealedSize),
+        ciphertext.slice(15, 15 + sealedSize),
+        ciphertext.slice(15 + 2 * sealedSize),
+      ]);
+      await expectFailure("reordered", decrypt(reordered, key, 7));
+    }
+  }
+}
+
+main().catch((err) => {
+  console.error(err.message);
+  process.exit(1);
+});
@@ -1,3 +1,13 @@
 module share
 
 go 1.24.2
+
+require (
+	golang.org/x/crypto v0.45.0
+	lukechampine.com/blake3 v1.4.1
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+)
@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"share/access"
+	"share/config"
+	"share/logging"
+)
+
+const sessionCookieName = "share_session"
+
+type loginPageData struct {
+	Next        string
+	Mode        string
+	Error       string
+	Accounts    bool
+	AllowSignup bool
+	SecretLogin bool
+	SSO         bool
+	// AdminOnly limits the password form to the admin password because
+	// senders sign in with an account or SSO.
+	AdminOnly bool
+	Username  string
+}
+
+type adminPageData struct {
+	Mode       string
+	Invites    []*access.Invite
+	NewInvite  *access.Invite
+	Now        time.Time
+	ShareGated bool
+
+	Accounts  bool
+	Users     []*access.User
+	UserError string
+}
+
+func (s *Server) currentSession(r *http.Request) (*access.Session, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+	return s.gate.Session(cookie.Value)
+}
+
+// RequireAccess admits only visitors with a session when the instance gate is
+// enabled. Pages redirect to the login form; API calls get 401.
+func (s *Server) RequireAccess(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.gate.Enabled() {
+			next(w, r)
+			return
+		}
+		if session, ok := s.currentSession(r); ok && s.gate.Admits(session) {
+			next(w, r)
+			return
+		}
+		denyAccess(w, r)
+	}
+}
+
+// RequireUser admits only signed-in local users. Without accounts the
+// user routes do not exist.
+func (s *Server) RequireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.gate.Accounts() == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if s.sessionUser(r) != "" {
+			next(w, r)
+			return
+		}
+		denyAccess(w, r)
+	}
+}
+
+// sessionUser returns the signed-in local username, if any.
+func (s *Server) sessionUser(r *http.Request) string {
+	if session, ok := s.currentSession(r); ok {
+		return session.Username
+	}
+	return ""
+}
+
+// sessionOwner returns the identity uploads and devices are attributed to:
+// the local username or the OIDC subject.
+func (s *Server) sessionOwner(r *http.Request) string {
+	if session, ok := s.currentSession(r); ok {
+		return session.Owner()
+	}
+	return ""
+}
+
+// RequireShareAccess gates the receiver routes only when the instance is
+// configured to protect share links as well.
+func (s *Server) RequireShareAccess(next http.HandlerFunc) http.HandlerFunc {
+	if !s.cfg.GateShareLinks {
+		return next
+	}
+	return s.RequireAccess(next)
+}
+
+// RequireAdmin admits only admin sessions. Without an admin password the
+// admin routes do not exist.
+func (s *Server) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.gate.AdminEnabled() {
+			http.NotFound(w, r)
+			return
+		}
+		if session, ok := s.currentSession(r); ok && session.Admin {
+			next(w, r)
+			return
+		}
+		denyAccess(w, r)
+	}
+}
+
+func denyAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	target := "/login?next=" + url.QueryEscape(r.URL.RequestURI())
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// LoginHandler shows the instance login form and starts sessions.
+func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	data := s.newLoginPageData(r)
+	if !s.gate.Enabled() && !s.gate.AdminEnabled() {
+		http.Redirect(w, r, data.Next, http.StatusSeeOther)
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		ip := clientIP(r)
+		key := "login:" + ip
+		logger := logging.FromContext(r.Context())
+		if wait, _ := s.pinAttempts.Attempt(key); wait > 0 {
+			writeRetryAfter(w, wait)
+			status = http.StatusTooManyRequests
+			data.Error = fmt.Sprintf("Too many failed attempts. Try again in %s.", formatWait(wait))
+		} else {
+			var session *access.Session
+			var err error
+			if username := r.FormValue("username"); username != "" {
+				data.Username = username
+				session, err = s.gate.LoginUser(username, r.FormValue("password"))
+			} else {
+				session, err = s.gate.Login(r.FormValue("secret"))
+			}
+			if err == nil {
+				s.pinAttempts.Reset(key)
+				s.setSessionCookie(w, r, session)
+				logger.Info("login succeeded", "admin", session.Admin, "user", session.Username, "remote", r.RemoteAddr)
+				http.Redirect(w, r, data.Next, http.StatusSeeOther)
+				return
+			}
+			logger.Warn("login failed", "remote", r.RemoteAddr, "error", err)
+			status = http.StatusUnauthorized
+			data.Error = "Incorrect password or invite code."
+			if errors.Is(err, access.ErrInviteExhausted) {
+				data.Error = "This invite code has expired or has been used up."
+			}
+		}
+	}
+
+	renderLoginPage(w, r, status, data)
+}
+
+func (s *Server) newLoginPageData(r *http.Request) loginPageData {
+	adminOnly := s.gate.Accounts() != nil || s.gate.SSOEnabled()
+	return loginPageData{
+		Next:        safeRedirect(r.FormValue("next")),
+		Mode:        string(s.gate.Mode()),
+		Accounts:    s.gate.Accounts() != nil,
+		AllowSignup: s.gate.Accounts() != nil && s.cfg.AllowSignup,
+		SecretLogin: s.gate.AdminEnabled() || (!adminOnly && s.gate.Mode() != access.ModeOpen),
+		SSO:         s.gate.SSOEnabled(),
+		AdminOnly:   adminOnly,
+	}
+}
+
+func renderLoginPage(w http.ResponseWriter, r *http.Request, status int, data loginPageData) {
+	renderTemplate(w, r, status, "login.html", data, nil)
+}
+
+// SignupHandler lets visitors create a local account when self-service
+// sign-up is enabled.
+func (s *Server) SignupHandler(w http.ResponseWriter, r *http.Request) {
+	accounts := s.gate.Accounts()
+	if accounts == nil || !s.cfg.AllowSignup {
+		http.NotFound(w, r)
+		return
+	}
+	data := s.newLoginPageData(r)
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	username, password := r.FormValue("username"), r.FormValue("password")
+	data.Username = username
+	if _, err := accounts.Create(username, password, 0); err != nil {
+		data.Error = signupError(err)
+		renderLoginPage(w, r, http.StatusBadRequest, data)
+		return
+	}
+	session, err := s.gate.LoginUser(username, password)
+	if err != nil {
+		http.Error(w, "unable to sign in", http.StatusInternalServerError)
+		return
+	}
+	logging.FromContext(r.Context()).Info("user signed up", "user", session.Username)
+	s.setSessionCookie(w, r, session)
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+}
+
+func signupError(err error) string {
+	switch {
+	case errors.Is(err, access.ErrUserExists), errors.Is(err, access.ErrInvalidUsername), errors.Is(err, access.ErrWeakPassword):
+		return err.Error()
+	default:
+		return "Unable to create the account."
+	}
+}
+
+// LogoutHandler ends the current session.
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if session, ok := s.currentSession(r); ok {
+		s.gate.Logout(session.ID)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) setSessionCookie(w http.ResponseWriter, r *http.Request, session *access.Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  session.ExpiresAt,
+	})
+}
+
+// AdminPage lists invite codes and local users.
+func (s *Server) AdminPage(w http.ResponseWriter, r *http.Request) {
+	s.renderAdminPage(w, r, adminPageData{})
+}
+
+// CreateInviteHandler issues a new invite code.
+func (s *Server) CreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	maxUses, _ := strconv.Atoi(r.FormValue("maxUses"))
+	hours, _ := strconv.Atoi(r.FormValue("expiresHours"))
+	invite := s.gate.CreateInvite(r.FormValue("label"), max(maxUses, 0), time.Duration(max(hours, 0))*time.Hour)
+	logging.FromContext(r.Context()).Info("invite created", "label", invite.Label, "max_uses", invite.MaxUses)
+	s.renderAdminPage(w, r, adminPageData{NewInvite: invite})
+}
+
+// RevokeInviteHandler deletes an invite code and the sessions it started.
+func (s *Server) RevokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	if !confirmDestructive(w, r, confirmPageData{
+		Title:     "Revoke invite code?",
+		Message:   fmt.Sprintf("Invite code %s stops working and everyone who signed in with it is signed out.", code),
+		Action:    "/admin/invites/revoke",
+		Fields:    []hiddenField{{"code", code}},
+		Confirm:   "Revoke",
+		CancelURL: "/admin",
+	}) {
+		return
+	}
+	s.gate.RevokeInvite(code)
+	logging.FromContext(r.Context()).Info("invite revoked")
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// CreateUserHandler adds a local account.
+func (s *Server) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	accounts := s.gate.Accounts()
+	if accounts == nil || r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	quota, err := parseQuota(r.FormValue("quota"))
+	if err != nil {
+		s.renderAdminPage(w, r, adminPageData{UserError: err.Error()})
+		return
+	}
+	user, err := accounts.Create(r.FormValue("username"), r.FormValue("password"), quota)
+	if err != nil {
+		s.renderAdminPage(w, r, adminPageData{UserError: signupError(err)})
+		return
+	}
+	logging.FromContext(r.Context()).Info("user created", "user", user.Username)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// SetUserQuotaHandler changes a user's storage quota.
+func (s *Server) SetUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	accounts := s.gate.Accounts()
+	if accounts == nil || r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	quota, err := parseQuota(r.FormValue("quota"))
+	if err != nil {
+		s.renderAdminPage(w, r, adminPageData{UserError: err.Error()})
+		return
+	}
+	if err := accounts.SetQuota(r.FormValue("username"), quota); err != nil {
+		s.renderAdminPage(w, r, adminPageData{UserError: err.Error()})
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// DeleteUserHandler removes a local account and signs it out everywhere.
+func (s *Server) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	accounts := s.gate.Accounts()
+	if accounts == nil {
+		http.NotFound(w, r)
+		return
+	}
+	username := r.FormValue("username")
+	if !confirmDestructive(w, r, confirmPageData{
+		Title:     "Delete user?",
+		Message:   fmt.Sprintf("The account %s and its transfer history are deleted and its sessions are signed out.", username),
+		Action:    "/admin/users/delete",
+		Fields:    []hiddenField{{"username", username}},
+		Confirm:   "Delete user",
+		CancelURL: "/admin",
+	}) {
+		return
+	}
+	if err := accounts.Delete(username); err != nil {
+		s.renderAdminPage(w, r, adminPageData{UserError: err.Error()})
+		return
+	}
+	s.gate.LogoutUser(username)
+	logging.FromContext(r.Context()).Info("user deleted", "user", username)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// parseQuota accepts sizes such as "5GB"; empty means the instance default.
+func parseQuota(input string) (int64, error) {
+	if strings.TrimSpace(input) == "" {
+		return 0, nil
+	}
+	return config.ParseBytes(input)
+}
+
+func (s *Server) renderAdminPage(w http.ResponseWriter, r *http.Request, data adminPageData) {
+	data.Mode = string(s.gate.Mode())
+	data.Invites = s.gate.Invites()
+	data.Now = time.Now()
+	data.ShareGated = s.cfg.GateShareLinks
+	if accounts := s.gate.Accounts(); accounts != nil {
+		data.Accounts = true
+		data.Users = accounts.List()
+	}
+	renderTemplate(w, r, http.StatusOK, "admin.html", data, template.FuncMap{
+		"mb": func(bytes int64) float64 { return float64(bytes) / (1024 * 1024) },
+	})
+}
+
+// safeRedirect only allows local absolute paths as redirect targets.
+func safeRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"share/logging"
+	"share/metrics"
+	"share/storage"
+)
+
+// ArchiveHandler streams all downloadable files of a transfer as one ZIP
+// archive. With a variant, photos are packed in that size instead of their
+// originals; other files are always included as they are. Files are stored
+// uncompressed since most shared media is compressed already.
+func (s *Server) ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	transfer, err := s.transferFromRequest(r)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	if transfer.PinHash != "" && !s.hasPinAccess(r, transfer) {
+		http.Error(w, "pin required", http.StatusForbidden)
+		return
+	}
+	if transfer.Encrypted {
+		http.Error(w, "end-to-end encrypted files must be downloaded one by one", http.StatusBadRequest)
+		return
+	}
+	variant := r.URL.Query().Get("variant")
+	if variant != "" && variant != "original" {
+		if _, ok := storage.LookupVariant(variant); !ok {
+			http.Error(w, errUnknownVariant.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var files []*storage.StoredFile
+	for i := range transfer.Files {
+		if s.downloadBlocked(&transfer.Files[i]) == "" {
+			files = append(files, &transfer.Files[i])
+		}
+	}
+	if len(files) == 0 {
+		http.Error(w, "no files available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"transfer-%s.zip\"", transfer.ID))
+	w.Header().Set("Content-Type", "application/zip")
+	logger := logging.FromContext(r.Context()).With("transfer_id", transfer.ID)
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() { metrics.DownloadedBytesTotal.Add(float64(cw.n)) }()
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	zw := zip.NewWriter(cw)
+	names := make(map[string]bool)
+	for _, stored := range files {
+		fileVariant := ""
+		if storage.HasVariants(transfer, stored) {
+			fileVariant = variant
+		}
+		// Headers are sent already, so a file that cannot be read ends the
+		// archive early and the client sees a truncated download.
+		if err := s.addToArchive(zw, transfer, stored, fileVariant, names); err != nil {
+			logger.Error("writing archive failed", "file_id", stored.ID, "bytes", cw.n, "error", err)
+			return
+		}
+		metrics.DownloadsTotal.With(transfer.Category).Inc()
+	}
+	if err := zw.Close(); err != nil {
+		logger.Warn("archive download interrupted", "bytes", cw.n, "error", err)
+		return
+	}
+	logger.Info("archive downloaded", "files", len(files), "bytes", cw.n, "variant", variant)
+}
+
+func (s *Server) addToArchive(zw *zip.Writer, transfer *storage.Transfer, stored *storage.StoredFile, variant string, names map[string]bool) error {
+	f, err := s.openDownload(transfer, stored, variant)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     archiveName(f.Name, stored.ID, names),
+		Method:   zip.Store,
+		Modified: transfer.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		return err
+	}
+	return nil
+}
+
+// archiveName returns a unique entry name for a file in an archive. Any
+// directories in the uploaded name are dropped, so entries cannot be
+// extracted outside the destination folder.
+func archiveName(name, fileID string, taken map[string]bool) string {
+	base := path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if base == "." || base == "/" || base == ".." {
+		base = fileID
+	}
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	candidate := base
+	for n := 2; taken[candidate]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+	}
+	taken[candidate] = true
+	return candidate
+}
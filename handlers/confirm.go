@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+type hiddenField struct {
+	Name  string
+	Value string
+}
+
+// confirmPageData describes a destructive action awaiting confirmation, or
+// with Done set, the outcome of one.
+type confirmPageData struct {
+	Title     string
+	Message   string
+	Action    string
+	Fields    []hiddenField
+	Confirm   string
+	CancelURL string
+	Done      bool
+}
+
+// confirmDestructive dispatches on the method of a destructive endpoint.
+// GET and HEAD render a confirmation page that re-submits the request as a
+// POST, so link previewers and prefetching browsers never change anything.
+// It reports whether the caller should carry out the action.
+func confirmDestructive(w http.ResponseWriter, r *http.Request, data confirmPageData) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodDelete:
+		return true
+	case http.MethodGet, http.MethodHead:
+		renderTemplate(w, r, http.StatusOK, "confirm.html", data, nil)
+		return false
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+}
+
+func renderDonePage(w http.ResponseWriter, r *http.Request, title, message string) {
+	renderTemplate(w, r, http.StatusOK, "confirm.html", confirmPageData{
+		Title:   title,
+		Message: message,
+		Done:    true,
+	}, nil)
+}
@@ -2,30 +2,29 @@ package handlers
 
 import (
 	"encoding/json"
-	"html/template"
 	"net/http"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"share/devices"
+	"share/logging"
 )
 
 func (s *Server) DevicePage(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles(filepath.Join("templates", "device.html")))
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	_ = tmpl.Execute(w, map[string]string{
+	renderTemplate(w, r, http.StatusOK, "device.html", map[string]string{
 		"DeviceID": r.URL.Query().Get("id"),
-	})
+	}, nil)
 }
 
+// ListDevicesHandler lists the devices of the signed-in user, or the
+// unowned ones to anonymous callers.
 func (s *Server) ListDevicesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	_ = json.NewEncoder(w).Encode(s.registry.List())
+	_ = json.NewEncoder(w).Encode(s.registry.List(s.sessionOwner(r)))
 }
 
 func (s *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Request) {
@@ -41,11 +40,13 @@ func (s *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid payload", http.StatusBadRequest)
 		return
 	}
-	device, err := s.registry.Upsert(payload.ID, payload.Name)
+	device, err := s.registry.Upsert(payload.ID, payload.Name, s.sessionOwner(r))
 	if err != nil {
+		logging.FromContext(r.Context()).Warn("device registration rejected", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	logging.FromContext(r.Context()).Info("device registered", "device_id", device.ID, "renamed", device.ID == payload.ID)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	_ = json.NewEncoder(w).Encode(device)
 }
@@ -87,6 +88,7 @@ func (s *Server) NotifyDeviceHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	logging.FromContext(r.Context()).Info("device notified", "device_id", payload.DeviceID, "transfer_id", transfer.ID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -100,6 +102,10 @@ func (s *Server) DevicePendingHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing device id", http.StatusBadRequest)
 		return
 	}
+	if !s.ownsDevice(r, deviceID) {
+		http.Error(w, devices.ErrDeviceNotFound.Error(), http.StatusBadRequest)
+		return
+	}
 	pending, err := s.registry.Pending(deviceID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -113,8 +119,11 @@ func (s *Server) DevicePendingHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(pending)
 }
 
+// ClearPendingHandler dismisses a device notification. It only accepts POST
+// and DELETE so a visited URL can never clear anything.
 func (s *Server) ClearPendingHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -130,6 +139,21 @@ func (s *Server) ClearPendingHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing device id", http.StatusBadRequest)
 		return
 	}
+	if !s.ownsDevice(r, payload.DeviceID) {
+		http.Error(w, devices.ErrDeviceNotFound.Error(), http.StatusBadRequest)
+		return
+	}
 	s.registry.Clear(payload.DeviceID, payload.TransferID)
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// ownsDevice reports whether the requester may read a device's pending
+// transfers: unowned devices are open to anyone, owned ones only to their
+// owner.
+func (s *Server) ownsDevice(r *http.Request, deviceID string) bool {
+	device, err := s.registry.Get(deviceID)
+	if err != nil {
+		return true
+	}
+	return device.Owner == "" || device.Owner == s.sessionOwner(r)
+}
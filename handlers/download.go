@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"share/logging"
+	"share/storage"
+)
+
+var (
+	errLinkInvalid = errors.New("invalid download link")
+	errLinkExpired = errors.New("download link expired")
+	errLinkUsed    = errors.New("download link already used")
+)
+
+// downloadLinks mints and verifies signed URLs for a single stored file.
+// Single-use links carry a nonce that is remembered until the link expires.
+type downloadLinks struct {
+	key []byte
+
+	mu   sync.Mutex
+	used map[string]*usedLink
+}
+
+// usedLink records the byte ranges a single-use link has served, and those
+// claimed by downloads in progress. Every byte goes out once: an
+// interrupted download can be resumed and a download split into ranges,
+// but nothing can be fetched a second time, from any client.
+type usedLink struct {
+	expires time.Time
+	served  []byteRange
+}
+
+// byteRange is the half-open range [start, end) of a file.
+type byteRange struct {
+	start, end int64
+}
+
+func (b byteRange) overlaps(o byteRange) bool {
+	return b.start < o.end && o.start < b.end
+}
+
+// downloadClaim is the part of a file one GET request on a single-use link
+// may serve. exact is false for requests naming several ranges, which
+// claim the whole file.
+type downloadClaim struct {
+	nonce string
+	rng   byteRange
+	exact bool
+}
+
+type signedLink struct {
+	TransferID string
+	FileID     string
+	Variant    string
+	Nonce      string
+	Expires    time.Time
+}
+
+func newDownloadLinks(key []byte) *downloadLinks {
+	return &downloadLinks{key: key, used: make(map[string]*usedLink)}
+}
+
+// sign returns the query of a download URL for fileID in transfer, resized
+// to variant if one is given, that is valid until expires. A single-use
+// link serves the file once.
+func (d *downloadLinks) sign(transferID, fileID, variant string, expires time.Time, singleUse bool) url.Values {
+	link := signedLink{TransferID: transferID, FileID: fileID, Variant: variant, Expires: expires}
+	if singleUse {
+		nonce := make([]byte, 12)
+		if _, err := rand.Read(nonce); err != nil {
+			panic(err)
+		}
+		link.Nonce = hex.EncodeToString(nonce)
+	}
+	q := url.Values{
+		"id":   {transferID},
+		"file": {fileID},
+		"exp":  {strconv.FormatInt(expires.Unix(), 10)},
+		"sig":  {d.signature(link)},
+	}
+	if link.Variant != "" {
+		q.Set("variant", link.Variant)
+	}
+	if link.Nonce != "" {
+		q.Set("once", link.Nonce)
+	}
+	return q
+}
+
+// verify checks the signature and expiry of a download URL query.
+func (d *downloadLinks) verify(q url.Values) (*signedLink, error) {
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return nil, errLinkInvalid
+	}
+	link := &signedLink{
+		TransferID: q.Get("id"),
+		FileID:     q.Get("file"),
+		Variant:    q.Get("variant"),
+		Nonce:      q.Get("once"),
+		Expires:    time.Unix(exp, 0),
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(d.signature(*link))) {
+		return nil, errLinkInvalid
+	}
+	if time.Now().After(link.Expires) {
+		return nil, errLinkExpired
+	}
+	return link, nil
+}
+
+// claim reserves the bytes a GET request on a single-use link asks for, out
+// of content of size bytes. It returns errLinkUsed when any of them was
+// served before or is being served. Other requests and links need no claim
+// and get nil.
+func (d *downloadLinks) claim(link *signedLink, r *http.Request, size int64) (*downloadClaim, error) {
+	if link == nil || link.Nonce == "" || r.Method != http.MethodGet {
+		return nil, nil
+	}
+	// A stale If-Range would turn the range into the whole file.
+	r.Header.Del("If-Range")
+	rng, exact := requestedRange(r.Header.Get("Range"), size)
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for nonce, used := range d.used {
+		if now.After(used.expires) {
+			delete(d.used, nonce)
+		}
+	}
+	used, ok := d.used[link.Nonce]
+	if !ok {
+		used = &usedLink{expires: link.Expires}
+		d.used[link.Nonce] = used
+	}
+	for _, served := range used.served {
+		if served.overlaps(rng) {
+			return nil, errLinkUsed
+		}
+	}
+	used.served = append(used.served, rng)
+	return &downloadClaim{nonce: link.Nonce, rng: rng, exact: exact}, nil
+}
+
+// settle replaces a claim with what the response delivered: all of it when
+// complete, otherwise the written bytes from its start, so the rest can
+// still be fetched. Responses that wrote nothing spend nothing.
+func (d *downloadLinks) settle(c *downloadClaim, written int64, complete bool) {
+	if c == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	used, ok := d.used[c.nonce]
+	if !ok {
+		return
+	}
+	for i, served := range used.served {
+		if served == c.rng {
+			used.served = slices.Delete(used.served, i, i+1)
+			break
+		}
+	}
+	switch {
+	case complete, !c.exact && written > 0:
+		used.served = append(used.served, c.rng)
+	case written > 0:
+		used.served = append(used.served, byteRange{c.rng.start, min(c.rng.end, c.rng.start+written)})
+	}
+}
+
+// requestedRange returns the bytes of a size-byte file that a Range header
+// asks for, the way ServeContent reads it. Several ranges, or a header
+// ServeContent refuses, count as the whole file and are not exact. An
+// empty file counts as one byte, so its download spends the link.
+func requestedRange(header string, size int64) (byteRange, bool) {
+	whole := byteRange{0, max(size, 1)}
+	if header == "" {
+		return whole, true
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return whole, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return whole, false
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return whole, false
+		}
+		return byteRange{max(size-n, 0), size}, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return whole, false
+	}
+	end := size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return whole, false
+		}
+		end = min(n+1, size)
+	}
+	return byteRange{start, end}, true
+}
+
+func (d *downloadLinks) signature(link signedLink) string {
+	mac := hmac.New(sha256.New, d.key)
+	fmt.Fprintf(mac, "download\n%s\n%s\n%s\n%d\n%s", link.TransferID, link.FileID, link.Variant, link.Expires.Unix(), link.Nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedFileURL returns a download URL for one file, or its resized
+// variant, that expires after ttl or with the transfer, whichever comes
+// first.
+func (s *Server) signedFileURL(r *http.Request, transfer *storage.Transfer, fileID, variant string, ttl time.Duration, singleUse bool) (string, time.Time) {
+	expires := time.Now().Add(ttl)
+	if transferExpiry := transfer.CreatedAt.Add(s.cfg.TransferTTL); ttl <= 0 || expires.After(transferExpiry) {
+		expires = transferExpiry
+	}
+	q := s.downloadLinks.sign(transfer.ID, fileID, variant, expires, singleUse)
+	return fmt.Sprintf("%s://%s/file?%s", requestScheme(r), r.Host, q.Encode()), expires
+}
+
+// fileFromSignedURL resolves the transfer and file of a signed download URL.
+// The caller claims the bytes it serves from single-use links, once it
+// knows the size of the content.
+func (s *Server) fileFromSignedURL(r *http.Request) (*storage.Transfer, *storage.StoredFile, *signedLink, error) {
+	link, err := s.downloadLinks.verify(r.URL.Query())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	transfer, ok := s.store.Lookup(link.TransferID)
+	if !ok {
+		return nil, nil, nil, storage.ErrNotFound
+	}
+	stored, err := findFile(transfer, link.FileID)
+	if err != nil {
+		return nil, nil, nil, storage.ErrNotFound
+	}
+	return transfer, stored, link, nil
+}
+
+// CreateDownloadLinkHandler mints a signed link to one file. The caller needs
+// the transfer token and, for PIN-protected transfers, PIN access, since the
+// link itself skips both.
+func (s *Server) CreateDownloadLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID        string `json:"id"`
+		File      string `json:"file"`
+		Variant   string `json:"variant"`
+		TTL       int64  `json:"ttlSeconds"`
+		SingleUse bool   `json:"singleUse"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.ID == "" {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	transfer, err := s.store.Authorize(payload.ID, shareToken(r, payload.ID))
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	if transfer.PinHash != "" && !s.hasPinAccess(r, transfer) {
+		http.Error(w, "pin required", http.StatusForbidden)
+		return
+	}
+	stored, err := findFile(transfer, payload.File)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if payload.Variant == "original" {
+		payload.Variant = ""
+	}
+	if payload.Variant != "" {
+		if _, ok := storage.LookupVariant(payload.Variant); !ok || !storage.HasVariants(transfer, stored) {
+			http.Error(w, "no such size of this file", http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := s.cfg.DownloadLinkTTL
+	if payload.TTL > 0 {
+		ttl = time.Duration(payload.TTL) * time.Second
+	}
+	link, expires := s.signedFileURL(r, transfer, payload.File, payload.Variant, ttl, payload.SingleUse)
+	logging.FromContext(r.Context()).Info("download link created",
+		"transfer_id", transfer.ID,
+		"file_id", payload.File,
+		"variant", payload.Variant,
+		"single_use", payload.SingleUse,
+		"expires", expires,
+	)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"url":       link,
+		"expiresAt": expires.UTC(),
+		"singleUse": payload.SingleUse,
+	})
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"share/config"
+	"share/devices"
+	"share/storage"
+)
+
+// onePayload hands a single file to SaveFiles.
+type onePayload struct {
+	file *storage.FilePayload
+}
+
+func (p *onePayload) Next() (*storage.FilePayload, error) {
+	if p.file == nil {
+		return nil, io.EOF
+	}
+	f := p.file
+	p.file = nil
+	return f, nil
+}
+
+func testContent(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 31)
+	}
+	return b
+}
+
+// newTestServer returns a server with one stored transfer holding content.
+func newTestServer(t *testing.T, content []byte) (*Server, *storage.Transfer) {
+	t.Helper()
+	store, err := storage.NewStore(t.TempDir(), storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	transfer, err := store.SaveFiles(storage.SaveOptions{Category: "mixed"}, &onePayload{
+		file: &storage.FilePayload{Name: `report "final".bin`, Content: io.NopCloser(bytes.NewReader(content))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{TransferTTL: time.Hour, DownloadLinkTTL: time.Hour, RateLimit: 100, RateBurst: 100}
+	return NewServer(store, devices.NewRegistry(0), nil, bytes.Repeat([]byte{1}, 32), cfg), transfer
+}
+
+// fetch requests a signed link and returns the status and body.
+func fetch(t *testing.T, s *Server, method string, q url.Values, rangeHeader string) (int, []byte) {
+	t.Helper()
+	r := httptest.NewRequest(method, "/file?"+q.Encode(), nil)
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	w := httptest.NewRecorder()
+	s.ServeFileHandler(w, r)
+	return w.Code, w.Body.Bytes()
+}
+
+func TestDownloadLinkSignature(t *testing.T) {
+	s, transfer := newTestServer(t, testContent(100))
+	fileID := transfer.Files[0].ID
+	expires := time.Now().Add(time.Hour)
+	q := s.downloadLinks.sign(transfer.ID, fileID, "", expires, true)
+	link, err := s.downloadLinks.verify(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.TransferID != transfer.ID || link.FileID != fileID || link.Nonce == "" || link.Variant != "" {
+		t.Fatalf("verified link = %+v", link)
+	}
+
+	tamper := map[string]func(q url.Values){
+		"other file":      func(q url.Values) { q.Set("file", transfer.ID+"-01") },
+		"other transfer":  func(q url.Values) { q.Set("id", "000000000000") },
+		"later expiry":    func(q url.Values) { q.Set("exp", "99999999999") },
+		"no nonce":        func(q url.Values) { q.Del("once") },
+		"other nonce":     func(q url.Values) { q.Set("once", "00") },
+		"added variant":   func(q url.Values) { q.Set("variant", "2048") },
+		"other signature": func(q url.Values) { q.Set("sig", "AAAA") },
+		"bad expiry":      func(q url.Values) { q.Set("exp", "soon") },
+	}
+	for name, change := range tamper {
+		changed := url.Values{}
+		for k, v := range q {
+			changed[k] = append([]string(nil), v...)
+		}
+		change(changed)
+		if _, err := s.downloadLinks.verify(changed); !errors.Is(err, errLinkInvalid) {
+			t.Errorf("%s: verify = %v, want errLinkInvalid", name, err)
+		}
+		if code, _ := fetch(t, s, http.MethodGet, changed, ""); code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", name, code)
+		}
+	}
+
+	// A variant is part of what is signed, and removing it is tampering too.
+	q = s.downloadLinks.sign(transfer.ID, fileID, "1080p", expires, false)
+	if link, err := s.downloadLinks.verify(q); err != nil || link.Variant != "1080p" {
+		t.Fatalf("variant link = %+v, %v", link, err)
+	}
+	q.Del("variant")
+	if _, err := s.downloadLinks.verify(q); !errors.Is(err, errLinkInvalid) {
+		t.Errorf("variant removed: verify = %v, want errLinkInvalid", err)
+	}
+
+	// Links signed with another server's key are refused.
+	other := newDownloadLinks(bytes.Repeat([]byte{2}, 32))
+	if _, err := s.downloadLinks.verify(other.sign(transfer.ID, fileID, "", expires, false)); !errors.Is(err, errLinkInvalid) {
+		t.Errorf("foreign key: verify = %v, want errLinkInvalid", err)
+	}
+}
+
+func TestDownloadLinkExpiry(t *testing.T) {
+	content := testContent(100)
+	s, transfer := newTestServer(t, content)
+	q := s.downloadLinks.sign(transfer.ID, transfer.Files[0].ID, "", time.Now().Add(-time.Second), false)
+	if _, err := s.downloadLinks.verify(q); !errors.Is(err, errLinkExpired) {
+		t.Fatalf("verify = %v, want errLinkExpired", err)
+	}
+	if code, _ := fetch(t, s, http.MethodGet, q, ""); code != http.StatusGone {
+		t.Fatalf("expired link: status %d, want 410", code)
+	}
+
+	// Links never outlive their transfer.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, expires := s.signedFileURL(r, transfer, transfer.Files[0].ID, "", 48*time.Hour, false)
+	if want := transfer.CreatedAt.Add(s.cfg.TransferTTL); !expires.Equal(want) {
+		t.Fatalf("link expires %v, want the transfer's expiry %v", expires, want)
+	}
+
+	// Reusable links serve the file as often as asked until they expire.
+	q = s.downloadLinks.sign(transfer.ID, transfer.Files[0].ID, "", time.Now().Add(time.Hour), false)
+	for range 3 {
+		if code, body := fetch(t, s, http.MethodGet, q, ""); code != http.StatusOK || !bytes.Equal(body, content) {
+			t.Fatalf("reusable link: status %d, %d bytes", code, len(body))
+		}
+	}
+}
+
+func TestSingleUseLink(t *testing.T) {
+	content := testContent(1000)
+	s, transfer := newTestServer(t, content)
+	q := s.downloadLinks.sign(transfer.ID, transfer.Files[0].ID, "", time.Now().Add(time.Hour), true)
+
+	// Probes do not spend the link.
+	if code, _ := fetch(t, s, http.MethodHead, q, ""); code != http.StatusOK {
+		t.Fatalf("HEAD: status %d", code)
+	}
+	if code, body := fetch(t, s, http.MethodGet, q, ""); code != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("first GET: status %d, %d bytes", code, len(body))
+	}
+	for _, rangeHeader := range []string{"", "bytes=0-", "bytes=0-0", "bytes=500-599", "bytes=-1", "bytes=0-1,5-6", "bytes=x"} {
+		if code, _ := fetch(t, s, http.MethodGet, q, rangeHeader); code != http.StatusGone {
+			t.Errorf("GET after the download with Range %q: status %d, want 410", rangeHeader, code)
+		}
+	}
+}
+
+func TestSingleUseLinkRanges(t *testing.T) {
+	content := testContent(1000)
+	s, transfer := newTestServer(t, content)
+	q := s.downloadLinks.sign(transfer.ID, transfer.Files[0].ID, "", time.Now().Add(time.Hour), true)
+
+	get := func(rangeHeader string, wantCode int, want []byte) {
+		t.Helper()
+		code, body := fetch(t, s, http.MethodGet, q, rangeHeader)
+		if code != wantCode || (want != nil && !bytes.Equal(body, want)) {
+			t.Fatalf("Range %q: status %d, %d bytes; want %d, %d bytes", rangeHeader, code, len(body), wantCode, len(want))
+		}
+	}
+	// A download split into ranges gets each part once.
+	get("bytes=0-99", http.StatusPartialContent, content[:100])
+	get("bytes=0-99", http.StatusGone, nil)
+	get("bytes=50-150", http.StatusGone, nil)
+	get("bytes=0-", http.StatusGone, nil)
+	get("", http.StatusGone, nil)
+	get("bytes=900-", http.StatusPartialContent, content[900:])
+	get("bytes=-50", http.StatusGone, nil)
+	get("bytes=100-899", http.StatusPartialContent, content[100:900])
+	get("bytes=400-400", http.StatusGone, nil)
+}
+
+// failingWriter takes limit bytes of the body and then fails, like a client
+// that hangs up.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		n, _ := f.ResponseRecorder.Write(p[:f.limit])
+		f.limit = 0
+		return n, io.ErrUnexpectedEOF
+	}
+	f.limit -= len(p)
+	return f.ResponseRecorder.Write(p)
+}
+
+func TestSingleUseLinkResume(t *testing.T) {
+	content := testContent(1000)
+	s, transfer := newTestServer(t, content)
+	q := s.downloadLinks.sign(transfer.ID, transfer.Files[0].ID, "", time.Now().Add(time.Hour), true)
+	interrupted := func(limit int) {
+		t.Helper()
+		w := &failingWriter{ResponseRecorder: httptest.NewRecorder(), limit: limit}
+		s.ServeFileHandler(w, httptest.NewRequest(http.MethodGet, "/file?"+q.Encode(), nil))
+		if w.Code != http.StatusOK || w.Body.Len() != limit {
+			t.Fatalf("interrupted GET: status %d, %d bytes", w.Code, w.Body.Len())
+		}
+	}
+
+	// A download that fails before sending anything spends nothing.
+	interrupted(0)
+	// One cut short spends only what it sent, and can be resumed once.
+	interrupted(300)
+	if code, _ := fetch(t, s, http.MethodGet, q, "bytes=0-"); code != http.StatusGone {
+		t.Fatalf("refetching sent bytes: status %d, want 410", code)
+	}
+	if code, body := fetch(t, s, http.MethodGet, q, "bytes=300-"); code != http.StatusPartialContent || !bytes.Equal(body, content[300:]) {
+		t.Fatalf("resume: status %d, %d bytes", code, len(body))
+	}
+	if code, _ := fetch(t, s, http.MethodGet, q, "bytes=300-"); code != http.StatusGone {
+		t.Fatalf("second resume: status %d, want 410", code)
+	}
+
+	// A stale If-Range cannot turn a range into the whole file.
+	q = s.downloadLinks.sign(transfer.ID, transfer.Files[0].ID, "", time.Now().Add(time.Hour), true)
+	r := httptest.NewRequest(http.MethodGet, "/file?"+q.Encode(), nil)
+	r.Header.Set("Range", "bytes=0-9")
+	r.Header.Set("If-Range", `"stale"`)
+	w := httptest.NewRecorder()
+	s.ServeFileHandler(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 10 {
+		t.Fatalf("If-Range: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if code, body := fetch(t, s, http.MethodGet, q, "bytes=10-"); code != http.StatusPartialContent || !bytes.Equal(body, content[10:]) {
+		t.Fatalf("rest after If-Range: status %d, %d bytes", code, len(body))
+	}
+}
+
+func TestRequestedRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   byteRange
+		exact  bool
+	}{
+		{"", byteRange{0, 1000}, true},
+		{"bytes=0-", byteRange{0, 1000}, true},
+		{"bytes=10-19", byteRange{10, 20}, true},
+		{"bytes= 10 - 19 ", byteRange{10, 20}, true},
+		{"bytes=990-5000", byteRange{990, 1000}, true},
+		{"bytes=-10", byteRange{990, 1000}, true},
+		{"bytes=-5000", byteRange{0, 1000}, true},
+		{"bytes=0-1,5-6", byteRange{0, 1000}, false},
+		{"bytes=1000-", byteRange{0, 1000}, false},
+		{"bytes=20-10", byteRange{0, 1000}, false},
+		{"items=0-1", byteRange{0, 1000}, false},
+		{"bytes=-0", byteRange{0, 1000}, false},
+	}
+	for _, tt := range tests {
+		got, exact := requestedRange(tt.header, 1000)
+		if got != tt.want || exact != tt.exact {
+			t.Errorf("requestedRange(%q) = %v, %v; want %v, %v", tt.header, got, exact, tt.want, tt.exact)
+		}
+	}
+	if got, _ := requestedRange("", 0); got != (byteRange{0, 1}) {
+		t.Errorf("empty file claims %v, want one byte", got)
+	}
+}
@@ -1,41 +1,183 @@
 package handlers
 
 import (
-	"fmt"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"io"
+	"mime"
 	"net/http"
-	"os"
-	"strconv"
+
+	"share/config"
+	"share/logging"
+	"share/metrics"
+	"share/storage"
 )
 
+// ServeFileHandler streams one file, authorized either by the transfer
+// token (plus PIN access) or by a signed download link.
 func (s *Server) ServeFileHandler(w http.ResponseWriter, r *http.Request) {
-	transfer, err := s.transferFromRequest(r)
-	if err != nil {
-		writeTransferError(w, err)
+	var transfer *storage.Transfer
+	var stored *storage.StoredFile
+	var link *signedLink
+	var err error
+	if r.URL.Query().Has("sig") {
+		transfer, stored, link, err = s.fileFromSignedURL(r)
+		switch {
+		case errors.Is(err, errLinkExpired), errors.Is(err, errLinkUsed):
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		case errors.Is(err, errLinkInvalid):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+	} else {
+		transfer, err = s.transferFromRequest(r)
+		if err != nil {
+			writeTransferError(w, err)
+			return
+		}
+		if transfer.PinHash != "" && !s.hasPinAccess(r, transfer) {
+			http.Error(w, "pin required", http.StatusForbidden)
+			return
+		}
+		stored, err = findFile(transfer, r.URL.Query().Get("file"))
+		if err != nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if reason := s.downloadBlocked(stored); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
 		return
 	}
-	if transfer.PinHash != "" && !s.hasPinAccess(r, transfer) {
-		http.Error(w, "pin required", http.StatusForbidden)
+	f, err := s.openDownload(transfer, stored, r.URL.Query().Get("variant"))
+	switch {
+	case errors.Is(err, errUnknownVariant), errors.Is(err, storage.ErrNoVariant):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		logging.FromContext(r.Context()).Error("opening stored file failed", "transfer_id", transfer.ID, "file_id", stored.ID, "error", err)
+		http.Error(w, "file unavailable", http.StatusInternalServerError)
 		return
 	}
-	fileID := r.URL.Query().Get("file")
-	stored, err := findFile(transfer, fileID)
+	defer f.Close()
+	// Single-use links are only spent by the bytes actually sent.
+	claim, err := s.downloadLinks.claim(link, r, f.Size)
 	if err != nil {
-		http.Error(w, "file not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusGone)
 		return
 	}
 
-	f, err := os.Open(stored.Path)
-	if err != nil {
-		http.Error(w, "file unavailable", http.StatusInternalServerError)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Name}))
+	w.Header().Set("Content-Type", f.Mime)
+	if !f.Resized {
+		setDigestHeaders(w.Header(), r, stored)
+	}
+	logger := logging.FromContext(r.Context()).With("transfer_id", transfer.ID, "file_id", stored.ID)
+	// ServeContent answers Range and conditional requests; with encryption
+	// at rest only the chunks covering the requested range are decrypted.
+	cw := &countingWriter{ResponseWriter: w}
+	content := &readErrorRecorder{ReadSeeker: f}
+	http.ServeContent(cw, r, f.Name, transfer.CreatedAt, content)
+	s.downloadLinks.settle(claim, cw.n, content.err == nil && cw.status == http.StatusOK && cw.n >= f.Size)
+	metrics.DownloadedBytesTotal.Add(float64(cw.n))
+	switch {
+	case content.err != nil:
+		logger.Error("reading stored file failed", "bytes", cw.n, "error", content.err)
+		return
+	case r.Method == http.MethodHead, cw.status != http.StatusOK && cw.status != http.StatusPartialContent:
+		return
+	case cw.status == http.StatusOK && cw.n < f.Size:
+		logger.Warn("file download interrupted", "bytes", cw.n)
 		return
 	}
-	defer f.Close()
+	metrics.DownloadsTotal.With(transfer.Category).Inc()
+	logger.Info("file downloaded", "bytes", cw.n, "range", r.Header.Get("Range"), "variant", r.URL.Query().Get("variant"))
+}
+
+var errUnknownVariant = errors.New("unknown photo size")
+
+// openDownload opens a file for download, or the variant of a photo with
+// the given name. An empty name or "original" selects the file itself.
+func (s *Server) openDownload(transfer *storage.Transfer, stored *storage.StoredFile, variant string) (*storage.VariantFile, error) {
+	if variant != "" && variant != "original" {
+		v, ok := storage.LookupVariant(variant)
+		if !ok {
+			return nil, errUnknownVariant
+		}
+		return s.store.OpenVariant(transfer, stored, v)
+	}
+	f, err := s.store.Open(transfer, stored)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.VariantFile{ReadSeekCloser: f, Name: stored.Name, Mime: stored.Mime, Size: stored.Size}, nil
+}
+
+// downloadBlocked explains why the scan policy withholds a file, or returns
+// "" when it may be downloaded.
+func (s *Server) downloadBlocked(f *storage.StoredFile) string {
+	switch {
+	case f.Scan == storage.ScanInfected:
+		return "file is quarantined because malware was found in it"
+	case s.cfg.ScanPolicy == config.ScanRequireClean && f.Scan != "" && f.Scan != storage.ScanClean:
+		return "file is unavailable because it could not be scanned for malware"
+	}
+	return ""
+}
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", stored.Name))
-	w.Header().Set("Content-Type", stored.Mime)
-	w.Header().Set("Content-Length", strconv.FormatInt(stored.Size, 10))
-	if _, err := io.Copy(w, f); err != nil {
+// setDigestHeaders announces the file's SHA-256 so clients can verify the
+// download: Repr-Digest (RFC 9530) describes the whole file even for range
+// responses, the older Digest header (RFC 3230) is only sent for full ones.
+func setDigestHeaders(h http.Header, r *http.Request, stored *storage.StoredFile) {
+	sum, err := hex.DecodeString(stored.SHA256)
+	if err != nil || len(sum) == 0 {
 		return
 	}
+	encoded := base64.StdEncoding.EncodeToString(sum)
+	h.Set("Repr-Digest", "sha-256=:"+encoded+":")
+	if r.Header.Get("Range") == "" {
+		h.Set("Digest", "SHA-256="+encoded)
+	}
+}
+
+// readErrorRecorder keeps the first read error, which ServeContent would
+// otherwise swallow once the response has started.
+type readErrorRecorder struct {
+	io.ReadSeeker
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// countingWriter records the status and body bytes of a response.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
 }
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDownloadFileName(t *testing.T) {
+	s, transfer := newTestServer(t, testContent(10))
+	q := url.Values{"id": {transfer.ID}, "token": {transfer.Token}, "file": {transfer.Files[0].ID}}
+	w := httptest.NewRecorder()
+	s.ServeFileHandler(w, httptest.NewRequest(http.MethodGet, "/file?"+q.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("download = %d", w.Code)
+	}
+	disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" || params["filename"] != transfer.Files[0].Name {
+		t.Fatalf("Content-Disposition %q = %s %v, %v, want an attachment named %q",
+			w.Header().Get("Content-Disposition"), disposition, params, err, transfer.Files[0].Name)
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"share/utils"
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type diskCheck struct {
+	healthCheck
+	FreeBytes      uint64 `json:"freeBytes"`
+	ThresholdBytes int64  `json:"thresholdBytes"`
+}
+
+type cleanupCheck struct {
+	healthCheck
+	LastRun  time.Time `json:"lastRun,omitzero"`
+	Interval string    `json:"interval,omitempty"`
+}
+
+type healthReport struct {
+	Status string `json:"status"`
+	Checks struct {
+		Storage healthCheck  `json:"storage"`
+		Disk    diskCheck    `json:"disk"`
+		Cleanup cleanupCheck `json:"cleanup"`
+	} `json:"checks"`
+}
+
+// HealthzHandler reports liveness. It only fails when the cleanup loop has
+// stopped, but includes the storage and disk checks for visibility.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.runHealthChecks()
+	report.Status = report.Checks.Cleanup.Status
+	writeHealthReport(w, report)
+}
+
+// ReadyzHandler reports readiness: the upload directory must be writable,
+// free disk space above the threshold, where it can be measured, and the
+// cleanup loop alive.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.runHealthChecks()
+	report.Status = "ok"
+	for _, status := range []string{report.Checks.Storage.Status, report.Checks.Disk.Status, report.Checks.Cleanup.Status} {
+		if status == "fail" {
+			report.Status = "fail"
+		}
+	}
+	writeHealthReport(w, report)
+}
+
+func (s *Server) runHealthChecks() *healthReport {
+	report := &healthReport{}
+
+	report.Checks.Storage.Status = "ok"
+	if err := s.store.CheckWritable(); err != nil {
+		report.Checks.Storage = healthCheck{Status: "fail", Error: err.Error()}
+	}
+
+	disk := &report.Checks.Disk
+	disk.ThresholdBytes = s.cfg.DiskFreeThreshold
+	free, err := utils.DiskFree(s.store.Dir())
+	switch {
+	case errors.Is(err, utils.ErrDiskFreeUnsupported):
+		// Free space cannot be measured on this platform, which is no
+		// reason to take the instance out of service.
+		disk.Status = "unknown"
+		disk.Error = err.Error()
+	case err != nil:
+		disk.Status = "fail"
+		disk.Error = err.Error()
+	case s.cfg.DiskFreeThreshold > 0 && free < uint64(s.cfg.DiskFreeThreshold):
+		disk.Status = "fail"
+		disk.Error = "free disk space below threshold"
+		disk.FreeBytes = free
+	default:
+		disk.Status = "ok"
+		disk.FreeBytes = free
+	}
+
+	cleanup := &report.Checks.Cleanup
+	status := s.store.CleanupStatus()
+	cleanup.LastRun = status.LastRun
+	cleanup.Interval = status.Interval.String()
+	switch {
+	case !status.Running:
+		cleanup.Status = "fail"
+		cleanup.Error = "cleanup loop not running"
+	case time.Since(status.LastRun) > 2*status.Interval:
+		cleanup.Status = "fail"
+		cleanup.Error = "cleanup loop stalled"
+	default:
+		cleanup.Status = "ok"
+	}
+	return report
+}
+
+func writeHealthReport(w http.ResponseWriter, report *healthReport) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
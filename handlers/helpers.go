@@ -3,14 +3,35 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"html/template"
+	"math"
+	"net"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
 
+	"share/security"
 	"share/storage"
 )
 
+// renderTemplate executes templates/<name> with the helpers every page
+// uses: csrfToken for forms and fetch calls and cspNonce for inline
+// scripts. extra adds page-specific template functions.
+func renderTemplate(w http.ResponseWriter, r *http.Request, status int, name string, data any, extra template.FuncMap) {
+	funcs := template.FuncMap{
+		"csrfToken": func() string { return security.Token(r.Context()) },
+		"cspNonce":  func() string { return security.Nonce(r.Context()) },
+	}
+	tmpl := template.Must(template.New(name).Funcs(funcs).Funcs(extra).ParseFiles(filepath.Join("templates", name)))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = tmpl.Execute(w, data)
+}
+
 func (s *Server) transferFromRequest(r *http.Request) (*storage.Transfer, error) {
-	id := r.URL.Query().Get("id")
-	token := r.URL.Query().Get("token")
+	id := r.FormValue("id")
+	token := shareToken(r, id)
 	if id == "" || token == "" {
 		return nil, errors.New("missing id or token")
 	}
@@ -39,3 +60,40 @@ func findFile(transfer *storage.Transfer, fileID string) (*storage.StoredFile, e
 	}
 	return nil, fmt.Errorf("file not found")
 }
+
+// clientIP returns the remote address of the request without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeRetryAfter sets the Retry-After header, rounded up to whole seconds.
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// formatBytes renders a byte count for people, e.g. "512 bytes" or "18.4 KB".
+func formatBytes(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d bytes", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
+
+// formatWait renders a wait duration for people, e.g. "45 seconds" or "3 minutes".
+func formatWait(wait time.Duration) string {
+	if wait < time.Minute {
+		return fmt.Sprintf("%d seconds", int(math.Ceil(wait.Seconds())))
+	}
+	return fmt.Sprintf("%d minutes", int(math.Ceil(wait.Minutes())))
+}
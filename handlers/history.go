@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"share/access"
+	"share/logging"
+	"share/storage"
+)
+
+type historyEntry struct {
+	ID         string
+	Category   string
+	Files      int
+	SizeMB     float64
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	EndedAt    time.Time
+	Status     string
+	ManageLink string
+}
+
+type historyPageData struct {
+	Username  string
+	UsedMB    float64
+	QuotaMB   float64
+	Active    int
+	Transfers []historyEntry
+}
+
+// HistoryHandler lists the signed-in user's past and active transfers.
+func (s *Server) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := s.gate.Accounts().User(s.sessionUser(r))
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	data := historyPageData{
+		Username: user.Username,
+		UsedMB:   float64(s.store.OwnerUsage(user.Username)) / (1024 * 1024),
+		QuotaMB:  float64(s.ownerQuota(user.Username)) / (1024 * 1024),
+	}
+	for i := len(user.History) - 1; i >= 0; i-- {
+		entry := user.History[i]
+		row := historyEntry{
+			ID:        entry.TransferID,
+			Category:  categoryLabel(entry.Category),
+			Files:     entry.Files,
+			SizeMB:    float64(entry.Bytes) / (1024 * 1024),
+			CreatedAt: entry.CreatedAt,
+			ExpiresAt: entry.CreatedAt.Add(s.cfg.TransferTTL),
+			EndedAt:   entry.EndedAt,
+			Status:    entry.Status,
+		}
+		if row.Status == "" {
+			row.Status = access.StatusExpired
+			if transfer, ok := s.store.Lookup(entry.TransferID); ok && transfer.Owner == user.Username {
+				row.Status = access.StatusActive
+				row.ManageLink = fmt.Sprintf("/manage?id=%s&key=%s", transfer.ID, transfer.ManageToken)
+				data.Active++
+			}
+		}
+		data.Transfers = append(data.Transfers, row)
+	}
+
+	renderTemplate(w, r, http.StatusOK, "history.html", data, nil)
+}
+
+// markHistory records in the owner's history why a transfer ended.
+func (s *Server) markHistory(ctx context.Context, transfer *storage.Transfer, status string) {
+	accounts := s.gate.Accounts()
+	if accounts == nil || transfer.Owner == "" || strings.HasPrefix(transfer.Owner, "oidc:") {
+		return
+	}
+	if err := accounts.MarkTransfer(transfer.Owner, transfer.ID, status); err != nil {
+		logging.FromContext(ctx).Warn("updating transfer history failed", "user", transfer.Owner, "error", err)
+	}
+}
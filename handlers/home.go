@@ -1,13 +1,9 @@
 package handlers
 
 import (
-	"html/template"
 	"net/http"
-	"path/filepath"
 )
 
 func (s *Server) HomeHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles(filepath.Join("templates", "main.html")))
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	_ = tmpl.Execute(w, nil)
+	renderTemplate(w, r, http.StatusOK, "main.html", nil, nil)
 }
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"share/logging"
+	"share/storage"
+)
+
+// shareTokenHeader lets API clients send the transfer token without putting
+// it in the URL.
+const shareTokenHeader = "X-Share-Token"
+
+type openPageData struct {
+	ID   string
+	File string
+}
+
+// shareLink returns the link receivers open. The token travels in the URL
+// fragment, which browsers never send to servers, proxies or in Referer
+// headers; the open page exchanges it for a cookie.
+func shareLink(r *http.Request, transfer *storage.Transfer) string {
+	return fmt.Sprintf("%s://%s/r/%s#%s", requestScheme(r), r.Host, transfer.ID, transfer.Token)
+}
+
+func tokenCookieName(id string) string {
+	return "token-" + id
+}
+
+// shareToken returns the transfer token sent with r: the X-Share-Token
+// header, the cookie set when a fragment link was opened, or for older links
+// the token form or query parameter.
+func shareToken(r *http.Request, id string) string {
+	if token := r.Header.Get(shareTokenHeader); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(tokenCookieName(id)); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return r.FormValue("token")
+}
+
+// OpenLinkPage serves /r/{id}. The page's script reads the token from the
+// fragment, hands it to OpenTransferHandler and continues to the transfer.
+func (s *Server) OpenLinkPage(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, r, http.StatusOK, "open.html", openPageData{
+		ID:   r.PathValue("id"),
+		File: r.URL.Query().Get("file"),
+	}, nil)
+}
+
+// OpenTransferHandler checks a transfer token sent in the request body and
+// stores it in an HttpOnly cookie scoped to the transfer, so the following
+// pages and downloads need no token in their URLs.
+func (s *Server) OpenTransferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.ID == "" || payload.Token == "" {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	transfer, err := s.store.Authorize(payload.ID, payload.Token)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("transfer link rejected", "transfer_id", payload.ID, "remote", r.RemoteAddr, "error", err)
+		writeTransferError(w, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookieName(transfer.ID),
+		Value:    transfer.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   max(int(time.Until(transfer.CreatedAt.Add(s.cfg.TransferTTL)).Seconds()), 60),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
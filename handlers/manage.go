@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"share/access"
+	"share/logging"
+	"share/storage"
+)
+
+type managePageData struct {
+	ID          string
+	Key         string
+	Category    string
+	ShareLink   string
+	RequiresPin bool
+	Encrypted   bool
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	Files       []incomingFile
+
+	PinFailures  int
+	LastFailure  time.Time
+	LockedOut    bool
+	BlockedUntil time.Time
+}
+
+func (s *Server) manageTransferFromRequest(r *http.Request) (*storage.Transfer, error) {
+	id := r.FormValue("id")
+	key := r.FormValue("key")
+	if id == "" || key == "" {
+		return nil, fmt.Errorf("missing id or key")
+	}
+	return s.store.AuthorizeManage(id, key)
+}
+
+// ManageHandler renders the sender's view of a transfer, including PIN
+// failures and lockouts.
+func (s *Server) ManageHandler(w http.ResponseWriter, r *http.Request) {
+	transfer, err := s.manageTransferFromRequest(r)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	attempts := s.pinAttempts.State(pinTransferKey(transfer.ID))
+	data := managePageData{
+		ID:          transfer.ID,
+		Key:         transfer.ManageToken,
+		Category:    categoryLabel(transfer.Category),
+		ShareLink:   shareLink(r, transfer),
+		RequiresPin: transfer.PinHash != "",
+		Encrypted:   transfer.Encrypted,
+		CreatedAt:   transfer.CreatedAt,
+		ExpiresAt:   transfer.CreatedAt.Add(s.cfg.TransferTTL),
+		PinFailures: attempts.Failures,
+		LastFailure: attempts.LastFailure,
+		LockedOut:   attempts.LockedOut,
+	}
+	if time.Now().Before(attempts.BlockedUntil) {
+		data.BlockedUntil = attempts.BlockedUntil
+	}
+	for _, f := range transfer.Files {
+		data.Files = append(data.Files, incomingFile{
+			ID:            f.ID,
+			Name:          f.Name,
+			Mime:          f.Mime,
+			SizeMB:        float64(f.Size) / (1024 * 1024),
+			SHA256:        f.SHA256,
+			BLAKE3:        f.BLAKE3,
+			EncryptedMeta: f.EncryptedMeta,
+			ScanLabel:     scanLabel(&f),
+			MetadataLabel: metadataLabel(&f),
+			Blocked:       s.downloadBlocked(&f) != "",
+		})
+	}
+
+	renderTemplate(w, r, http.StatusOK, "manage.html", data, nil)
+}
+
+// RevokeTransferHandler lets the sender delete a transfer before it expires.
+func (s *Server) RevokeTransferHandler(w http.ResponseWriter, r *http.Request) {
+	transfer, err := s.manageTransferFromRequest(r)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	if !confirmDestructive(w, r, confirmPageData{
+		Title:     "Revoke transfer?",
+		Message:   fmt.Sprintf("The share link stops working and the %d file(s) are deleted. This cannot be undone.", len(transfer.Files)),
+		Action:    "/manage/revoke",
+		Fields:    []hiddenField{{"id", transfer.ID}, {"key", transfer.ManageToken}},
+		Confirm:   "Revoke transfer",
+		CancelURL: fmt.Sprintf("/manage?id=%s&key=%s", transfer.ID, transfer.ManageToken),
+	}) {
+		return
+	}
+	s.store.Remove(transfer.ID)
+	s.registry.ClearByTransfer(transfer.ID)
+	s.markHistory(r.Context(), transfer, access.StatusRevoked)
+	logging.FromContext(r.Context()).Info("transfer revoked", "transfer_id", transfer.ID)
+	renderDonePage(w, r, "Transfer revoked", "The share link no longer works and the files were removed.")
+}
@@ -18,16 +18,36 @@ func (s *Server) FileMetaHandler(w http.ResponseWriter, r *http.Request) {
 
 	files := make([]map[string]interface{}, 0, len(transfer.Files))
 	for _, f := range transfer.Files {
-		files = append(files, map[string]interface{}{
-			"id":   f.ID,
-			"name": f.Name,
-			"mime": f.Mime,
-			"size": f.Size,
-		})
+		file := map[string]interface{}{
+			"id":     f.ID,
+			"name":   f.Name,
+			"mime":   f.Mime,
+			"size":   f.Size,
+			"sha256": f.SHA256,
+		}
+		if f.BLAKE3 != "" {
+			file["blake3"] = f.BLAKE3
+		}
+		if transfer.Encrypted {
+			file["encryptedMeta"] = f.EncryptedMeta
+		}
+		if f.Scan != "" {
+			file["scan"] = f.Scan
+			file["downloadable"] = s.downloadBlocked(&f) == ""
+		}
+		if f.Threat != "" {
+			file["threat"] = f.Threat
+		}
+		if f.Sanitized {
+			file["sanitized"] = true
+			file["strippedBytes"] = f.StrippedBytes
+		}
+		files = append(files, file)
 	}
 	resp := map[string]interface{}{
 		"category":    transfer.Category,
 		"requiresPin": transfer.PinHash != "",
+		"encrypted":   transfer.Encrypted,
 		"files":       files,
 	}
 
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"share/e2e"
+	"share/storage"
+)
+
+// maxFieldsSize bounds the form fields of an upload taken together; the
+// largest are the sealed metadata of end-to-end encrypted files.
+const maxFieldsSize = 8 << 20
+
+// uploadOptions are the fields that apply to the whole upload and must be
+// sent before the first file.
+var uploadOptions = map[string]bool{"encrypted": true, "category": true, "pin": true, "strip_metadata": true}
+
+// badUpload describes a malformed upload, answered with 400 Bad Request.
+type badUpload string
+
+func (e badUpload) Error() string { return string(e) }
+
+// uploadStream reads a multipart upload part by part and hands its files
+// to the store as they arrive. Form fields come first: the options of the
+// upload before the first file, and each file's meta and checksum fields
+// before the file, the n-th of them belonging to the n-th file.
+type uploadStream struct {
+	parts      *multipart.Reader
+	values     url.Values
+	fieldBytes int64
+	encrypted  bool
+	// next is the file part read ahead while looking for form fields.
+	next  *multipart.Part
+	files int
+	// err is the first error met reading the body, as opposed to storing
+	// the files.
+	err error
+}
+
+func newUploadStream(parts *multipart.Reader) *uploadStream {
+	return &uploadStream{parts: parts, values: url.Values{}}
+}
+
+// start reads the fields before the first file. It returns io.EOF when the
+// upload has no files.
+func (u *uploadStream) start() error {
+	if err := u.readFields(); err != nil {
+		return err
+	}
+	u.encrypted = u.values.Get("encrypted") == "1"
+	return nil
+}
+
+// readFields reads form fields up to the next file, which it keeps for
+// Next, and returns io.EOF at the end of the body.
+func (u *uploadStream) readFields() error {
+	for {
+		part, err := u.parts.NextPart()
+		if err != nil {
+			return err
+		}
+		name := part.FormName()
+		if part.FileName() != "" {
+			if name == "files" {
+				u.next = part
+				return nil
+			}
+			// Files under other names are skipped, as before.
+			continue
+		}
+		if u.files > 0 && uploadOptions[name] {
+			return badUpload(fmt.Sprintf("the %s field must come before the files", name))
+		}
+		if (name == "meta" || name == "checksum") && len(u.values[name]) < u.files {
+			return badUpload(fmt.Sprintf("each %s field must come before its file", name))
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFieldsSize-u.fieldBytes+1))
+		if err != nil {
+			return err
+		}
+		if u.fieldBytes += int64(len(value)); u.fieldBytes > maxFieldsSize {
+			return badUpload("form fields are too large")
+		}
+		// A file input without a selected file sends an empty part, which
+		// is a field like any other.
+		u.values.Add(name, string(value))
+	}
+}
+
+// Next returns the next file of the upload with its checksum and, for
+// end-to-end encrypted uploads, its sealed metadata.
+func (u *uploadStream) Next() (*storage.FilePayload, error) {
+	if u.next == nil {
+		if err := u.readFields(); err == io.EOF {
+			return nil, u.fail(u.checkCounts())
+		} else if err != nil {
+			return nil, u.fail(err)
+		}
+	}
+	part := u.next
+	u.next = nil
+	idx := u.files
+	u.files++
+
+	payload := &storage.FilePayload{Name: part.FileName(), MIME: part.Header.Get("Content-Type")}
+	if checksums := u.values["checksum"]; len(checksums) > 0 {
+		if idx >= len(checksums) {
+			return nil, u.fail(badUpload("send one checksum field per file, before the file, empty for files without one"))
+		}
+		if err := parseChecksum(payload, checksums[idx], idx+1); err != nil {
+			return nil, u.fail(err)
+		}
+	}
+	var content io.Reader = part
+	if u.encrypted {
+		metas := u.values["meta"]
+		if idx >= len(metas) {
+			return nil, u.fail(badUpload("encrypted uploads need one meta field per file, before the file"))
+		}
+		if err := checkEncryptedMeta(metas[idx], idx+1); err != nil {
+			return nil, u.fail(err)
+		}
+		// Names and types are replaced by placeholders since the real ones
+		// are part of the metadata.
+		payload.Name = fmt.Sprintf("file-%02d.sge", idx+1)
+		payload.MIME = "application/octet-stream"
+		payload.EncryptedMeta = metas[idx]
+		content = &frameChecker{r: part, file: idx + 1}
+	}
+	payload.Content = io.NopCloser(&bodyReader{r: content, stream: u})
+	return payload, nil
+}
+
+// checkCounts runs once all files are read and returns io.EOF when every
+// meta and checksum field belonged to a file.
+func (u *uploadStream) checkCounts() error {
+	if n := len(u.values["checksum"]); n > 0 && n != u.files {
+		return badUpload("send one checksum field per file, before the file, empty for files without one")
+	}
+	if n := len(u.values["meta"]); u.encrypted && n != u.files {
+		return badUpload("encrypted uploads need one meta field per file, before the file")
+	}
+	return io.EOF
+}
+
+func (u *uploadStream) fail(err error) error {
+	if err != io.EOF && u.err == nil {
+		u.err = err
+	}
+	return err
+}
+
+// bodyReader records errors reading a file's content, so they are told
+// apart from errors storing it.
+type bodyReader struct {
+	r      io.Reader
+	stream *uploadStream
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil {
+		b.stream.fail(err)
+	}
+	return n, err
+}
+
+// frameChecker passes an end-to-end encrypted file through while checking
+// its framing: a valid header, and a length its chunk size allows.
+type frameChecker struct {
+	r         io.Reader
+	file      int
+	header    []byte
+	chunkSize int
+	n         int64
+}
+
+func (c *frameChecker) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if len(c.header) < e2e.HeaderSize {
+		c.header = append(c.header, p[:min(n, e2e.HeaderSize-len(c.header))]...)
+		if len(c.header) == e2e.HeaderSize {
+			size, _, herr := e2e.ReadHeader(bytes.NewReader(c.header))
+			if herr != nil {
+				return n, c.formatError()
+			}
+			c.chunkSize = size
+		}
+	}
+	c.n += int64(n)
+	if err == io.EOF && (c.chunkSize == 0 || !e2e.ValidSize(c.n, c.chunkSize)) {
+		return n, c.formatError()
+	}
+	return n, err
+}
+
+func (c *frameChecker) formatError() error {
+	return badUpload(fmt.Sprintf("file %d is not in the end-to-end encrypted format", c.file))
+}
+
+// writeUploadStreamError answers an upload whose body could not be read.
+func writeUploadStreamError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	var bad badUpload
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("upload is larger than the %s this server accepts", formatBytes(tooLarge.Limit)), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &bad):
+		http.Error(w, bad.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "failed to parse upload", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"share/logging"
+	"share/oidc"
+)
+
+const (
+	oidcStateCookieName = "share_oidc_state"
+	oidcCallbackPath    = "/auth/oidc/callback"
+)
+
+// OIDCLoginHandler sends the visitor to the identity provider.
+func (s *Server) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	authURL, state, err := s.oidc.Begin(r.Context(), s.oidcRedirectURL(r), safeRedirect(r.FormValue("next")))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("oidc login failed", "issuer", s.oidc.Issuer(), "error", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	// The state cookie binds the callback to this browser so a login started
+	// elsewhere cannot be completed here.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     oidcCallbackPath,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler completes the login and starts a session for the
+// authenticated subject.
+func (s *Server) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	logger := logging.FromContext(r.Context())
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     oidcCallbackPath,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		logger.Warn("oidc login rejected by provider", "error", errCode)
+		s.renderSSOError(w, r, http.StatusUnauthorized, "Sign-in was cancelled or rejected by the identity provider.")
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || cookie.Value == "" || cookie.Value != query.Get("state") {
+		logger.Warn("oidc callback state mismatch", "remote", r.RemoteAddr)
+		s.renderSSOError(w, r, http.StatusBadRequest, "Your sign-in session expired. Please try again.")
+		return
+	}
+
+	login, err := s.oidc.Finish(r.Context(), cookie.Value, query.Get("code"))
+	if err != nil {
+		logger.Warn("oidc login failed", "remote", r.RemoteAddr, "error", err)
+		status, message := http.StatusBadGateway, "Sign-in failed. Please try again."
+		switch {
+		case errors.Is(err, oidc.ErrUnknownState):
+			status, message = http.StatusBadRequest, "Your sign-in session expired. Please try again."
+		case errors.Is(err, oidc.ErrInvalidToken):
+			status = http.StatusUnauthorized
+		}
+		s.renderSSOError(w, r, status, message)
+		return
+	}
+
+	session := s.gate.LoginSubject(login.Claims.Subject, login.Claims.DisplayName())
+	s.setSessionCookie(w, r, session)
+	logger.Info("login succeeded", "sso", true, "user", session.Owner(), "remote", r.RemoteAddr)
+	http.Redirect(w, r, login.Next, http.StatusSeeOther)
+}
+
+func (s *Server) renderSSOError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	data := s.newLoginPageData(r)
+	data.Error = message
+	renderLoginPage(w, r, status, data)
+}
+
+// oidcRedirectURL returns the registered callback URL, or one derived from
+// the request host when none is configured.
+func (s *Server) oidcRedirectURL(r *http.Request) string {
+	if s.cfg.OIDCRedirectURL != "" {
+		return s.cfg.OIDCRedirectURL
+	}
+	return requestScheme(r) + "://" + r.Host + oidcCallbackPath
+}
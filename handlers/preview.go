@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"share/logging"
+	"share/markdown"
+	"share/storage"
+)
+
+// Kinds of preview. Text and Markdown are rendered into the preview page;
+// the others are embedded from /preview/raw.
+const (
+	previewText     = "text"
+	previewMarkdown = "markdown"
+	previewImage    = "image"
+	previewAudio    = "audio"
+	previewVideo    = "video"
+)
+
+// previewKind returns how f can be previewed, or "" when it cannot. Types
+// a browser would run as a page, HTML and SVG above all, are only ever
+// shown as source text. PDFs are not previewed yet: browsers refuse to
+// start their viewer under a sandbox, and without one a document would open
+// in the app's origin. Previewing them needs a viewer served with the app
+// that renders documents under rawPolicy; see noPreviewReason.
+func previewKind(f *storage.StoredFile) string {
+	if f.EncryptedMeta != "" || f.Blob == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(f.Mime)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "text/markdown", "text/x-markdown":
+		return previewMarkdown
+	case "application/json", "application/xml", "image/svg+xml":
+		return previewText
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/bmp":
+		return previewImage
+	case "audio/mpeg", "audio/ogg", "audio/opus", "audio/wave", "audio/wav", "audio/x-wav",
+		"audio/flac", "audio/aac", "audio/mp4", "audio/webm", "application/ogg":
+		return previewAudio
+	case "video/mp4", "video/webm", "video/ogg":
+		return previewVideo
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return previewText
+	}
+	return ""
+}
+
+// noPreviewReason explains why a file without a preview kind has none, for
+// types a preview was asked for, or returns "".
+func noPreviewReason(f *storage.StoredFile) string {
+	if mediaType, _, _ := mime.ParseMediaType(f.Mime); mediaType == "application/pdf" {
+		return "PDF documents cannot be previewed yet: the browser's own viewer cannot be kept apart from this site, so they are only offered for download."
+	}
+	return ""
+}
+
+// rawPolicy is the Content-Security-Policy of files served inline: they
+// may not load or run anything, and are treated as a unique origin.
+const rawPolicy = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; sandbox; frame-ancestors 'self'"
+
+type previewPageData struct {
+	Name   string
+	Mime   string
+	SizeMB float64
+	Kind   string
+	// Unavailable explains why a file without a Kind is not shown.
+	Unavailable string
+	Text        string
+	HTML        template.HTML
+	Truncated   bool
+	LimitKB     int64
+	RawURL      string
+	DownloadURL string
+	BackURL     string
+}
+
+// previewFile authorizes a preview request the same way as a download and
+// returns the transfer and file, or writes the error.
+func (s *Server) previewFile(w http.ResponseWriter, r *http.Request) (*storage.Transfer, *storage.StoredFile, bool) {
+	transfer, err := s.transferFromRequest(r)
+	if err != nil {
+		writeTransferError(w, err)
+		return nil, nil, false
+	}
+	if transfer.PinHash != "" && !s.hasPinAccess(r, transfer) {
+		http.Error(w, "pin required", http.StatusForbidden)
+		return nil, nil, false
+	}
+	stored, err := findFile(transfer, r.URL.Query().Get("file"))
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if reason := s.downloadBlocked(stored); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return nil, nil, false
+	}
+	return transfer, stored, true
+}
+
+// PreviewHandler shows a file in the browser: text and source code as
+// plain text, Markdown rendered to HTML, and images, audio and video
+// embedded from RawPreviewHandler.
+func (s *Server) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	transfer, stored, ok := s.previewFile(w, r)
+	if !ok {
+		return
+	}
+	query := url.Values{"id": {transfer.ID}, "file": {stored.ID}}
+	back := url.Values{"id": {transfer.ID}}
+	if token := r.FormValue("token"); token != "" {
+		query.Set("token", token)
+		back.Set("token", token)
+	}
+	data := previewPageData{
+		Name:        stored.Name,
+		Mime:        stored.Mime,
+		SizeMB:      float64(stored.Size) / (1024 * 1024),
+		Kind:        previewKind(stored),
+		Unavailable: noPreviewReason(stored),
+		LimitKB:     s.cfg.PreviewMaxBytes >> 10,
+		RawURL:      "/preview/raw?" + query.Encode(),
+		DownloadURL: "/file?" + query.Encode(),
+		BackURL:     "/incoming?" + back.Encode(),
+	}
+	if data.Kind == previewText || data.Kind == previewMarkdown {
+		text, truncated, err := s.readPreviewText(transfer, stored)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("reading file for preview failed", "transfer_id", transfer.ID, "file_id", stored.ID, "error", err)
+			http.Error(w, "file unavailable", http.StatusInternalServerError)
+			return
+		}
+		data.Truncated = truncated
+		if data.Kind == previewMarkdown {
+			data.HTML = template.HTML(markdown.Render(text))
+		} else {
+			data.Text = text
+		}
+	}
+	renderTemplate(w, r, http.StatusOK, "preview.html", data, nil)
+}
+
+// readPreviewText returns up to PreviewMaxBytes of a text file, with
+// invalid UTF-8 replaced, and whether the file was longer.
+func (s *Server) readPreviewText(transfer *storage.Transfer, stored *storage.StoredFile) (string, bool, error) {
+	f, err := s.store.Open(transfer, stored)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(io.LimitReader(f, s.cfg.PreviewMaxBytes+1))
+	if err != nil {
+		return "", false, err
+	}
+	truncated := int64(len(buf)) > s.cfg.PreviewMaxBytes
+	if truncated {
+		buf = buf[:s.cfg.PreviewMaxBytes]
+	}
+	text := strings.ToValidUTF8(string(buf), "\ufffd")
+	return strings.TrimPrefix(text, "\ufeff"), truncated, nil
+}
+
+// RawPreviewHandler serves images, audio and video inline for the preview
+// page, answering Range requests so players can seek.
+// Other files are refused: they are either rendered by PreviewHandler or
+// could run script in the app's origin.
+func (s *Server) RawPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	transfer, stored, ok := s.previewFile(w, r)
+	if !ok {
+		return
+	}
+	switch previewKind(stored) {
+	case previewImage, previewAudio, previewVideo:
+	default:
+		http.Error(w, "no inline preview for this type of file", http.StatusUnsupportedMediaType)
+		return
+	}
+	f, err := s.store.Open(transfer, stored)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("opening stored file failed", "transfer_id", transfer.ID, "file_id", stored.ID, "error", err)
+		http.Error(w, "file unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	h := w.Header()
+	h.Set("Content-Security-Policy", rawPolicy)
+	h.Set("Cross-Origin-Resource-Policy", "same-origin")
+	h.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": stored.Name}))
+	h.Set("Content-Type", stored.Mime)
+	h.Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", transfer.CreatedAt, f)
+}
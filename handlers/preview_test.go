@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPDFIsNotPreviewedInline(t *testing.T) {
+	s, transfer := newTestServer(t, []byte("%PDF-1.7\n1 0 obj << /Type /Catalog >> endobj\n%%EOF\n"))
+	if transfer.Files[0].Mime != "application/pdf" {
+		t.Fatalf("detected %q, want application/pdf", transfer.Files[0].Mime)
+	}
+	q := url.Values{"id": {transfer.ID}, "token": {transfer.Token}, "file": {transfer.Files[0].ID}}
+
+	w := httptest.NewRecorder()
+	s.RawPreviewHandler(w, httptest.NewRequest(http.MethodGet, "/preview/raw?"+q.Encode(), nil))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("raw preview of a PDF = %d, want 415", w.Code)
+	}
+
+	// Templates are read relative to the repository root.
+	t.Chdir("..")
+	w = httptest.NewRecorder()
+	s.PreviewHandler(w, httptest.NewRequest(http.MethodGet, "/preview?"+q.Encode(), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "PDF documents cannot be previewed yet") {
+		t.Fatalf("preview of a PDF = %d, want a page explaining why it is not shown", w.Code)
+	}
+}
@@ -2,17 +2,56 @@ package handlers
 
 import (
 	"fmt"
-	"html/template"
 	"net/http"
 	"net/url"
-	"path/filepath"
+
+	"share/access"
+	"share/logging"
+	"share/metrics"
+	"share/storage"
 )
 
 type incomingFile struct {
-	ID     string
-	Name   string
-	Mime   string
-	SizeMB float64
+	ID            string
+	Name          string
+	Mime          string
+	SizeMB        float64
+	SHA256        string
+	BLAKE3        string
+	EncryptedMeta string
+	ScanLabel     string
+	Blocked       bool
+	Preview       bool
+	MetadataLabel string
+	// Resizable files can be downloaded in the sizes of Variants.
+	Resizable bool
+}
+
+// scanLabel describes a file's malware scan for the transfer pages.
+func scanLabel(f *storage.StoredFile) string {
+	switch f.Scan {
+	case storage.ScanClean:
+		return "Scanned, no threats found"
+	case storage.ScanInfected:
+		return "Quarantined: " + f.Threat
+	case storage.ScanFailed:
+		return "Could not be scanned for malware"
+	case storage.ScanUnscanned:
+		return "Not scanned for malware"
+	}
+	return ""
+}
+
+// metadataLabel describes the metadata stripped from a photo before it was
+// stored.
+func metadataLabel(f *storage.StoredFile) string {
+	switch {
+	case !f.Sanitized:
+		return ""
+	case f.StrippedBytes == 0:
+		return "Checked for metadata, none found"
+	}
+	return fmt.Sprintf("Metadata removed (%s)", formatBytes(f.StrippedBytes))
 }
 
 type IncomingPageData struct {
@@ -20,9 +59,17 @@ type IncomingPageData struct {
 	Token       string
 	Category    string
 	RequiresPin bool
+	Encrypted   bool
 	NeedsPin    bool
 	PinError    string
 	Files       []incomingFile
+	// Gallery shows the images of a photos transfer as a grid of
+	// thumbnails above the file list.
+	Gallery []incomingFile
+	// Archive offers all files as one ZIP download, with photos in one of
+	// Variants when any file is resizable.
+	Archive  bool
+	Variants []storage.Variant
 }
 
 func (s *Server) IncomingHandler(w http.ResponseWriter, r *http.Request) {
@@ -34,18 +81,31 @@ func (s *Server) IncomingHandler(w http.ResponseWriter, r *http.Request) {
 
 	data := IncomingPageData{
 		ID:          transfer.ID,
-		Token:       transfer.Token,
+		Token:       r.FormValue("token"),
 		Category:    categoryLabel(transfer.Category),
 		RequiresPin: transfer.PinHash != "",
+		Encrypted:   transfer.Encrypted,
 	}
+	status := http.StatusOK
 	hasAccess := s.hasPinAccess(r, transfer)
 	if r.Method == http.MethodPost && transfer.PinHash != "" && !hasAccess {
-		if err := r.ParseForm(); err == nil {
-			pin := r.FormValue("pin")
-			if s.validatePin(pin, transfer) {
-				s.grantPinAccess(w, transfer)
-				http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
-				return
+		ip := clientIP(r)
+		if wait, lockedOut := s.beginPinAttempt(transfer.ID, ip); wait > 0 {
+			writeRetryAfter(w, wait)
+			status = http.StatusTooManyRequests
+			data.PinError = fmt.Sprintf("Too many incorrect attempts. Try again in %s.", formatWait(wait))
+		} else if s.validatePin(r.FormValue("pin"), transfer) {
+			s.pinSucceeded(transfer.ID, ip)
+			s.grantPinAccess(w, transfer)
+			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+			return
+		} else {
+			logger := logging.FromContext(r.Context())
+			logger.Warn("pin failed", "transfer_id", transfer.ID, "remote", r.RemoteAddr)
+			metrics.PinFailuresTotal.Inc()
+			if lockedOut {
+				logger.Warn("pin locked out", "transfer_id", transfer.ID, "remote", r.RemoteAddr)
+				metrics.PinLockoutsTotal.Inc()
 			}
 			data.PinError = "Incorrect PIN"
 		}
@@ -54,31 +114,49 @@ func (s *Server) IncomingHandler(w http.ResponseWriter, r *http.Request) {
 		data.NeedsPin = true
 	} else {
 		for _, f := range transfer.Files {
-			data.Files = append(data.Files, incomingFile{
-				ID:     f.ID,
-				Name:   f.Name,
-				Mime:   f.Mime,
-				SizeMB: float64(f.Size) / (1024 * 1024),
-			})
+			file := incomingFile{
+				ID:            f.ID,
+				Name:          f.Name,
+				Mime:          f.Mime,
+				SizeMB:        float64(f.Size) / (1024 * 1024),
+				SHA256:        f.SHA256,
+				BLAKE3:        f.BLAKE3,
+				EncryptedMeta: f.EncryptedMeta,
+				ScanLabel:     scanLabel(&f),
+				MetadataLabel: metadataLabel(&f),
+				Blocked:       s.downloadBlocked(&f) != "",
+				Preview:       previewKind(&f) != "",
+				Resizable:     storage.HasVariants(transfer, &f),
+			}
+			data.Files = append(data.Files, file)
+			if !file.Blocked && !transfer.Encrypted {
+				data.Archive = true
+			}
+			if file.Resizable && !file.Blocked {
+				data.Variants = storage.Variants
+			}
+			if transfer.Category == "photos" && !file.Blocked && storage.Thumbnailable(&f) {
+				data.Gallery = append(data.Gallery, file)
+			}
 		}
 	}
 
-	tmpl := template.Must(template.ParseFiles(filepath.Join("templates", "receive.html")))
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	_ = tmpl.Execute(w, data)
+	renderTemplate(w, r, status, "receive.html", data, nil)
 }
 
 func (s *Server) AcceptHandler(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	token := r.URL.Query().Get("token")
 	fileID := r.URL.Query().Get("file")
-	if id == "" || token == "" {
+	if id == "" {
 		http.Error(w, "missing transfer information", http.StatusBadRequest)
 		return
 	}
 	params := url.Values{}
 	params.Set("id", id)
-	params.Set("token", token)
+	if token != "" {
+		params.Set("token", token)
+	}
 	if fileID != "" {
 		params.Set("file", fileID)
 	}
@@ -96,8 +174,27 @@ func (s *Server) DeclineHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "pin required", http.StatusForbidden)
 		return
 	}
+	// Carry the token along only when the request had it in the URL; links
+	// opened through /r/ authenticate with the transfer cookie instead.
+	query := url.Values{"id": {transfer.ID}}
+	fields := []hiddenField{{"id", transfer.ID}}
+	if token := r.FormValue("token"); token != "" {
+		query.Set("token", token)
+		fields = append(fields, hiddenField{"token", token})
+	}
+	if !confirmDestructive(w, r, confirmPageData{
+		Title:     "Decline transfer?",
+		Message:   fmt.Sprintf("The %d file(s) in this transfer will be deleted for everyone. This cannot be undone.", len(transfer.Files)),
+		Action:    "/decline",
+		Fields:    fields,
+		Confirm:   "Decline & Remove",
+		CancelURL: "/incoming?" + query.Encode(),
+	}) {
+		return
+	}
 	s.store.Remove(transfer.ID)
 	s.registry.ClearByTransfer(transfer.ID)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprint(w, "<div class='card'><p>Transfer declined and removed.</p><a href='/' class='button btn-secondary'>Return Home</a></div>")
+	s.markHistory(r.Context(), transfer, access.StatusDeclined)
+	logging.FromContext(r.Context()).Info("transfer declined", "transfer_id", transfer.ID)
+	renderDonePage(w, r, "Transfer declined", "The transfer was declined and its files were removed.")
 }
@@ -2,13 +2,18 @@ package handlers
 
 import (
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"net/http"
 	"time"
 
+	"share/access"
+	"share/config"
 	"share/devices"
+	"share/logging"
+	"share/metrics"
+	"share/oidc"
+	"share/ratelimit"
 	"share/storage"
 )
 
@@ -16,22 +21,70 @@ import (
 type Server struct {
 	store     *storage.Store
 	registry  *devices.Registry
+	cfg       *config.Config
 	pinSecret []byte
+
+	pinAttempts *ratelimit.Lockout
+	limiter     *ratelimit.Limiter
+	gate        *access.Gate
+	oidc        *oidc.Client
+
+	downloadLinks *downloadLinks
 }
 
 // NewServer builds a handler server with the provided storage backend.
-func NewServer(store *storage.Store, registry *devices.Registry) *Server {
-	secret := make([]byte, 32)
-	if _, err := rand.Read(secret); err != nil {
-		panic(err)
+// accounts may be nil when local user accounts are disabled. secret is the
+// persistent server key that signs download links and PIN access cookies.
+func NewServer(store *storage.Store, registry *devices.Registry, accounts *access.Accounts, secret []byte, cfg *config.Config) *Server {
+	gate := access.NewGate(cfg.AccessMode, cfg.AccessPassword, cfg.AdminPassword, cfg.SessionTTL, accounts)
+	var sso *oidc.Client
+	if cfg.OIDCIssuer != "" {
+		sso = oidc.NewClient(oidc.Config{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			Scopes:       cfg.OIDCScopes,
+		})
+		gate.EnableSSO()
 	}
 	return &Server{
 		store:     store,
 		registry:  registry,
-		pinSecret: secret,
+		cfg:       cfg,
+		pinSecret: deriveKey(secret, "pin-access"),
+
+		pinAttempts: ratelimit.NewLockout(ratelimit.DefaultLockoutPolicy),
+		limiter:     ratelimit.NewLimiter(cfg.RateLimit, cfg.RateBurst),
+		gate:        gate,
+		oidc:        sso,
+
+		downloadLinks: newDownloadLinks(deriveKey(secret, "download-links")),
+	}
+}
+
+// RateLimit wraps next with the per-client request limiter. Each scope has
+// its own bucket so polling devices do not starve uploads.
+func (s *Server) RateLimit(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := s.limiter.Allow(scope + ":" + clientIP(r))
+		if !ok {
+			metrics.RateLimitedTotal.With(scope).Inc()
+			logging.FromContext(r.Context()).Warn("rate limited", "scope", scope, "remote", r.RemoteAddr)
+			writeRetryAfter(w, wait)
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
 	}
 }
 
+// deriveKey returns a purpose-specific subkey of the server secret.
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
 func (s *Server) pinCookieName(id string) string {
 	return "pin-" + id
 }
@@ -51,7 +104,7 @@ func (s *Server) hasPinAccess(r *http.Request, t *storage.Transfer) bool {
 	if err != nil {
 		return false
 	}
-	return cookie.Value == s.pinCookieValue(t)
+	return hmac.Equal([]byte(cookie.Value), []byte(s.pinCookieValue(t)))
 }
 
 func (s *Server) grantPinAccess(w http.ResponseWriter, t *storage.Transfer) {
@@ -64,9 +117,31 @@ func (s *Server) grantPinAccess(w http.ResponseWriter, t *storage.Transfer) {
 	})
 }
 
+func pinTransferKey(id string) string {
+	return "transfer:" + id
+}
+
+func pinClientKey(ip string) string {
+	return "ip:" + ip
+}
+
+// beginPinAttempt starts a PIN attempt for the transfer and client. It
+// returns how long either must wait before another attempt is accepted, or
+// counts this attempt as failed until pinSucceeded takes it back and
+// reports whether that locked either of them out.
+func (s *Server) beginPinAttempt(transferID, ip string) (time.Duration, bool) {
+	return s.pinAttempts.Attempt(pinTransferKey(transferID), pinClientKey(ip))
+}
+
+// pinSucceeded clears the failures of a transfer whose PIN was entered. The
+// client only gets this attempt back and keeps its earlier failures until
+// they expire, so unlocking a transfer it created cannot lift a lockout
+// earned guessing the PINs of others.
+func (s *Server) pinSucceeded(transferID, ip string) {
+	s.pinAttempts.Reset(pinTransferKey(transferID))
+	s.pinAttempts.Forgive(pinClientKey(ip))
+}
+
 func (s *Server) validatePin(input string, t *storage.Transfer) bool {
-	if t.PinHash == "" {
-		return true
-	}
-	return storage.HashPin(input) == t.PinHash
+	return storage.VerifyPin(input, t.PinHash)
 }
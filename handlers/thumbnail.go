@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"share/logging"
+	"share/storage"
+)
+
+// ThumbnailHandler serves the JPEG thumbnail of an image file under the
+// same access rules as the file itself.
+func (s *Server) ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	transfer, err := s.transferFromRequest(r)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	if transfer.PinHash != "" && !s.hasPinAccess(r, transfer) {
+		http.Error(w, "pin required", http.StatusForbidden)
+		return
+	}
+	stored, err := findFile(transfer, r.URL.Query().Get("file"))
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if reason := s.downloadBlocked(stored); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+
+	f, err := s.store.Thumbnail(stored)
+	switch {
+	case errors.Is(err, storage.ErrThumbnailPending):
+		writeRetryAfter(w, 2*time.Second)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, storage.ErrNoThumbnail):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		logging.FromContext(r.Context()).Error("opening thumbnail failed", "transfer_id", transfer.ID, "file_id", stored.ID, "error", err)
+		http.Error(w, "thumbnail unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, "", transfer.CreatedAt, f)
+}
@@ -1,97 +1,366 @@
 package handlers
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
-	"path/filepath"
+	"strconv"
 	"strings"
-	"text/template"
 
+	"share/access"
+	"share/config"
+	"share/logging"
+	"share/metrics"
 	"share/storage"
 )
 
-const maxUploadSize = 25 << 20 // 25 MB
+// maxEncryptedMetaSize bounds the sealed metadata sent with each end-to-end
+// encrypted file.
+const maxEncryptedMetaSize = 4 << 10
+
+type sendPageData struct {
+	Error string
+	// Rejected lists the files the upload policy refused.
+	Rejected []storage.RejectedFile
+	// StripMetadata pre-selects removing metadata from photos.
+	StripMetadata bool
+	// NoEncryption turns off end-to-end encryption on instances that only
+	// keep files they could scan.
+	NoEncryption bool
+}
 
 func (s *Server) UploadPage(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles(filepath.Join("templates", "send.html")))
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	_ = tmpl.Execute(w, nil)
+	s.renderSendPage(w, r, http.StatusOK, sendPageData{StripMetadata: s.cfg.StripMetadata})
+}
+
+func (s *Server) renderSendPage(w http.ResponseWriter, r *http.Request, status int, data sendPageData) {
+	data.NoEncryption = s.cfg.ScanPolicy == config.ScanRequireClean
+	renderTemplate(w, r, status, "send.html", data, nil)
+}
+
+// stripMetadata returns whether the sender wants metadata removed from
+// their photos: the strip_metadata field of the upload, or the instance
+// default. The send page puts a hidden "0" before its checkbox, so the
+// last value counts.
+func (s *Server) stripMetadata(values url.Values) bool {
+	fields := values["strip_metadata"]
+	if len(fields) == 0 {
+		return s.cfg.StripMetadata
+	}
+	strip, err := strconv.ParseBool(fields[len(fields)-1])
+	if err != nil {
+		return s.cfg.StripMetadata
+	}
+	return strip
+}
+
+func (s *Server) writeInsufficientStorage(w http.ResponseWriter, r *http.Request, values url.Values) {
+	s.renderSendPage(w, r, http.StatusInsufficientStorage, sendPageData{
+		Error:         "The server does not have enough storage space for this upload. Try fewer or smaller files, or wait for older transfers to expire.",
+		StripMetadata: s.stripMetadata(values),
+	})
 }
 
+// UploadFileHandler stores the files of a multipart upload as they arrive,
+// so quotas and the free space reserve are enforced while the body is
+// read rather than after a temporary copy was made.
 func (s *Server) UploadFileHandler(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		http.Error(w, "failed to parse upload", http.StatusBadRequest)
+	logger := logging.FromContext(r.Context())
+	// Chunked uploads announce no length; they are still checked against
+	// a store that is already full.
+	if err := s.store.CheckCapacity(max(r.ContentLength, 0)); err != nil {
+		logger.Warn("upload rejected", "content_length", r.ContentLength, "error", err)
+		s.writeInsufficientStorage(w, r, nil)
 		return
 	}
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		http.Error(w, "please attach at least one file", http.StatusBadRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxUploadSize)
+	parts, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "failed to parse upload", http.StatusBadRequest)
 		return
 	}
-	var payloads []storage.FilePayload
-	for _, header := range files {
-		f, err := header.Open()
-		if err != nil {
-			http.Error(w, "unable to read file", http.StatusBadRequest)
+	stream := newUploadStream(parts)
+	if err := stream.start(); err != nil {
+		if err == io.EOF {
+			http.Error(w, "please attach at least one file", http.StatusBadRequest)
 			return
 		}
-		payloads = append(payloads, storage.FilePayload{
-			Name:    header.Filename,
-			MIME:    header.Header.Get("Content-Type"),
-			Content: f,
-		})
+		writeUploadStreamError(w, err)
+		return
+	}
+	values := stream.values
+	if stream.encrypted && s.cfg.ScanPolicy == config.ScanRequireClean {
+		http.Error(w, "this server only accepts files it can scan for malware, so end-to-end encryption is not available", http.StatusUnprocessableEntity)
+		return
 	}
-	category := normalizeCategory(r.FormValue("category"))
+	category := normalizeCategory(values.Get("category"))
 	var pin string
-	if strings.TrimSpace(r.FormValue("pin")) != "" {
-		pin = r.FormValue("pin")
+	if strings.TrimSpace(values.Get("pin")) != "" {
+		pin = values.Get("pin")
 	}
-	transfer, err := s.store.SaveFiles(category, pin, payloads)
+	owner := s.sessionOwner(r)
+	transfer, err := s.store.SaveFiles(storage.SaveOptions{
+		Category:   category,
+		Pin:        pin,
+		Owner:      owner,
+		OwnerQuota: s.ownerQuota(owner),
+		Encrypted:  stream.encrypted,
+
+		EnforceCategory: s.cfg.EnforceCategory,
+		StripMetadata:   s.stripMetadata(values),
+	}, stream)
 	if err != nil {
+		logger.Error("storing upload failed", "files", stream.files, "error", err)
+		if stream.err != nil {
+			writeUploadStreamError(w, stream.err)
+			return
+		}
+		if errors.Is(err, storage.ErrNoFiles) {
+			http.Error(w, "please attach at least one file", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, storage.ErrInsufficientStorage) {
+			s.writeInsufficientStorage(w, r, values)
+			return
+		}
+		if errors.Is(err, storage.ErrOwnerQuotaExceeded) {
+			s.renderSendPage(w, r, http.StatusInsufficientStorage, sendPageData{
+				Error:         "This upload would exceed your storage quota. Remove some of your active transfers or wait for them to expire.",
+				StripMetadata: s.stripMetadata(values),
+			})
+			return
+		}
+		var policyErr *storage.PolicyError
+		if errors.As(err, &policyErr) {
+			if acceptsJSON(r) {
+				http.Error(w, policyErr.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			s.renderSendPage(w, r, http.StatusUnprocessableEntity, sendPageData{
+				Error:         "Some files are not accepted on this server, so nothing was uploaded. Remove them and try again.",
+				Rejected:      policyErr.Files,
+				StripMetadata: s.stripMetadata(values),
+			})
+			return
+		}
+		var categoryErr *storage.CategoryError
+		if errors.As(err, &categoryErr) {
+			s.renderSendPage(w, r, http.StatusUnprocessableEntity, sendPageData{
+				Error: fmt.Sprintf("Some files are not %s: %s. Remove them or choose another content type.",
+					strings.ToLower(categoryLabel(category)), describeMismatches(categoryErr.Files)),
+				StripMetadata: s.stripMetadata(values),
+			})
+			return
+		}
+		if errors.Is(err, storage.ErrChecksumMismatch) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, storage.ErrClosed) {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "unable to store files", http.StatusInternalServerError)
 		return
 	}
 
-	scheme := requestScheme(r)
-	shareURL := fmt.Sprintf("%s://%s/incoming?id=%s&token=%s", scheme, r.Host, transfer.ID, transfer.Token)
-	filesData := make([]shareFile, 0, len(transfer.Files))
-	for _, f := range transfer.Files {
-		filesData = append(filesData, shareFile{
-			Name:      f.Name,
-			Mime:      f.Mime,
-			SizeMB:    float64(f.Size) / (1024 * 1024),
-			DirectURL: fmt.Sprintf("%s://%s/file?id=%s&token=%s&file=%s", scheme, r.Host, transfer.ID, transfer.Token, url.QueryEscape(f.ID)),
+	totalSize := transfer.TotalSize()
+	if s.sessionUser(r) != "" {
+		err := s.gate.Accounts().RecordTransfer(owner, access.HistoryEntry{
+			TransferID: transfer.ID,
+			Category:   transfer.Category,
+			Files:      len(transfer.Files),
+			Bytes:      totalSize,
+			CreatedAt:  transfer.CreatedAt,
+		})
+		if err != nil {
+			logger.Error("recording transfer history failed", "user", owner, "error", err)
+		}
+	}
+	metrics.UploadsTotal.With(transfer.Category).Inc()
+	metrics.UploadedFilesTotal.With(transfer.Category).Add(float64(len(transfer.Files)))
+	metrics.UploadedBytesTotal.Add(float64(totalSize))
+	logger.Info("transfer created",
+		"transfer_id", transfer.ID,
+		"user", owner,
+		"category", transfer.Category,
+		"files", len(transfer.Files),
+		"bytes", totalSize,
+		"pin_protected", transfer.PinHash != "",
+		"encrypted", transfer.Encrypted,
+	)
+	mismatched := storage.MismatchedFiles(transfer)
+	if len(mismatched) > 0 {
+		logger.Info("files do not match transfer category", "transfer_id", transfer.ID, "category", transfer.Category, "files", len(mismatched))
+	}
+
+	if transfer.PinHash != "" {
+		s.grantPinAccess(w, transfer)
+	}
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(uploadResponse{
+			ID:         transfer.ID,
+			Token:      transfer.Token,
+			ShareLink:  shareLink(r, transfer),
+			ManageLink: manageLink(r, transfer),
+			SharePage:  fmt.Sprintf("/share?id=%s&key=%s", transfer.ID, transfer.ManageToken),
+			Mismatched: mismatched,
 		})
+		return
+	}
+	s.renderSharePage(w, r, transfer)
+}
+
+// uploadResponse is returned to API clients that upload with
+// "Accept: application/json" instead of being shown the share page.
+type uploadResponse struct {
+	ID         string `json:"id"`
+	Token      string `json:"token"`
+	ShareLink  string `json:"shareLink"`
+	ManageLink string `json:"manageLink"`
+	SharePage  string `json:"sharePage"`
+	// Mismatched lists files whose detected type is outside the chosen
+	// category.
+	Mismatched []storage.MismatchedFile `json:"mismatched,omitempty"`
+}
+
+// SharePageHandler shows the share page of an existing transfer to its
+// sender, authorized by the management key. Browser uploads of end-to-end
+// encrypted files land here once the script has finished uploading.
+func (s *Server) SharePageHandler(w http.ResponseWriter, r *http.Request) {
+	transfer, err := s.manageTransferFromRequest(r)
+	if err != nil {
+		writeTransferError(w, err)
+		return
 	}
+	s.renderSharePage(w, r, transfer)
+}
+
+func (s *Server) renderSharePage(w http.ResponseWriter, r *http.Request, transfer *storage.Transfer) {
 	data := sharePageData{
-		ShareLink:   shareURL,
-		Category:    categoryLabel(category),
+		ShareLink:   shareLink(r, transfer),
+		ManageLink:  manageLink(r, transfer),
+		Owner:       s.sessionUser(r),
+		Category:    categoryLabel(transfer.Category),
 		RequiresPin: transfer.PinHash != "",
+		Encrypted:   transfer.Encrypted,
 		TransferID:  transfer.ID,
 		Token:       transfer.Token,
-		Files:       filesData,
+	}
+	for _, f := range transfer.Files {
+		file := shareFile{
+			FileID:        f.ID,
+			Name:          f.Name,
+			Mime:          f.Mime,
+			SizeMB:        float64(f.Size) / (1024 * 1024),
+			EncryptedMeta: f.EncryptedMeta,
+			Mismatch:      !transfer.Encrypted && !storage.CategoryMatches(transfer.Category, f.Mime),
+			ScanLabel:     scanLabel(&f),
+			MetadataLabel: metadataLabel(&f),
+			Blocked:       s.downloadBlocked(&f) != "",
+		}
+		if file.Mismatch {
+			data.Mismatched++
+		}
+		if !transfer.Encrypted && !file.Blocked {
+			file.DirectURL, _ = s.signedFileURL(r, transfer, f.ID, "", s.cfg.DownloadLinkTTL, false)
+		}
+		data.Files = append(data.Files, file)
 	}
 
-	tmpl := template.Must(template.ParseFiles(filepath.Join("templates", "share.html")))
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	_ = tmpl.Execute(w, data)
+	renderTemplate(w, r, http.StatusOK, "share.html", data, nil)
+}
+
+// acceptsJSON reports whether the client asked for JSON, like sharecli and
+// the end-to-end encryption script do.
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func manageLink(r *http.Request, transfer *storage.Transfer) string {
+	return fmt.Sprintf("%s://%s/manage?id=%s&key=%s", requestScheme(r), r.Host, transfer.ID, transfer.ManageToken)
+}
+
+// parseChecksum parses a "checksum" form field: "sha256:<hex>",
+// "blake3:<hex>" or bare hex for SHA-256. An empty value leaves the file
+// unchecked.
+func parseChecksum(payload *storage.FilePayload, value string, file int) error {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return nil
+	}
+	algo, sum, found := strings.Cut(value, ":")
+	if !found {
+		algo, sum = "sha256", value
+	}
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 64 {
+		return badUpload(fmt.Sprintf("file %d: checksum must be 64 hex characters", file))
+	}
+	switch algo {
+	case "sha256", "sha-256":
+		payload.ExpectedSHA256 = sum
+	case "blake3":
+		payload.ExpectedBLAKE3 = sum
+	default:
+		return badUpload(fmt.Sprintf("file %d: unsupported checksum algorithm %q", file, algo))
+	}
+	return nil
+}
+
+// checkEncryptedMeta validates the sealed metadata sent with an end-to-end
+// encrypted file.
+func checkEncryptedMeta(meta string, file int) error {
+	if meta == "" || len(meta) > maxEncryptedMetaSize {
+		return badUpload(fmt.Sprintf("file %d: invalid encrypted metadata", file))
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(meta); err != nil {
+		return badUpload(fmt.Sprintf("file %d: invalid encrypted metadata", file))
+	}
+	return nil
 }
 
 type shareFile struct {
-	Name      string
-	Mime      string
-	SizeMB    float64
-	DirectURL string
+	FileID        string
+	Name          string
+	Mime          string
+	SizeMB        float64
+	DirectURL     string
+	EncryptedMeta string
+	// Mismatch marks a file whose detected type is outside the category.
+	Mismatch      bool
+	ScanLabel     string
+	Blocked       bool
+	MetadataLabel string
 }
 
 type sharePageData struct {
 	ShareLink   string
+	ManageLink  string
+	Owner       string
 	Category    string
 	RequiresPin bool
+	Encrypted   bool
 	TransferID  string
 	Token       string
 	Files       []shareFile
+	// Mismatched counts the files that do not match the category.
+	Mismatched int
+}
+
+// describeMismatches lists files with their detected types for messages.
+func describeMismatches(files []storage.MismatchedFile) string {
+	parts := make([]string, len(files))
+	for i, f := range files {
+		parts[i] = fmt.Sprintf("%s (%s)", f.Name, f.Mime)
+	}
+	return strings.Join(parts, ", ")
 }
 
 func normalizeCategory(input string) string {
@@ -134,3 +403,17 @@ func requestScheme(r *http.Request) string {
 	}
 	return "http"
 }
+
+// ownerQuota returns the storage quota of a local user, falling back to the
+// instance default for users without their own quota and for OIDC senders.
+func (s *Server) ownerQuota(owner string) int64 {
+	if owner == "" {
+		return 0
+	}
+	if accounts := s.gate.Accounts(); accounts != nil {
+		if user, err := accounts.User(owner); err == nil && user.Quota > 0 {
+			return user.Quota
+		}
+	}
+	return s.cfg.UserQuota
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"share/config"
+)
+
+func TestRequireCleanRefusesEncryptedUploads(t *testing.T) {
+	s, _ := newTestServer(t, testContent(10))
+	s.cfg.ScanPolicy = config.ScanRequireClean
+	s.cfg.MaxUploadSize = 1 << 20
+	before, used := s.store.Stats()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("encrypted", "1")
+	form.WriteField("meta", "sealed")
+	part, _ := form.CreateFormFile("files", "file-1.sge")
+	part.Write(testContent(100))
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/uploadFile", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.UploadFileHandler(w, r)
+
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "end-to-end encryption is not available") {
+		t.Fatalf("encrypted upload = %d %q, want 422 explaining why", w.Code, w.Body.String())
+	}
+	if after, usedAfter := s.store.Stats(); after != before || usedAfter != used {
+		t.Fatalf("store holds %d transfers, %d bytes after the refused upload, want %d, %d", after, usedAfter, before, used)
+	}
+
+	// Templates are read relative to the repository root.
+	t.Chdir("..")
+	w = httptest.NewRecorder()
+	s.UploadPage(w, httptest.NewRequest(http.MethodGet, "/send", nil))
+	if !strings.Contains(w.Body.String(), `id="toggle-e2e" disabled`) {
+		t.Fatal("send page offers end-to-end encryption under require-clean")
+	}
+}
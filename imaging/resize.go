@@ -0,0 +1,82 @@
+// Package imaging scales and orients decoded images for thumbnails and
+// smaller copies of photos, and strips metadata from JPEG and PNG files,
+// using only the standard library.
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// FitSize returns the size of a w×h image scaled down to fit in maxW×maxH
+// while keeping its aspect ratio. Images that already fit keep their size.
+func FitSize(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+// Fit scales src down to fit in maxW×maxH, averaging the source pixels
+// each destination pixel covers. It never enlarges an image.
+func Fit(src image.Image, maxW, maxH int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := FitSize(sw, sh, maxW, maxH)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	if sw == 0 || sh == 0 {
+		return dst
+	}
+
+	// Source rows are converted one at a time so memory stays proportional
+	// to the width, while draw's fast paths handle the pixel formats.
+	row := image.NewRGBA(image.Rect(0, 0, sw, 1))
+	sums := make([]uint64, dw*4)
+	counts := make([]uint64, dw)
+	// x0[i] is the first source column of destination column i.
+	x0 := make([]int, dw+1)
+	for i := range x0 {
+		x0[i] = i * sw / dw
+	}
+
+	sy := 0
+	for dy := 0; dy < dh; dy++ {
+		yEnd := (dy + 1) * sh / dh
+		clear(sums)
+		clear(counts)
+		for ; sy < yEnd; sy++ {
+			draw.Draw(row, row.Rect, src, image.Pt(b.Min.X, b.Min.Y+sy), draw.Src)
+			for dx := 0; dx < dw; dx++ {
+				for x := x0[dx]; x < max(x0[dx+1], x0[dx]+1); x++ {
+					p := row.Pix[x*4 : x*4+4]
+					sums[dx*4] += uint64(p[0])
+					sums[dx*4+1] += uint64(p[1])
+					sums[dx*4+2] += uint64(p[2])
+					sums[dx*4+3] += uint64(p[3])
+					counts[dx]++
+				}
+			}
+		}
+		out := dst.Pix[dy*dst.Stride:]
+		for dx := 0; dx < dw; dx++ {
+			n := max(counts[dx], 1)
+			for c := 0; c < 4; c++ {
+				out[dx*4+c] = uint8((sums[dx*4+c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// Flatten draws img over an opaque background, for encoders such as JPEG
+// that have no transparency.
+func Flatten(img image.Image, background color.Color) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Rect, image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Rect, img, img.Bounds().Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,274 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ErrUnsupported is returned by StripMetadata for files that are neither
+// JPEG nor PNG.
+var ErrUnsupported = errors.New("imaging: not a JPEG or PNG file")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// StripMetadata copies a JPEG or PNG file from r to w without its metadata:
+// EXIF, XMP, IPTC and comments, as well as anything appended after the
+// image, where phones keep extra pictures with metadata of their own.
+// Color profiles are kept, and so is an EXIF orientation other than the
+// default, as the only tag of a minimal EXIF block, so photos stay upright.
+// It returns the number of bytes removed.
+func StripMetadata(w io.Writer, r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	head, _ := br.Peek(len(pngSignature))
+	var err error
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xd8}):
+		err = stripJPEG(bw, br)
+	case bytes.Equal(head, pngSignature):
+		err = stripPNG(bw, br)
+	default:
+		return 0, ErrUnsupported
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	// Trailing data counts as removed.
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return 0, err
+	}
+	return cr.n - cw.n, nil
+}
+
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	// APP14 holds Adobe's color transform flag, which decoders need.
+	markerAPP14 = 0xee
+	markerAPP15 = 0xef
+	markerCOM   = 0xfe
+)
+
+func stripJPEG(w *bufio.Writer, r *bufio.Reader) error {
+	if _, err := r.Discard(2); err != nil {
+		return err
+	}
+	w.Write([]byte{0xff, markerSOI})
+	code, err := readMarker(r)
+	for err == nil {
+		switch {
+		case code == markerEOI:
+			_, err = w.Write([]byte{0xff, markerEOI})
+			return err
+		case code >= 0xd0 && code <= 0xd7, code == 0x01:
+			// Restart and TEM markers stand alone.
+			w.Write([]byte{0xff, code})
+			code, err = readMarker(r)
+			continue
+		}
+		var length [2]byte
+		if _, err = io.ReadFull(r, length[:]); err != nil {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return errors.New("imaging: invalid JPEG segment length")
+		}
+		segment := make([]byte, n-2)
+		if _, err = io.ReadFull(r, segment); err != nil {
+			break
+		}
+		if keepSegment(code, segment) {
+			w.Write([]byte{0xff, code})
+			w.Write(length[:])
+			w.Write(segment)
+		} else if code == markerAPP1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			if o := exifOrientation(segment[6:]); o > 1 {
+				exif := append([]byte("Exif\x00\x00"), orientationExif(o)...)
+				w.Write([]byte{0xff, markerAPP1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)})
+				w.Write(exif)
+			}
+		}
+		if code == markerSOS {
+			code, err = copyScan(w, r)
+		} else {
+			code, err = readMarker(r)
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// keepSegment reports whether a JPEG segment is image data rather than
+// metadata. Of the application segments only JFIF, ICC profiles and
+// Adobe's are kept.
+func keepSegment(code byte, segment []byte) bool {
+	switch {
+	case code == markerCOM:
+		return false
+	case code == markerAPP2:
+		return bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00"))
+	case code == markerAPP0, code == markerAPP14:
+		return true
+	case code >= markerAPP1 && code <= markerAPP15:
+		return false
+	}
+	return true
+}
+
+// readMarker reads the next marker, skipping fill bytes, and returns its
+// code.
+func readMarker(r *bufio.Reader) (byte, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if c != 0xff {
+		return 0, errors.New("imaging: invalid JPEG marker")
+	}
+	for c == 0xff {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return c, nil
+}
+
+// copyScan copies entropy-coded data up to the next marker and returns
+// that marker's code.
+func copyScan(w *bufio.Writer, r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != 0xff {
+			w.WriteByte(c)
+			continue
+		}
+		next, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		for next == 0xff {
+			if next, err = r.ReadByte(); err != nil {
+				return 0, err
+			}
+		}
+		// Stuffed zero bytes and restart markers are part of the scan.
+		if next == 0x00 || next >= 0xd0 && next <= 0xd7 {
+			w.Write([]byte{0xff, next})
+			continue
+		}
+		return next, nil
+	}
+}
+
+// pngMetadata lists the PNG chunks that hold metadata: EXIF, text (which
+// also carries XMP) and the modification time.
+var pngMetadata = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNG(w *bufio.Writer, r *bufio.Reader) error {
+	if _, err := r.Discard(len(pngSignature)); err != nil {
+		return err
+	}
+	w.Write(pngSignature)
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if length > 1<<31-1 {
+			return errors.New("imaging: invalid PNG chunk length")
+		}
+		kind := string(header[4:])
+		if !pngMetadata[kind] {
+			w.Write(header[:])
+			if _, err := io.CopyN(w, r, int64(length)+4); err != nil {
+				return fmt.Errorf("imaging: reading PNG %s chunk: %w", kind, err)
+			}
+			if kind == "IEND" {
+				return nil
+			}
+			continue
+		}
+		if kind == "eXIf" && length <= 1<<20 {
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if o := exifOrientation(data); o > 1 {
+				writePNGChunk(w, "eXIf", orientationExif(o))
+			}
+			length = 0
+		}
+		if _, err := r.Discard(int(length) + 4); err != nil {
+			return err
+		}
+	}
+}
+
+func writePNGChunk(w io.Writer, kind string, data []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], kind)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	w.Write(header[:])
+	w.Write(data)
+	w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+}
+
+// orientationExif returns a big-endian TIFF header with a single IFD
+// holding only the orientation tag.
+func orientationExif(orientation int) []byte {
+	return []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		0, 0, 0, 0,
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
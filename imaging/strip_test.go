@@ -0,0 +1,241 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// secret marks metadata that must not survive stripping.
+const secret = "SECRET-"
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 24, 16))
+	for y := range 16 {
+		for x := range 24 {
+			img.Set(x, y, color.RGBA{uint8(x * 10), uint8(y * 15), 128, 255})
+		}
+	}
+	return img
+}
+
+// exifWithOrientation returns a little-endian TIFF header whose IFD0 holds
+// a camera make, stored outside the entry, and the given orientation.
+func exifWithOrientation(orientation int) []byte {
+	model := secret + "camera\x00"
+	le := binary.LittleEndian
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	tiff = le.AppendUint16(tiff, 2)
+	// Make, ASCII, with its value after the IFD.
+	tiff = le.AppendUint16(tiff, 0x010f)
+	tiff = le.AppendUint16(tiff, 2)
+	tiff = le.AppendUint32(tiff, uint32(len(model)))
+	tiff = le.AppendUint32(tiff, 8+2+2*12+4)
+	// Orientation, SHORT.
+	tiff = le.AppendUint16(tiff, 0x0112)
+	tiff = le.AppendUint16(tiff, 3)
+	tiff = le.AppendUint32(tiff, 1)
+	tiff = le.AppendUint16(tiff, uint16(orientation))
+	tiff = le.AppendUint16(tiff, 0)
+	tiff = le.AppendUint32(tiff, 0)
+	return append(tiff, model...)
+}
+
+func jpegSegment(code byte, data string) []byte {
+	return append([]byte{0xff, code, byte((len(data) + 2) >> 8), byte(len(data) + 2)}, data...)
+}
+
+var iccSegment = jpegSegment(markerAPP2, "ICC_PROFILE\x00\x01\x01profile data")
+
+// photoJPEG returns a JPEG carrying EXIF, XMP, IPTC, a comment, an ICC
+// profile and a trailer, and the length of the image without the trailer.
+func photoJPEG(t *testing.T, orientation int) ([]byte, int) {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	b.Write([]byte{0xff, markerSOI})
+	b.Write(jpegSegment(markerAPP0, "JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00"))
+	b.Write(jpegSegment(markerAPP1, "Exif\x00\x00"+string(exifWithOrientation(orientation))))
+	b.Write(jpegSegment(markerAPP1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta><dc:creator>"+secret+"xmp</dc:creator></x:xmpmeta>"))
+	b.Write(jpegSegment(0xed, "Photoshop 3.0\x008BIM\x04\x04\x00\x00\x00\x00\x00\x10\x1c\x02\x50\x00\x0b"+secret+"iptc"))
+	b.Write(iccSegment)
+	b.Write(jpegSegment(markerCOM, secret+"comment"))
+	b.Write(encoded.Bytes()[2:])
+	n := b.Len()
+	// Phones append extra pictures, with metadata of their own.
+	b.WriteString(secret + "trailer")
+	return b.Bytes(), n
+}
+
+func strip(t *testing.T, in []byte) ([]byte, int64) {
+	t.Helper()
+	var out bytes.Buffer
+	removed, err := StripMetadata(&out, bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != int64(len(in)-out.Len()) {
+		t.Errorf("removed = %d, want %d", removed, len(in)-out.Len())
+	}
+	return out.Bytes(), removed
+}
+
+func TestStripJPEG(t *testing.T) {
+	in, _ := photoJPEG(t, 6)
+	out, _ := strip(t, in)
+	if bytes.Contains(out, []byte(secret)) {
+		t.Fatalf("metadata left at byte %d", bytes.Index(out, []byte(secret)))
+	}
+	for _, kept := range [][]byte{iccSegment, []byte("JFIF\x00")} {
+		if !bytes.Contains(out, kept) {
+			t.Errorf("stripped file lost %q", kept)
+		}
+	}
+	if o := JPEGOrientation(out); o != 6 {
+		t.Errorf("orientation = %d, want 6", o)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != testImage().Bounds() {
+		t.Errorf("bounds = %v", img.Bounds())
+	}
+
+	// The default orientation needs no EXIF block at all.
+	in, _ = photoJPEG(t, 1)
+	out, _ = strip(t, in)
+	if bytes.Contains(out, []byte("Exif\x00")) {
+		t.Error("EXIF block kept for the default orientation")
+	}
+
+	// Stripping again leaves nothing more to remove.
+	if again, removed := strip(t, out); removed != 0 || !bytes.Equal(again, out) {
+		t.Errorf("second strip removed %d bytes", removed)
+	}
+}
+
+func TestStripJPEGDamaged(t *testing.T) {
+	in, n := photoJPEG(t, 6)
+	// Every cut before the end of the image loses part of a segment, the
+	// scan or the end marker.
+	for i := 2; i < n; i++ {
+		if _, err := StripMetadata(new(bytes.Buffer), bytes.NewReader(in[:i])); err == nil {
+			t.Fatalf("file cut at %d of %d bytes was accepted", i, n)
+		}
+	}
+
+	soi := []byte{0xff, markerSOI}
+	tests := map[string][]byte{
+		"length 0":       append(soi, 0xff, markerAPP1, 0, 0),
+		"length 1":       append(soi, 0xff, markerAPP1, 0, 1, 'E'),
+		"length too big": append(soi, 0xff, markerAPP1, 0xff, 0xff, 'E', 'x', 'i', 'f', 0xff, markerEOI),
+		"no marker":      append(soi, 0x00, markerAPP1, 0, 4, 0, 0, 0xff, markerEOI),
+		"only SOI":       soi,
+	}
+	for name, data := range tests {
+		if _, err := StripMetadata(new(bytes.Buffer), bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: damaged file was accepted", name)
+		}
+	}
+}
+
+func pngChunk(kind string, data []byte) []byte {
+	var b bytes.Buffer
+	writePNGChunk(&b, kind, data)
+	return b.Bytes()
+}
+
+// photoPNG returns a PNG carrying EXIF, text, XMP, a timestamp, an ICC
+// profile and a trailer, and the length of the image without the trailer.
+func photoPNG(t *testing.T, orientation int) ([]byte, []byte, int) {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	raw := encoded.Bytes()
+	// IHDR comes first: signature, length, type, 13 bytes of data and CRC.
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	iccp := pngChunk("iCCP", []byte("profile\x00\x00compressed profile"))
+	var b bytes.Buffer
+	b.Write(raw[:ihdrEnd])
+	b.Write(iccp)
+	b.Write(pngChunk("eXIf", exifWithOrientation(orientation)))
+	b.Write(pngChunk("tEXt", []byte("Author\x00"+secret+"text")))
+	b.Write(pngChunk("zTXt", []byte("Comment\x00\x00"+secret+"ztxt")))
+	b.Write(pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta>"+secret+"xmp</x:xmpmeta>")))
+	b.Write(pngChunk("tIME", []byte{0x07, 0xea, 10, 19, 12, 0, 0}))
+	b.Write(raw[ihdrEnd:])
+	n := b.Len()
+	b.WriteString(secret + "trailer")
+	return b.Bytes(), iccp, n
+}
+
+func TestStripPNG(t *testing.T) {
+	in, iccp, _ := photoPNG(t, 8)
+	out, _ := strip(t, in)
+	if bytes.Contains(out, []byte(secret)) {
+		t.Fatalf("metadata left at byte %d", bytes.Index(out, []byte(secret)))
+	}
+	for _, kind := range []string{"tEXt", "zTXt", "iTXt", "tIME"} {
+		if bytes.Contains(out, []byte(kind)) {
+			t.Errorf("%s chunk kept", kind)
+		}
+	}
+	if !bytes.Contains(out, iccp) {
+		t.Error("stripped file lost its ICC profile")
+	}
+	i := bytes.Index(out, []byte("eXIf"))
+	if i < 4 {
+		t.Fatal("orientation not kept")
+	}
+	length := binary.BigEndian.Uint32(out[i-4:])
+	if o := exifOrientation(out[i+4 : i+4+int(length)]); o != 8 {
+		t.Errorf("orientation = %d, want 8", o)
+	}
+	// The decoder checks the CRC of every chunk, the rewritten one too.
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != testImage().Bounds() {
+		t.Errorf("bounds = %v", img.Bounds())
+	}
+
+	in, _, _ = photoPNG(t, 1)
+	out, _ = strip(t, in)
+	if bytes.Contains(out, []byte("eXIf")) {
+		t.Error("EXIF chunk kept for the default orientation")
+	}
+}
+
+func TestStripPNGDamaged(t *testing.T) {
+	in, _, n := photoPNG(t, 8)
+	for i := len(pngSignature); i < n; i++ {
+		if _, err := StripMetadata(new(bytes.Buffer), bytes.NewReader(in[:i])); err == nil {
+			t.Fatalf("file cut at %d of %d bytes was accepted", i, n)
+		}
+	}
+	huge := append([]byte{}, pngSignature...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff, 'I', 'D', 'A', 'T')
+	if _, err := StripMetadata(new(bytes.Buffer), bytes.NewReader(huge)); err == nil {
+		t.Error("chunk longer than PNG allows was accepted")
+	}
+}
+
+func TestStripUnsupported(t *testing.T) {
+	for _, data := range []string{"", "GIF89a", "\xff", "\x89PNG"} {
+		if _, err := StripMetadata(new(bytes.Buffer), bytes.NewReader([]byte(data))); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("StripMetadata(%q) = %v, want ErrUnsupported", data, err)
+		}
+	}
+}
@@ -2,61 +2,263 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
+	"share/access"
+	"share/config"
 	"share/devices"
 	"share/handlers"
+	"share/logging"
+	"share/metrics"
+	"share/policy"
+	"share/scan"
+	"share/security"
 	"share/storage"
 	"share/utils"
 )
 
-const (
-	port            = "8080"
-	uploadsDir      = "uploads"
-	transferTTL     = 2 * time.Hour
-	cleanupInterval = 15 * time.Minute
-)
-
 func main() {
-	store, err := storage.NewStore(filepath.Clean(uploadsDir))
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("error loading configuration: %v", err)
+	}
+	logger, err := logging.New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
 	if err != nil {
-		log.Fatalf("error initializing storage: %v", err)
+		log.Fatalf("error initializing logging: %v", err)
 	}
-	registry := devices.NewRegistry(50)
+	slog.SetDefault(logger)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go store.StartCleanup(ctx, transferTTL, cleanupInterval)
-
-	server := handlers.NewServer(store, registry)
-
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	http.HandleFunc("/", server.HomeHandler)
-	http.HandleFunc("/upload", server.UploadPage)
-	http.HandleFunc("/uploadFile", server.UploadFileHandler)
-	http.HandleFunc("/meta", server.FileMetaHandler)
-	http.HandleFunc("/file", server.ServeFileHandler)
-	http.HandleFunc("/incoming", server.IncomingHandler)
-	http.HandleFunc("/accept", server.AcceptHandler)
-	http.HandleFunc("/decline", server.DeclineHandler)
-	http.HandleFunc("/device", server.DevicePage)
-	http.HandleFunc("/api/devices", server.ListDevicesHandler)
-	http.HandleFunc("/api/devices/register", server.RegisterDeviceHandler)
-	http.HandleFunc("/api/devices/notify", server.NotifyDeviceHandler)
-	http.HandleFunc("/api/devices/pending", server.DevicePendingHandler)
-	http.HandleFunc("/api/devices/clear", server.ClearPendingHandler)
+	masterKey, err := loadEncryptionKey(cfg)
+	if err != nil {
+		logger.Error("error loading encryption key", "error", err)
+		os.Exit(1)
+	}
+	if masterKey != nil {
+		logger.Info("encryption at rest enabled")
+	}
+	scanner, err := loadScanner(cfg)
+	if err != nil {
+		logger.Error("error configuring malware scanner", "error", err)
+		os.Exit(1)
+	}
+	if scanner != nil {
+		logger.Info("malware scanning enabled", "policy", cfg.ScanPolicy)
+	}
+	var uploadPolicy *policy.Policy
+	if cfg.PolicyFile != "" {
+		if uploadPolicy, err = policy.Load(cfg.PolicyFile); err != nil {
+			logger.Error("error loading upload policy", "path", cfg.PolicyFile, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("upload policy loaded", "path", cfg.PolicyFile, "rules", len(uploadPolicy.Rules))
+	}
+	store, err := storage.NewStore(filepath.Clean(cfg.UploadsDir), storage.Options{
+		Quota:       cfg.StorageQuota,
+		FreeReserve: cfg.FreeSpaceReserve,
+		BLAKE3:      cfg.ChecksumBLAKE3,
+		MasterKey:   masterKey,
+		Scanner:     scanner,
+		Policy:      uploadPolicy,
+	})
+	if err != nil {
+		logger.Error("error initializing storage", "error", err)
+		os.Exit(1)
+	}
+	registry := devices.NewRegistry(cfg.MaxDevices)
+
+	var accounts *access.Accounts
+	if cfg.AccountsFile != "" {
+		if accounts, err = access.LoadAccounts(cfg.AccountsFile); err != nil {
+			logger.Error("error loading accounts", "path", cfg.AccountsFile, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	secret, err := utils.LoadOrCreateKey(cfg.SigningKeyFile, 32)
+	if err != nil {
+		logger.Error("error loading signing key", "path", cfg.SigningKeyFile, "error", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cleanupCtx, stopCleanup := context.WithCancel(context.Background())
+	defer stopCleanup()
+	cleanupDone := make(chan struct{})
+	go func() {
+		defer close(cleanupDone)
+		store.StartCleanup(cleanupCtx, cfg.TransferTTL, cfg.CleanupInterval)
+	}()
+	thumbsDone := make(chan struct{})
+	go func() {
+		defer close(thumbsDone)
+		store.RunThumbnails(cleanupCtx)
+	}()
+
+	server := handlers.NewServer(store, registry, accounts, secret, cfg)
+	registerGauges(store, registry)
+
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.HandleFunc("/", server.HomeHandler)
+	mux.HandleFunc("/upload", server.RequireAccess(server.UploadPage))
+	mux.HandleFunc("/uploadFile", security.NoReferrer(server.RequireAccess(server.RateLimit("upload", server.UploadFileHandler))))
+	mux.HandleFunc("/meta", security.NoReferrer(server.RequireShareAccess(server.FileMetaHandler)))
+	mux.HandleFunc("/file", security.NoReferrer(server.RequireShareAccess(server.ServeFileHandler)))
+	mux.HandleFunc("/archive", security.NoReferrer(server.RequireShareAccess(server.ArchiveHandler)))
+	mux.HandleFunc("/thumbnail", security.NoReferrer(server.RequireShareAccess(server.ThumbnailHandler)))
+	mux.HandleFunc("/preview", security.NoReferrer(server.RequireShareAccess(server.PreviewHandler)))
+	mux.HandleFunc("/preview/raw", security.NoReferrer(server.RequireShareAccess(server.RawPreviewHandler)))
+	mux.HandleFunc("/r/{id}", security.NoReferrer(server.RequireShareAccess(server.OpenLinkPage)))
+	mux.HandleFunc("/api/transfers/open", security.NoReferrer(server.RequireShareAccess(server.RateLimit("open", server.OpenTransferHandler))))
+	mux.HandleFunc("/api/transfers/links", security.NoReferrer(server.RequireShareAccess(server.RateLimit("open", server.CreateDownloadLinkHandler))))
+	mux.HandleFunc("/incoming", security.NoReferrer(server.RequireShareAccess(server.IncomingHandler)))
+	mux.HandleFunc("/accept", security.NoReferrer(server.RequireShareAccess(server.AcceptHandler)))
+	mux.HandleFunc("/decline", security.NoReferrer(server.RequireShareAccess(server.DeclineHandler)))
+	mux.HandleFunc("/device", server.RequireAccess(server.DevicePage))
+	mux.HandleFunc("/manage", security.NoReferrer(server.ManageHandler))
+	mux.HandleFunc("/share", security.NoReferrer(server.SharePageHandler))
+	mux.HandleFunc("/manage/revoke", security.NoReferrer(server.RevokeTransferHandler))
+	mux.HandleFunc("/login", server.RateLimit("login", server.LoginHandler))
+	mux.HandleFunc("/logout", server.LogoutHandler)
+	mux.HandleFunc("/signup", server.RateLimit("login", server.SignupHandler))
+	mux.HandleFunc("/auth/oidc/login", server.RateLimit("login", server.OIDCLoginHandler))
+	mux.HandleFunc("/auth/oidc/callback", server.RateLimit("login", server.OIDCCallbackHandler))
+	mux.HandleFunc("/history", server.RequireUser(server.HistoryHandler))
+	mux.HandleFunc("/admin", server.RequireAdmin(server.AdminPage))
+	mux.HandleFunc("/admin/invites", server.RequireAdmin(server.CreateInviteHandler))
+	mux.HandleFunc("/admin/invites/revoke", server.RequireAdmin(server.RevokeInviteHandler))
+	mux.HandleFunc("/admin/users", server.RequireAdmin(server.CreateUserHandler))
+	mux.HandleFunc("/admin/users/quota", server.RequireAdmin(server.SetUserQuotaHandler))
+	mux.HandleFunc("/admin/users/delete", server.RequireAdmin(server.DeleteUserHandler))
+	mux.HandleFunc("/api/devices", server.RequireAccess(server.RateLimit("devices", server.ListDevicesHandler)))
+	mux.HandleFunc("/api/devices/register", server.RequireAccess(server.RateLimit("devices", server.RegisterDeviceHandler)))
+	mux.HandleFunc("/api/devices/notify", server.RequireAccess(server.RateLimit("devices", server.NotifyDeviceHandler)))
+	mux.HandleFunc("/api/devices/pending", server.RequireAccess(server.RateLimit("devices", server.DevicePendingHandler)))
+	mux.HandleFunc("/api/devices/clear", server.RequireAccess(server.RateLimit("devices", server.ClearPendingHandler)))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", server.HealthzHandler)
+	mux.HandleFunc("/readyz", server.ReadyzHandler)
+
+	httpServer := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           logging.Middleware(logger, security.Headers(security.NewCSRF().Middleware(metrics.Middleware(mux)))),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
 
 	ips := utils.GetAllLocalIPs()
 	if len(ips) == 0 {
-		fmt.Printf("Server running at: http://localhost:%s\n", port)
+		fmt.Printf("Server running at: http://localhost:%s\n", cfg.Port)
 	}
 	for _, ip := range ips {
-		fmt.Printf("Server running at: http://%s:%s\n", ip, port)
+		fmt.Printf("Server running at: http://%s:%s\n", ip, cfg.Port)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server failed", "error", err)
+			os.Exit(1)
+		}
+	case <-ctx.Done():
+		stop()
+		logger.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("graceful shutdown incomplete", "error", err)
+		_ = httpServer.Close()
 	}
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	stopCleanup()
+	<-cleanupDone
+	<-thumbsDone
+
+	if removed := store.Close(); removed > 0 {
+		logger.Info("removed partial transfers", "count", removed)
+	}
+	logger.Info("server stopped")
+}
+
+func registerGauges(store *storage.Store, registry *devices.Registry) {
+	metrics.Default.NewGaugeFunc("share_active_transfers", "Transfers currently held in storage.", func() float64 {
+		transfers, _ := store.Stats()
+		return float64(transfers)
+	})
+	metrics.Default.NewGaugeFunc("share_stored_bytes", "Bytes occupied by active transfers.", func() float64 {
+		_, bytes := store.Stats()
+		return float64(bytes)
+	})
+	metrics.Default.NewGaugeFunc("share_stored_blobs", "Distinct file contents held in storage.", func() float64 {
+		blobs, _ := store.BlobStats()
+		return float64(blobs)
+	})
+	metrics.Default.NewGaugeFunc("share_blob_references", "Files of active transfers; above share_stored_blobs when content is deduplicated.", func() float64 {
+		_, refs := store.BlobStats()
+		return float64(refs)
+	})
+	metrics.Default.NewGaugeFunc("share_registered_devices", "Devices in the registry.", func() float64 {
+		count, _ := registry.Stats()
+		return float64(count)
+	})
+	metrics.Default.NewGaugeFunc("share_pending_notifications", "Devices with an undelivered transfer notification.", func() float64 {
+		_, pending := registry.Stats()
+		return float64(pending)
+	})
+}
+
+// loadEncryptionKey returns the master key for encryption at rest, or nil
+// when it is not configured.
+func loadEncryptionKey(cfg *config.Config) ([]byte, error) {
+	switch {
+	case cfg.EncryptionKeyFile != "":
+		return utils.LoadOrCreateKey(cfg.EncryptionKeyFile, 32)
+	case cfg.EncryptionKey != "":
+		key, err := hex.DecodeString(cfg.EncryptionKey)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("SHARE_ENCRYPTION_KEY must be 64 hex characters")
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// loadScanner returns the configured malware scanner, or nil when scanning
+// is off.
+func loadScanner(cfg *config.Config) (scan.Scanner, error) {
+	switch {
+	case cfg.ClamdAddress != "":
+		network, address, err := scan.ParseClamdAddress(cfg.ClamdAddress)
+		if err != nil {
+			return nil, err
+		}
+		return &scan.Clamd{Network: network, Address: address, Timeout: cfg.ScanTimeout}, nil
+	case len(cfg.ScanCommand) > 0:
+		path, err := exec.LookPath(cfg.ScanCommand[0])
+		if err != nil {
+			return nil, err
+		}
+		return &scan.Command{Path: path, Args: cfg.ScanCommand[1:], Timeout: cfg.ScanTimeout}, nil
+	}
+	return nil, nil
 }
@@ -0,0 +1,352 @@
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"strings"
+)
+
+// escapable lists the characters a backslash turns into literal text.
+const escapable = "\\`*_{}[]()#+-.!|~<>\"'"
+
+// inline renders the inline elements of one block of text: code spans,
+// emphasis, strikethrough, links and hard line breaks. Failed searches for
+// closing delimiters are remembered, so unbalanced input stays linear.
+type inline struct {
+	src    string
+	depth  int
+	inLink bool
+
+	brackets map[int]int
+	noCloser map[string]bool
+	noTicks  map[int]bool
+}
+
+func renderInline(src string) string {
+	var b strings.Builder
+	p := &inline{src: src}
+	p.render(&b)
+	return b.String()
+}
+
+func (p *inline) nested(src string, inLink bool) *inline {
+	return &inline{src: src, depth: p.depth + 1, inLink: p.inLink || inLink}
+}
+
+func (p *inline) render(b *strings.Builder) {
+	s := p.src
+	if p.depth > maxNesting {
+		b.WriteString(html.EscapeString(s))
+		return
+	}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(escapable, s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+			continue
+		case c == '\n' && strings.HasSuffix(s[:i], "  "):
+			b.WriteString("<br>\n")
+			i++
+			continue
+		case c == '`':
+			i += p.codeSpan(b, i)
+			continue
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if n := p.link(b, i+1, true); n > 0 {
+				i += n + 1
+				continue
+			}
+		case c == '[':
+			if n := p.link(b, i, false); n > 0 {
+				i += n
+				continue
+			}
+		case c == '<':
+			if n := p.autolink(b, i); n > 0 {
+				i += n
+				continue
+			}
+		case c == '*' || c == '_' || c == '~':
+			if n := p.emphasis(b, i); n > 0 {
+				i += n
+				continue
+			}
+			// Write the whole run so its tail is not taken for an opener.
+			n := 1
+			for i+n < len(s) && s[i+n] == c {
+				n++
+			}
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+		}
+		writeEscaped(b, c)
+		i++
+	}
+}
+
+func writeEscaped(b *strings.Builder, c byte) {
+	switch c {
+	case '<':
+		b.WriteString("&lt;")
+	case '>':
+		b.WriteString("&gt;")
+	case '&':
+		b.WriteString("&amp;")
+	case '"':
+		b.WriteString("&#34;")
+	case '\'':
+		b.WriteString("&#39;")
+	default:
+		b.WriteByte(c)
+	}
+}
+
+// codeSpan renders the code span starting at i and returns its length, or
+// writes the backticks as text when the span is never closed.
+func (p *inline) codeSpan(b *strings.Builder, i int) int {
+	s := p.src
+	n := run(s, i)
+	if !p.noTicks[n] {
+		for j := i + n; j < len(s); {
+			if s[j] != '`' {
+				j++
+				continue
+			}
+			m := run(s, j)
+			if m == n {
+				code := strings.ReplaceAll(s[i+n:j], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				return j + n - i
+			}
+			j += m
+		}
+		if p.noTicks == nil {
+			p.noTicks = make(map[int]bool)
+		}
+		p.noTicks[n] = true
+	}
+	b.WriteString(s[i : i+n])
+	return n
+}
+
+func run(s string, i int) int {
+	n := 1
+	for i+n < len(s) && s[i+n] == s[i] {
+		n++
+	}
+	return n
+}
+
+// emphasis renders *em*, **strong**, ***both*** and ~~strikethrough~~
+// starting at i and returns their length, or 0 when i opens none of them.
+func (p *inline) emphasis(b *strings.Builder, i int) int {
+	s := p.src
+	c := s[i]
+	n := run(s, i)
+	if n > 3 || (c == '~' && n != 2) || i+n >= len(s) || isSpace(s[i+n]) {
+		return 0
+	}
+	// Underscores inside words, as in snake_case names, are not emphasis.
+	if c == '_' && i > 0 && isWordChar(s[i-1]) {
+		return 0
+	}
+	delim := s[i : i+n]
+	if p.noCloser[delim] {
+		return 0
+	}
+	for j := i + n + 1; j+n <= len(s); j++ {
+		if s[j] == '`' {
+			j += run(s, j) - 1
+			continue
+		}
+		if !strings.HasPrefix(s[j:], delim) || isSpace(s[j-1]) || s[j-1] == c || (j+n < len(s) && s[j+n] == c) {
+			continue
+		}
+		if c == '_' && j+n < len(s) && isWordChar(s[j+n]) {
+			continue
+		}
+		open, close := "<em>", "</em>"
+		switch {
+		case c == '~':
+			open, close = "<del>", "</del>"
+		case n == 2:
+			open, close = "<strong>", "</strong>"
+		case n == 3:
+			open, close = "<em><strong>", "</strong></em>"
+		}
+		b.WriteString(open)
+		p.nested(s[i+n:j], false).render(b)
+		b.WriteString(close)
+		return j + n - i
+	}
+	if p.noCloser == nil {
+		p.noCloser = make(map[string]bool)
+	}
+	p.noCloser[delim] = true
+	return 0
+}
+
+// closingBracket returns the position of the ] matching the [ at i, or -1.
+func (p *inline) closingBracket(i int) int {
+	if p.brackets == nil {
+		p.brackets = make(map[int]int)
+		var open []int
+		s := p.src
+		for j := 0; j < len(s); j++ {
+			switch s[j] {
+			case '\\':
+				j++
+			case '[':
+				open = append(open, j)
+			case ']':
+				if len(open) > 0 {
+					p.brackets[open[len(open)-1]] = j
+					open = open[:len(open)-1]
+				}
+			}
+		}
+	}
+	if j, ok := p.brackets[i]; ok {
+		return j
+	}
+	return -1
+}
+
+// link renders [text](url) or, for images, ![alt](url) starting with the
+// bracket at i and returns its length, or 0 when there is no link. Images
+// become links to the picture: previews do not load anything from other
+// sites.
+func (p *inline) link(b *strings.Builder, i int, image bool) int {
+	s := p.src
+	end := p.closingBracket(i)
+	if end < 0 || end+1 >= len(s) || s[end+1] != '(' {
+		return 0
+	}
+	dest, n := linkDestination(s[end+2:])
+	if n == 0 {
+		return 0
+	}
+	text := s[i+1 : end]
+	length := end + 2 + n - i
+	if p.inLink || !safeURL(dest) {
+		p.nested(text, true).render(b)
+		return length
+	}
+	b.WriteString(`<a href="` + html.EscapeString(dest) + `" rel="nofollow noopener noreferrer">`)
+	if image {
+		b.WriteString(html.EscapeString(text))
+	} else {
+		p.nested(text, true).render(b)
+	}
+	b.WriteString("</a>")
+	return length
+}
+
+// linkDestination parses `url "title")` and returns the URL and the number
+// of bytes up to and including the closing parenthesis.
+func linkDestination(s string) (string, int) {
+	i := 0
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	var dest string
+	if i < len(s) && s[i] == '<' {
+		end := strings.IndexAny(s[i:], ">\n")
+		if end < 0 || s[i+end] != '>' {
+			return "", 0
+		}
+		dest = s[i+1 : i+end]
+		i += end + 1
+	} else {
+		start, depth := i, 0
+		for ; i < len(s) && !isSpace(s[i]); i++ {
+			if s[i] == '(' {
+				// Like CommonMark, give up on deeply nested parentheses,
+				// which also keeps unclosed ones from being rescanned.
+				if depth++; depth > 32 {
+					return "", 0
+				}
+			} else if s[i] == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+		}
+		dest = s[start:i]
+	}
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+		end := strings.IndexByte(s[i+1:], s[i])
+		if end < 0 {
+			return "", 0
+		}
+		i += end + 2
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+	}
+	if i >= len(s) || s[i] != ')' {
+		return "", 0
+	}
+	return dest, i + 1
+}
+
+// autolink renders <https://example.com> and <user@example.com> starting
+// at i and returns its length, or 0 when i does not start one.
+func (p *inline) autolink(b *strings.Builder, i int) int {
+	s := p.src
+	end := strings.IndexAny(s[i+1:], "<> \n")
+	if end < 0 || s[i+1+end] != '>' {
+		return 0
+	}
+	target := s[i+1 : i+1+end]
+	href := target
+	if !strings.Contains(target, ":") && strings.Contains(target, "@") {
+		href = "mailto:" + target
+	}
+	if p.inLink || !strings.Contains(href, ":") || !safeURL(href) {
+		return 0
+	}
+	b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer">` + html.EscapeString(target) + "</a>")
+	return end + 2
+}
+
+// safeURL reports whether a link may point to dest: web and mail addresses
+// and anchors within the document, never scripts or this server's routes.
+func safeURL(dest string) bool {
+	if strings.HasPrefix(dest, "#") {
+		return true
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return true
+	}
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\t'
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
@@ -0,0 +1,340 @@
+// Package markdown renders Markdown documents to HTML for file previews.
+// All text is escaped and only a fixed set of elements is emitted, raw HTML
+// included in a document is shown as text, and links are limited to http,
+// https and mailto URLs, so the output needs no further sanitizing.
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	headingRe  = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	ruleRe     = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceRe    = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})[ \t]*([^`\\s]*)")
+	bulletRe   = regexp.MustCompile(`^( {0,3})([-*+])[ \t]+`)
+	orderedRe  = regexp.MustCompile(`^( {0,3})(\d{1,9})[.)][ \t]+`)
+	tableSepRe = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	languageRe = regexp.MustCompile(`^[A-Za-z0-9_+#.-]+$`)
+)
+
+const (
+	// maxNesting bounds the depth of nested blocks and inline elements so
+	// crafted documents cannot exhaust the stack.
+	maxNesting  = 16
+	indentWidth = 4
+)
+
+// Render converts a Markdown document to HTML.
+func Render(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\t", "    ")
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"), 0)
+	return b.String()
+}
+
+func renderBlocks(b *strings.Builder, lines []string, depth int) {
+	if depth > maxNesting {
+		writeParagraph(b, lines)
+		return
+	}
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			i++
+		case fenceRe.MatchString(line):
+			i = renderFence(b, lines, i)
+		case strings.HasPrefix(line, "    "):
+			i = renderIndentedCode(b, lines, i)
+		case headingRe.MatchString(trimmed) && indent(line) < indentWidth:
+			m := headingRe.FindStringSubmatch(trimmed)
+			level := string('0' + rune(len(m[1])))
+			b.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+			i++
+		case ruleRe.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">"):
+			i = renderQuote(b, lines, i, depth)
+		case bulletRe.MatchString(line), orderedRe.MatchString(line):
+			i = renderList(b, lines, i, depth)
+		case i+1 < len(lines) && strings.Contains(line, "|") && tableSepRe.MatchString(lines[i+1]):
+			i = renderTable(b, lines, i)
+		default:
+			i = renderParagraph(b, lines, i)
+		}
+	}
+}
+
+func indent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// startsBlock reports whether line interrupts a paragraph.
+func startsBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || fenceRe.MatchString(line) || ruleRe.MatchString(line) ||
+		(headingRe.MatchString(trimmed) && indent(line) < indentWidth) ||
+		strings.HasPrefix(trimmed, ">") || bulletRe.MatchString(line) || orderedRe.MatchString(line)
+}
+
+func renderFence(b *strings.Builder, lines []string, i int) int {
+	m := fenceRe.FindStringSubmatch(lines[i])
+	fence, lang := m[1], m[2]
+	var code []string
+	i++
+	for ; i < len(lines); i++ {
+		if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, fence[:3]) && strings.Trim(t, fence[:1]) == "" && len(t) >= len(fence) {
+			i++
+			break
+		}
+		code = append(code, lines[i])
+	}
+	writeCode(b, code, lang)
+	return i
+}
+
+func renderIndentedCode(b *strings.Builder, lines []string, i int) int {
+	var code []string
+	for ; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "    ") {
+			code = append(code, lines[i][indentWidth:])
+		} else if strings.TrimSpace(lines[i]) == "" {
+			code = append(code, "")
+		} else {
+			break
+		}
+	}
+	for len(code) > 0 && code[len(code)-1] == "" {
+		code = code[:len(code)-1]
+	}
+	writeCode(b, code, "")
+	return i
+}
+
+func writeCode(b *strings.Builder, code []string, lang string) {
+	b.WriteString("<pre><code")
+	if lang != "" && languageRe.MatchString(lang) {
+		b.WriteString(` class="language-` + html.EscapeString(lang) + `"`)
+	}
+	b.WriteString(">")
+	for _, line := range code {
+		b.WriteString(html.EscapeString(line) + "\n")
+	}
+	b.WriteString("</code></pre>\n")
+}
+
+func renderQuote(b *strings.Builder, lines []string, i, depth int) int {
+	var inner []string
+	for ; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if rest, ok := strings.CutPrefix(trimmed, ">"); ok {
+			inner = append(inner, strings.TrimPrefix(rest, " "))
+		} else if trimmed != "" && len(inner) > 0 && strings.TrimSpace(inner[len(inner)-1]) != "" && !startsBlock(lines[i]) {
+			// A lazy continuation line of the quoted paragraph.
+			inner = append(inner, trimmed)
+		} else {
+			break
+		}
+	}
+	b.WriteString("<blockquote>\n")
+	renderBlocks(b, inner, depth+1)
+	b.WriteString("</blockquote>\n")
+	return i
+}
+
+// listMarker returns the width of the list marker on line and whether the
+// list is ordered, or a width of 0 when line is not a list item.
+func listMarker(line string) (width int, ordered bool, start string) {
+	if m := bulletRe.FindStringSubmatch(line); m != nil {
+		return len(m[0]), false, ""
+	}
+	if m := orderedRe.FindStringSubmatch(line); m != nil {
+		return len(m[0]), true, m[2]
+	}
+	return 0, false, ""
+}
+
+func renderList(b *strings.Builder, lines []string, i, depth int) int {
+	_, ordered, start := listMarker(lines[i])
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	b.WriteString("<" + tag)
+	if ordered && strings.TrimLeft(start, "0") != "1" {
+		if n := strings.TrimLeft(start, "0"); n != "" {
+			b.WriteString(` start="` + n + `"`)
+		}
+	}
+	b.WriteString(">\n")
+
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		width, itemOrdered, _ := listMarker(lines[i])
+		if width == 0 || itemOrdered != ordered {
+			break
+		}
+		item := []string{lines[i][width:]}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				next := i
+				for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+					next++
+				}
+				if next == len(lines) {
+					i = next
+					break
+				}
+				// Blank lines inside an item or between items make the list
+				// loose, with its items rendered as paragraphs.
+				if indent(lines[next]) >= width {
+					item = append(item, make([]string, next-i)...)
+					loose = true
+					i = next - 1
+					continue
+				}
+				if w, o, _ := listMarker(lines[next]); w > 0 && o == ordered {
+					loose = true
+					i = next
+				}
+				break
+			}
+			if indent(line) >= width {
+				item = append(item, line[width:])
+			} else if w, _, _ := listMarker(line); w == 0 && !startsBlock(line) {
+				// A lazy continuation line of the item's paragraph.
+				item = append(item, strings.TrimSpace(line))
+			} else {
+				break
+			}
+		}
+		items = append(items, item)
+	}
+	for _, item := range items {
+		b.WriteString("<li>")
+		if loose {
+			b.WriteString("\n")
+			renderBlocks(b, item, depth+1)
+		} else {
+			renderTightItem(b, item, depth)
+		}
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// renderTightItem renders an item of a tight list, whose leading text is
+// not wrapped in a paragraph.
+func renderTightItem(b *strings.Builder, item []string, depth int) {
+	n := 0
+	for n < len(item) && !startsBlock(item[n]) {
+		n++
+	}
+	if n > 0 {
+		b.WriteString(renderInline(strings.Join(trimLines(item[:n]), "\n")))
+	}
+	if n < len(item) {
+		b.WriteString("\n")
+		renderBlocks(b, item[n:], depth+1)
+	}
+}
+
+func trimLines(lines []string) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = strings.TrimLeft(line, " ")
+	}
+	return out
+}
+
+func renderTable(b *strings.Builder, lines []string, i int) int {
+	header := splitRow(lines[i])
+	aligns := make([]string, len(header))
+	for c, cell := range splitRow(lines[i+1]) {
+		if c >= len(aligns) {
+			break
+		}
+		left, right := strings.HasPrefix(cell, ":"), strings.HasSuffix(cell, ":")
+		switch {
+		case left && right:
+			aligns[c] = "center"
+		case right:
+			aligns[c] = "right"
+		case left:
+			aligns[c] = "left"
+		}
+	}
+	b.WriteString("<table>\n<thead>\n")
+	writeRow(b, "th", header, aligns)
+	b.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && strings.TrimSpace(lines[i]) != "" && strings.Contains(lines[i], "|"); i++ {
+		writeRow(b, "td", splitRow(lines[i]), aligns)
+	}
+	b.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+func splitRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	line = strings.TrimSuffix(line, "|")
+	var cells []string
+	var cell strings.Builder
+	for j := 0; j < len(line); j++ {
+		switch {
+		case line[j] == '\\' && j+1 < len(line) && line[j+1] == '|':
+			cell.WriteByte('|')
+			j++
+		case line[j] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[j])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func writeRow(b *strings.Builder, tag string, cells, aligns []string) {
+	b.WriteString("<tr>")
+	for c, align := range aligns {
+		b.WriteString("<" + tag)
+		if align != "" {
+			b.WriteString(` style="text-align:` + align + `"`)
+		}
+		b.WriteString(">")
+		if c < len(cells) {
+			b.WriteString(renderInline(cells[c]))
+		}
+		b.WriteString("</" + tag + ">")
+	}
+	b.WriteString("</tr>\n")
+}
+
+func renderParagraph(b *strings.Builder, lines []string, i int) int {
+	start := i
+	for i++; i < len(lines) && !startsBlock(lines[i]); i++ {
+		if i+1 < len(lines) && strings.Contains(lines[i], "|") && tableSepRe.MatchString(lines[i+1]) {
+			break
+		}
+	}
+	writeParagraph(b, lines[start:i])
+	return i
+}
+
+func writeParagraph(b *strings.Builder, lines []string) {
+	text := strings.Join(trimLines(lines), "\n")
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	b.WriteString("<p>" + renderInline(strings.TrimRight(text, " \n")) + "</p>\n")
+}
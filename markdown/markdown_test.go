@@ -0,0 +1,183 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"heading", "## Title ##", "<h2>Title</h2>\n"},
+		{"paragraph", "one\ntwo", "<p>one\ntwo</p>\n"},
+		{"emphasis", "*a* **b** ***c*** ~~d~~", "<p><em>a</em> <strong>b</strong> <em><strong>c</strong></em> <del>d</del></p>\n"},
+		{"snake case", "snake_case_name", "<p>snake_case_name</p>\n"},
+		{"code span", "`<b>` and ``a`b``", "<p><code>&lt;b&gt;</code> and <code>a`b</code></p>\n"},
+		{"fence", "```go\nif a < b {}\n```", "<pre><code class=\"language-go\">if a &lt; b {}\n</code></pre>\n"},
+		{"fence language", "```\"><script>\nx\n```", "<pre><code>x\n</code></pre>\n"},
+		{"indented code", "    <tag>", "<pre><code>&lt;tag&gt;\n</code></pre>\n"},
+		{"quote", "> quoted\nlazy", "<blockquote>\n<p>quoted\nlazy</p>\n</blockquote>\n"},
+		{"list", "- a\n- b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"ordered list", "3. a\n4. b", "<ol start=\"3\">\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"rule", "***", "<hr>\n"},
+		{"table", "| a | b |\n|:--|--:|\n| 1 | 2 |", "<table>\n<thead>\n<tr><th style=\"text-align:left\">a</th><th style=\"text-align:right\">b</th></tr>\n</thead>\n<tbody>\n<tr><td style=\"text-align:left\">1</td><td style=\"text-align:right\">2</td></tr>\n</tbody>\n</table>\n"},
+		{"link", "[docs](https://example.com/a_(b) \"Title\")", "<p><a href=\"https://example.com/a_(b)\" rel=\"nofollow noopener noreferrer\">docs</a></p>\n"},
+		{"image", "![a *cat*](https://example.com/cat.png)", "<p><a href=\"https://example.com/cat.png\" rel=\"nofollow noopener noreferrer\">a *cat*</a></p>\n"},
+		{"anchor", "[up](#top)", "<p><a href=\"#top\" rel=\"nofollow noopener noreferrer\">up</a></p>\n"},
+		{"hard break", "a  \nb\\\nc", "<p>a  <br>\nb<br>\nc</p>\n"},
+		{"escapes", "\\*not em\\* & \"quotes\"", "<p>*not em* &amp; &#34;quotes&#34;</p>\n"},
+		{"crlf", "a\r\nb", "<p>a\nb</p>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.src); got != tt.want {
+				t.Errorf("Render(%q) =\n%q\nwant\n%q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		safe bool
+	}{
+		{"https://example.com/path?q=1#frag", true},
+		{"HTTP://EXAMPLE.COM", true},
+		{"mailto:someone@example.com", true},
+		{"#section", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{" javascript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{"java\nscript:alert(1)", false},
+		{"javascript&#58;alert(1)", false},
+		{"vbscript:msgbox(1)", false},
+		{"data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==", false},
+		{"data:image/svg+xml,<svg onload=alert(1)>", false},
+		{"file:///etc/passwd", false},
+		{"blob:https://example.com/id", false},
+		{"https:evil", false},
+		{"https://", false},
+		{"//evil.example/x", false},
+		{"/manage?id=1&key=2", false},
+		{"decline?id=1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := safeURL(tt.url); got != tt.safe {
+			t.Errorf("safeURL(%q) = %v, want %v", tt.url, got, tt.safe)
+		}
+	}
+}
+
+// tagRe matches the opening tags in rendered output.
+var tagRe = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9]*)([^>]*)>`)
+
+var allowedTags = map[string]bool{
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"p": true, "em": true, "strong": true, "del": true, "code": true, "pre": true,
+	"blockquote": true, "ul": true, "ol": true, "li": true, "hr": true, "br": true,
+	"table": true, "thead": true, "tbody": true, "tr": true, "th": true, "td": true, "a": true,
+}
+
+// attrRe matches the only attributes Render writes.
+var attrRe = regexp.MustCompile(`^(?: href="(?:https?://|mailto:|#)[^"<>]*" rel="nofollow noopener noreferrer"| class="language-[A-Za-z0-9_+#.-]+"| start="\d+"| style="text-align:(?:left|right|center)")?$`)
+
+// checkSafe fails when html holds anything but the elements and
+// attributes Render is meant to produce.
+func checkSafe(t *testing.T, src, html string) {
+	t.Helper()
+	for _, m := range tagRe.FindAllStringSubmatch(html, -1) {
+		if !allowedTags[m[1]] || !attrRe.MatchString(m[2]) {
+			t.Fatalf("Render(%q) produced %q", src, m[0])
+		}
+	}
+}
+
+func TestRenderUnsafeInput(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"javascript link", "[click](javascript:alert(1))", "<p>click</p>\n"},
+		{"javascript link in caps", "[click](JAVASCRIPT:alert(1))", "<p>click</p>\n"},
+		{"javascript link in brackets", "[click](<javascript:alert(1)>)", "<p>click</p>\n"},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", "<p>x</p>\n"},
+		{"data image", "![pic](data:image/svg+xml;base64,PHN2Zz4=)", "<p>pic</p>\n"},
+		{"relative link", "[manage](/manage?id=1)", "<p>manage</p>\n"},
+		{"javascript autolink", "<javascript:alert(1)>", "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+		{"data autolink", "<data:text/html,hi>", "<p>&lt;data:text/html,hi&gt;</p>\n"},
+		{"web autolink", "<https://example.com/?a=1&b=2>", "<p><a href=\"https://example.com/?a=1&amp;b=2\" rel=\"nofollow noopener noreferrer\">https://example.com/?a=1&amp;b=2</a></p>\n"},
+		{"mail autolink", "<someone@example.com>", "<p><a href=\"mailto:someone@example.com\" rel=\"nofollow noopener noreferrer\">someone@example.com</a></p>\n"},
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"event handler", "<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"html block", "<div>\n<iframe src=\"https://evil.example\"></iframe>\n</div>", "<p>&lt;div&gt;\n&lt;iframe src=&#34;https://evil.example&#34;&gt;&lt;/iframe&gt;\n&lt;/div&gt;</p>\n"},
+		{"comment", "<!-- <script> -->", "<p>&lt;!-- &lt;script&gt; --&gt;</p>\n"},
+		{"attribute breakout", "[x](https://example.com/\"onmouseover=\"alert(1))", "<p><a href=\"https://example.com/&#34;onmouseover=&#34;alert(1)\" rel=\"nofollow noopener noreferrer\">x</a></p>\n"},
+		{"link in link", "[a [b](https://b.example)](https://a.example)", "<p><a href=\"https://a.example\" rel=\"nofollow noopener noreferrer\">a b</a></p>\n"},
+		{"autolink in link", "[<https://b.example>](https://a.example)", "<p><a href=\"https://a.example\" rel=\"nofollow noopener noreferrer\">&lt;https://b.example&gt;</a></p>\n"},
+		{"html in heading", "# <b>bold</b>", "<h1>&lt;b&gt;bold&lt;/b&gt;</h1>\n"},
+		{"html in table", "| <x> |\n|---|\n| <y onclick=z> |", "<table>\n<thead>\n<tr><th>&lt;x&gt;</th></tr>\n</thead>\n<tbody>\n<tr><td>&lt;y onclick=z&gt;</td></tr>\n</tbody>\n</table>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Render(tt.src)
+			if got != tt.want {
+				t.Errorf("Render(%q) =\n%q\nwant\n%q", tt.src, got, tt.want)
+			}
+			checkSafe(t, tt.src, got)
+		})
+	}
+}
+
+func TestRenderPathologicalInput(t *testing.T) {
+	const n = 50000
+	tests := map[string]string{
+		"nested quotes":        strings.Repeat(">", n) + " deep",
+		"nested lists":         strings.Repeat("- ", n) + "deep",
+		"indented lists":       nestedLists(2000),
+		"open brackets":        strings.Repeat("[", n) + "x",
+		"nested links":         strings.Repeat("[a", n) + strings.Repeat("](https://example.com)", n),
+		"nested images":        strings.Repeat("![", n) + "x" + strings.Repeat("](https://example.com)", n),
+		"unclosed parentheses": "[x](" + strings.Repeat("(", n),
+		"nested parentheses":   "[x](https://example.com/" + strings.Repeat("(", n) + strings.Repeat(")", n) + ")",
+		"unclosed emphasis":    strings.Repeat("*a ", n),
+		"nested emphasis":      strings.Repeat("*a **b ", n/2) + strings.Repeat("** a*", n/2),
+		"underscores":          strings.Repeat("_a_", n),
+		"strikethrough":        strings.Repeat("~~", n),
+		"backtick runs":        strings.Repeat("`", n) + strings.Repeat("a`", n),
+		"unclosed backticks":   strings.Repeat("`a ``b ", n/2),
+		"unclosed autolinks":   strings.Repeat("<https://a", n),
+		"unclosed titles":      strings.Repeat("[a](b \"", n),
+		"table columns":        strings.Repeat("|a", n) + "\n" + strings.Repeat("|-", n),
+		"escapes":              strings.Repeat("\\", n) + strings.Repeat("\\[", n),
+		"quoted links":         strings.Repeat("> [a](", n),
+	}
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			got := Render(src)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("rendering %d bytes took %v", len(src), elapsed)
+			}
+			checkSafe(t, name, got)
+			if depth := strings.Count(got, "<blockquote>"); depth > maxNesting+1 {
+				t.Errorf("%d nested quotes rendered", depth)
+			}
+			if depth := strings.Count(got, "<ul>"); depth > maxNesting+1 {
+				t.Errorf("%d nested lists rendered", depth)
+			}
+		})
+	}
+}
+
+func nestedLists(depth int) string {
+	var b strings.Builder
+	for i := range depth {
+		b.WriteString(strings.Repeat("  ", i) + "- item\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default is the registry served on /metrics.
+var Default = NewRegistry()
+
+var (
+	UploadsTotal = Default.NewCounterVec("share_uploads_total",
+		"Transfers created, by category.", "category")
+	UploadedFilesTotal = Default.NewCounterVec("share_uploaded_files_total",
+		"Files stored, by transfer category.", "category")
+	DownloadsTotal = Default.NewCounterVec("share_downloads_total",
+		"Completed file downloads, by transfer category.", "category")
+	UploadedBytesTotal = Default.NewCounter("share_uploaded_bytes_total",
+		"Bytes written to storage by uploads.")
+	DownloadedBytesTotal = Default.NewCounter("share_downloaded_bytes_total",
+		"Bytes sent to receivers by downloads.")
+	PinFailuresTotal = Default.NewCounter("share_pin_failures_total",
+		"Incorrect PIN submissions.")
+	PinLockoutsTotal = Default.NewCounter("share_pin_lockouts_total",
+		"Transfers or clients locked out after repeated PIN failures.")
+	RateLimitedTotal = Default.NewCounterVec("share_rate_limited_total",
+		"Requests rejected with 429, by scope.", "scope")
+	ScannedFilesTotal = Default.NewCounterVec("share_scanned_files_total",
+		"Uploaded files checked by the malware scanner, by verdict.", "status")
+	ThumbnailsTotal = Default.NewCounterVec("share_thumbnails_total",
+		"Image thumbnails made by the preview worker, by outcome.", "status")
+	VariantsTotal = Default.NewCounterVec("share_photo_variants_total",
+		"Resized copies of photos requested for the first time, by outcome.", "status")
+	CleanupRunsTotal = Default.NewCounter("share_cleanup_runs_total",
+		"Expired transfer sweeps performed.")
+	CleanupRemovedTotal = Default.NewCounter("share_cleanup_removed_transfers_total",
+		"Transfers removed by expiry sweeps.")
+	HTTPRequestDuration = Default.NewHistogramVec("share_http_request_duration_seconds",
+		"HTTP request latency, by route.", DefBuckets, "route", "method", "code")
+)
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Middleware records request latency per route. It must wrap the
+// http.ServeMux directly so the matched pattern is available once the
+// request has been served.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		HTTPRequestDuration.Observe(time.Since(start).Seconds(), route, methodLabel(r.Method), strconv.Itoa(rec.status))
+	})
+}
+
+// methodLabel returns the method as a label value. Clients can send any
+// method, so those outside the standard set share one series.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
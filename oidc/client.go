@@ -0,0 +1,224 @@
+// Package oidc implements the OpenID Connect authorization code flow with
+// PKCE for signing in senders through an external identity provider.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginTimeout bounds how long a started login may take to complete.
+const loginTimeout = 10 * time.Minute
+
+// ErrUnknownState indicates a callback that does not belong to a login
+// started by this server, or one that already completed or expired.
+var ErrUnknownState = errors.New("unknown or expired login state")
+
+// Config holds the relying party registration.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+// Client runs logins against a single provider.
+type Client struct {
+	cfg      Config
+	provider *Provider
+
+	mu      sync.Mutex
+	pending map[string]*pendingLogin
+}
+
+type pendingLogin struct {
+	nonce       string
+	verifier    string
+	redirectURL string
+	next        string
+	expiresAt   time.Time
+}
+
+// Login is the result of a completed sign-in.
+type Login struct {
+	Claims *Claims
+	// Next is the local path the visitor asked for before signing in.
+	Next string
+}
+
+// NewClient creates a client for cfg. The provider is contacted on the
+// first login.
+func NewClient(cfg Config) *Client {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid"}
+	}
+	return &Client{
+		cfg:      cfg,
+		provider: NewProvider(cfg.Issuer, nil),
+		pending:  make(map[string]*pendingLogin),
+	}
+}
+
+// Begin starts a login and returns the provider URL to send the browser to
+// together with the state value that identifies the login.
+func (c *Client) Begin(ctx context.Context, redirectURL, next string) (authURL, state string, err error) {
+	meta, err := c.provider.Metadata(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state = randomString()
+	login := &pendingLogin{
+		nonce:       randomString(),
+		verifier:    randomString(),
+		redirectURL: redirectURL,
+		next:        next,
+		expiresAt:   time.Now().Add(loginTimeout),
+	}
+	challenge := sha256.Sum256([]byte(login.verifier))
+
+	scopes := c.cfg.Scopes
+	if !contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.cfg.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	c.mu.Lock()
+	c.pruneLocked(time.Now())
+	c.pending[state] = login
+	c.mu.Unlock()
+
+	return meta.AuthorizationEndpoint + sep + params.Encode(), state, nil
+}
+
+// Finish completes the login identified by state: it redeems code at the
+// token endpoint and validates the returned ID token. Each state can be
+// used once.
+func (c *Client) Finish(ctx context.Context, state, code string) (*Login, error) {
+	now := time.Now()
+	c.mu.Lock()
+	login, ok := c.pending[state]
+	delete(c.pending, state)
+	c.pruneLocked(now)
+	c.mu.Unlock()
+	if !ok || now.After(login.expiresAt) {
+		return nil, ErrUnknownState
+	}
+	if code == "" {
+		return nil, errors.New("oidc: missing authorization code")
+	}
+
+	rawIDToken, err := c.exchange(ctx, code, login)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := c.provider.VerifyIDToken(ctx, rawIDToken, c.cfg.ClientID, login.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &Login{Claims: claims, Next: login.next}, nil
+}
+
+// pruneLocked forgets logins that were started but never completed. It
+// runs on both ends of a login so abandoned ones do not pile up while
+// nobody starts new logins.
+func (c *Client) pruneLocked(now time.Time) {
+	for key, p := range c.pending {
+		if now.After(p.expiresAt) {
+			delete(c.pending, key)
+		}
+	}
+}
+
+func (c *Client) exchange(ctx context.Context, code string, login *pendingLogin) (string, error) {
+	meta, err := c.provider.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {login.redirectURL},
+		"client_id":     {c.cfg.ClientID},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	}
+	resp, err := c.provider.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("oidc token exchange: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return "", fmt.Errorf("oidc token exchange: %s %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("oidc token exchange: response has no id_token")
+	}
+	return token.IDToken, nil
+}
+
+// Issuer returns the configured issuer URL.
+func (c *Client) Issuer() string {
+	return c.provider.issuer
+}
+
+func randomString() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "share-test"
+
+// mockProvider serves discovery, a key set and a token endpoint that
+// answers every code with the ID token made by token.
+type mockProvider struct {
+	srv   *httptest.Server
+	rsa   *rsa.PrivateKey
+	ec    *ecdsa.PrivateKey
+	mu    sync.Mutex
+	token func(nonce string) string
+	nonce string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{rsa: rsaKey, ec: ecKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, Metadata{
+			Issuer:                m.srv.URL,
+			AuthorizationEndpoint: m.srv.URL + "/authorize",
+			TokenEndpoint:         m.srv.URL + "/token",
+			JWKSURI:               m.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []jsonWebKey{
+			{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X.FillBytes(make([]byte, 32))), Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{Kty: "RSA", Kid: "enc", Use: "enc", N: b64(rsaKey.N.Bytes()), E: "AQAB"},
+		}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "authorization_code" || r.FormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_request"})
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		writeJSON(w, map[string]string{"id_token": m.token(m.nonce)})
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// claims returns valid claims for a token issued now.
+func (m *mockProvider) claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":   m.srv.URL,
+		"sub":   "user-1",
+		"aud":   testClientID,
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": nonce,
+		"email": "user@example.com",
+	}
+}
+
+// sign serializes a token with the given header and claims, signed by the
+// key alg names.
+func (m *mockProvider) sign(t *testing.T, header, claims map[string]any) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	var err error
+	switch header["alg"] {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, m.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, m.rsa, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, m.ec, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "HS256":
+		// Signed with the public modulus, as in key confusion attacks.
+		mac := hmac.New(sha256.New, m.rsa.N.Bytes())
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + b64(sig)
+}
+
+// login runs a login whose token endpoint answers with token.
+func (m *mockProvider) login(t *testing.T, token func(nonce string) string) (*Login, error) {
+	t.Helper()
+	c := NewClient(Config{Issuer: m.srv.URL, ClientID: testClientID})
+	authURL, state, err := c.Begin(context.Background(), "https://share.example/auth/callback", "/send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.nonce = u.Query().Get("nonce")
+	m.token = token
+	m.mu.Unlock()
+	return c.Finish(context.Background(), state, "code")
+}
+
+func TestLoginAcceptsValidTokens(t *testing.T) {
+	m := newMockProvider(t)
+	for _, header := range []map[string]any{
+		{"alg": "RS256", "kid": "rsa"},
+		{"alg": "PS256", "kid": "rsa"},
+		{"alg": "ES256", "kid": "ec"},
+	} {
+		login, err := m.login(t, func(nonce string) string {
+			return m.sign(t, header, m.claims(nonce))
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", header["alg"], err)
+		}
+		if login.Claims.Subject != "user-1" || login.Claims.DisplayName() != "user@example.com" || login.Next != "/send" {
+			t.Errorf("%v: login = %+v, claims %+v", header["alg"], login, login.Claims)
+		}
+	}
+}
+
+func TestLoginRejectsInvalidTokens(t *testing.T) {
+	m := newMockProvider(t)
+	rsaHeader := map[string]any{"alg": "RS256", "kid": "rsa"}
+	tests := []struct {
+		name   string
+		header map[string]any
+		claims func(map[string]any)
+		token  func(valid string) string
+		// keyErr marks tokens rejected for their key id rather than as
+		// invalid tokens.
+		keyErr bool
+	}{
+		{name: "hmac alg", header: map[string]any{"alg": "HS256", "kid": "rsa"}},
+		{name: "none alg", token: func(valid string) string {
+			h, _ := json.Marshal(map[string]any{"alg": "none", "kid": "rsa"})
+			_, rest, _ := strings.Cut(valid, ".")
+			payload, _, _ := strings.Cut(rest, ".")
+			return b64(h) + "." + payload + "."
+		}},
+		{name: "alg for another key type", header: map[string]any{"alg": "ES256", "kid": "rsa"}},
+		{name: "unknown kid", header: map[string]any{"alg": "RS256", "kid": "other"}, keyErr: true},
+		{name: "encryption key", header: map[string]any{"alg": "RS256", "kid": "enc"}, keyErr: true},
+		{name: "tampered claims", token: func(valid string) string {
+			header, rest, _ := strings.Cut(valid, ".")
+			_, sig, _ := strings.Cut(rest, ".")
+			c, _ := json.Marshal(map[string]any{"iss": m.srv.URL, "sub": "admin", "aud": testClientID, "exp": time.Now().Add(time.Hour).Unix()})
+			return header + "." + b64(c) + "." + sig
+		}},
+		{name: "wrong issuer", claims: func(c map[string]any) { c["iss"] = "https://evil.example" }},
+		{name: "wrong audience", claims: func(c map[string]any) { c["aud"] = "another-client" }},
+		{name: "foreign authorized party", claims: func(c map[string]any) {
+			c["aud"] = []string{testClientID, "another-client"}
+			c["azp"] = "another-client"
+		}},
+		{name: "wrong nonce", claims: func(c map[string]any) { c["nonce"] = "replayed" }},
+		{name: "missing nonce", claims: func(c map[string]any) { delete(c, "nonce") }},
+		{name: "missing subject", claims: func(c map[string]any) { delete(c, "sub") }},
+		{name: "expired", claims: func(c map[string]any) { c["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix() }},
+		{name: "missing expiry", claims: func(c map[string]any) { delete(c, "exp") }},
+		{name: "issued in the future", claims: func(c map[string]any) { c["iat"] = time.Now().Add(clockSkew + time.Hour).Unix() }},
+		{name: "malformed", token: func(string) string { return "not.a-token" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.login(t, func(nonce string) string {
+				header := tt.header
+				if header == nil {
+					header = rsaHeader
+				}
+				claims := m.claims(nonce)
+				if tt.claims != nil {
+					tt.claims(claims)
+				}
+				token := m.sign(t, header, claims)
+				if tt.token != nil {
+					token = tt.token(token)
+				}
+				return token
+			})
+			switch {
+			case err == nil:
+				t.Fatal("login succeeded")
+			case tt.keyErr && !strings.Contains(err.Error(), "unknown signing key"):
+				t.Fatalf("err = %v, want an unknown signing key", err)
+			case !tt.keyErr && !errors.Is(err, ErrInvalidToken):
+				t.Fatalf("err = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestFinishUsesStateOnce(t *testing.T) {
+	m := newMockProvider(t)
+	c := NewClient(Config{Issuer: m.srv.URL, ClientID: testClientID})
+	_, state, err := c.Begin(context.Background(), "https://share.example/auth/callback", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.token = func(string) string { return "" }
+	if _, err := c.Finish(context.Background(), state, "code"); errors.Is(err, ErrUnknownState) {
+		t.Fatalf("first callback: %v", err)
+	}
+	if _, err := c.Finish(context.Background(), state, "code"); !errors.Is(err, ErrUnknownState) {
+		t.Fatalf("second callback: err = %v, want ErrUnknownState", err)
+	}
+}
+
+func TestFinishPrunesExpiredLogins(t *testing.T) {
+	c := NewClient(Config{Issuer: "https://idp.example", ClientID: testClientID})
+	c.pending["old"] = &pendingLogin{expiresAt: time.Now().Add(-time.Second)}
+	c.pending["current"] = &pendingLogin{expiresAt: time.Now().Add(loginTimeout)}
+	if _, err := c.Finish(context.Background(), "unknown", "code"); !errors.Is(err, ErrUnknownState) {
+		t.Fatalf("err = %v, want ErrUnknownState", err)
+	}
+	if _, ok := c.pending["old"]; ok {
+		t.Error("expired login kept after a callback")
+	}
+	if _, ok := c.pending["current"]; !ok {
+		t.Error("login in progress pruned")
+	}
+	if _, err := c.Finish(context.Background(), "old", "code"); !errors.Is(err, ErrUnknownState) {
+		t.Fatalf("expired state: err = %v, want ErrUnknownState", err)
+	}
+}
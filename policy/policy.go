@@ -0,0 +1,252 @@
+// Package policy decides which files an instance accepts, based on rules
+// about their extension, detected type, size and transfer category.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"share/config"
+)
+
+// Actions a rule or the default can take.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Policy is an ordered list of rules. The first rule matching a file
+// decides; files no rule matches get the default action.
+type Policy struct {
+	Default string `json:"default"`
+	// AllowEncrypted controls whether end-to-end encrypted uploads are
+	// accepted. Only size and category rules can be applied to them, so
+	// instances that must keep file types out should turn it off.
+	AllowEncrypted *bool  `json:"allowEncrypted"`
+	Rules          []Rule `json:"rules"`
+}
+
+// Rule matches files that meet all of its conditions; empty conditions
+// match everything.
+type Rule struct {
+	Action string `json:"action"`
+	// Extensions are matched case-insensitively, with or without the dot.
+	Extensions []string `json:"extensions"`
+	// MIME lists detected types such as "application/pdf" or "video/*".
+	MIME       []string `json:"mime"`
+	Categories []string `json:"categories"`
+	// MinSize and MaxSize bound the file size, e.g. "100MB".
+	MinSize Size `json:"minSize"`
+	MaxSize Size `json:"maxSize"`
+	// Message is shown to the sender when the rule denies a file.
+	Message string `json:"message"`
+}
+
+// Size is a byte count written as a number or with a unit like "25MB".
+type Size int64
+
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return errors.New("size must be a number or a string like \"25MB\"")
+	}
+	n, err := config.ParseBytes(text)
+	if err != nil {
+		return err
+	}
+	*s = Size(n)
+	return nil
+}
+
+// File describes an uploaded file. Name and MIME are empty for end-to-end
+// encrypted files.
+type File struct {
+	Name     string
+	MIME     string
+	Size     int64
+	Category string
+}
+
+// Load reads a policy from a JSON file.
+func Load(path string) (*Policy, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = Allow
+	}
+	if p.Default != Allow && p.Default != Deny {
+		return nil, fmt.Errorf("default: unknown action %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		if rule.Action != Allow && rule.Action != Deny {
+			return nil, fmt.Errorf("rule %d: unknown action %q", i+1, rule.Action)
+		}
+		if rule.MaxSize > 0 && rule.MinSize > rule.MaxSize {
+			return nil, fmt.Errorf("rule %d: minSize is above maxSize", i+1)
+		}
+	}
+	return &p, nil
+}
+
+// EncryptedAllowed reports whether end-to-end encrypted uploads may be
+// stored.
+func (p *Policy) EncryptedAllowed() bool {
+	return p.AllowEncrypted == nil || *p.AllowEncrypted
+}
+
+// Check returns nil when f is allowed, or an error explaining to the
+// sender why it is not.
+func (p *Policy) Check(f File) error {
+	for _, rule := range p.Rules {
+		if rule.matches(f) {
+			return rule.verdict(f)
+		}
+	}
+	return p.defaultVerdict()
+}
+
+// CheckName returns an error when f is refused whatever its contents turn
+// out to be, judging only by its name and category, so a file can be turned
+// away before it is stored. It returns nil as soon as a rule about the
+// detected type or size might decide; Check has the final word.
+func (p *Policy) CheckName(f File) error {
+	for _, rule := range p.Rules {
+		if !rule.matchesName(f) {
+			continue
+		}
+		if len(rule.MIME) > 0 || rule.MinSize > 0 || rule.MaxSize > 0 {
+			return nil
+		}
+		return rule.verdict(f)
+	}
+	return p.defaultVerdict()
+}
+
+func (p *Policy) defaultVerdict() error {
+	if p.Default == Deny {
+		return errors.New("this type of file is not accepted")
+	}
+	return nil
+}
+
+// verdict applies the rule's action to a file it matches.
+func (r *Rule) verdict(f File) error {
+	if r.Action == Allow {
+		return nil
+	}
+	if r.Message != "" {
+		return errors.New(r.Message)
+	}
+	return errors.New(r.describe(f))
+}
+
+func (r *Rule) matches(f File) bool {
+	if !r.matchesName(f) {
+		return false
+	}
+	if len(r.MIME) > 0 && !matchMIME(r.MIME, f.MIME) {
+		return false
+	}
+	if r.MinSize > 0 && f.Size < int64(r.MinSize) {
+		return false
+	}
+	if r.MaxSize > 0 && f.Size > int64(r.MaxSize) {
+		return false
+	}
+	return true
+}
+
+// matchesName reports whether f meets the rule's extension and category
+// conditions.
+func (r *Rule) matchesName(f File) bool {
+	if len(r.Extensions) > 0 && !matchExtension(r.Extensions, f.Name) {
+		return false
+	}
+	return len(r.Categories) == 0 || contains(r.Categories, f.Category)
+}
+
+// describe explains why a rule without a message of its own denied f.
+func (r *Rule) describe(f File) string {
+	switch {
+	case len(r.Extensions) > 0:
+		return fmt.Sprintf("%s files are not accepted", strings.ToLower(filepath.Ext(f.Name)))
+	case len(r.MIME) > 0:
+		mediaType, _, _ := mime.ParseMediaType(f.MIME)
+		return fmt.Sprintf("files of type %s are not accepted", mediaType)
+	case r.MinSize > 0:
+		return fmt.Sprintf("files of %s or more are not accepted", formatSize(int64(r.MinSize)))
+	case len(r.Categories) > 0:
+		return fmt.Sprintf("%s transfers are not accepted", strings.Join(r.Categories, ", "))
+	}
+	return "this file is not accepted"
+}
+
+func matchExtension(extensions []string, name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return false
+	}
+	for _, want := range extensions {
+		if strings.ToLower("."+strings.TrimPrefix(want, ".")) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMIME(patterns []string, mimeType string) bool {
+	if mimeType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = strings.ToLower(mimeType)
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType || pattern == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%d GB", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%d MB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%d KB", n>>10)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
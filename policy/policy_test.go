@@ -0,0 +1,151 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testPolicy() *Policy {
+	return &Policy{
+		Default: Allow,
+		Rules: []Rule{
+			{Action: Allow, Extensions: []string{"exe"}, Categories: []string{"software"}},
+			{Action: Deny, Extensions: []string{".exe", "BAT"}},
+			{Action: Deny, MIME: []string{"video/*"}, Categories: []string{"photos"}, Message: "no videos in photo transfers"},
+			{Action: Deny, MinSize: 100 << 20},
+			{Action: Deny, Categories: []string{"archives"}},
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		file File
+		want string
+	}{
+		{"allowed by default", File{Name: "notes.txt", MIME: "text/plain", Size: 10, Category: "files"}, ""},
+		{"earlier rule allows", File{Name: "setup.exe", Size: 10, Category: "software"}, ""},
+		{"extension", File{Name: "setup.EXE", Size: 10, Category: "files"}, ".exe files are not accepted"},
+		{"extension without dot in rule", File{Name: "run.bat", Size: 10}, ".bat files are not accepted"},
+		{"no extension", File{Name: "exe", Size: 10}, ""},
+		{"mime wildcard and category", File{Name: "a.mov", MIME: "video/quicktime", Size: 10, Category: "Photos"}, "no videos in photo transfers"},
+		{"mime in other category", File{Name: "a.mov", MIME: "video/quicktime", Size: 10, Category: "videos"}, ""},
+		{"min size", File{Name: "big.iso", Size: 100 << 20}, "files of 100 MB or more are not accepted"},
+		{"below min size", File{Name: "big.iso", Size: 100<<20 - 1}, ""},
+		{"category", File{Name: "a.zip", Size: 10, Category: "archives"}, "archives transfers are not accepted"},
+		{"encrypted", File{Size: 10, Category: "files"}, ""},
+	}
+	p := testPolicy()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.file)
+			if got := errorText(err); got != tt.want {
+				t.Fatalf("Check = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDefaultDeny(t *testing.T) {
+	p := &Policy{Default: Deny, Rules: []Rule{{Action: Allow, MIME: []string{"image/*"}, MaxSize: 1 << 20}}}
+	if err := p.Check(File{Name: "a.png", MIME: "image/png", Size: 10}); err != nil {
+		t.Fatalf("Check = %v, want allowed", err)
+	}
+	for _, f := range []File{
+		{Name: "a.png", MIME: "image/png", Size: 2 << 20},
+		{Name: "a.pdf", MIME: "application/pdf", Size: 10},
+	} {
+		if err := p.Check(f); errorText(err) != "this type of file is not accepted" {
+			t.Fatalf("Check(%+v) = %v, want the default refusal", f, err)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+		file   File
+		want   string
+	}{
+		{"extension", testPolicy(), File{Name: "setup.exe", Category: "files"}, ".exe files are not accepted"},
+		{"earlier rule allows", testPolicy(), File{Name: "setup.exe", Category: "software"}, ""},
+		{"category", testPolicy(), File{Name: "a.zip", Category: "archives"}, ""},
+		{"category only", &Policy{Default: Allow, Rules: []Rule{{Action: Deny, Categories: []string{"archives"}}}}, File{Name: "a.zip", Category: "archives"}, "archives transfers are not accepted"},
+		{"mime rule decides later", testPolicy(), File{Name: "a.mov", Category: "photos"}, ""},
+		{"size rule decides later", &Policy{Default: Allow, Rules: []Rule{{Action: Deny, MaxSize: 1 << 20}, {Action: Deny, Extensions: []string{"exe"}}}}, File{Name: "setup.exe"}, ""},
+		{"default deny", &Policy{Default: Deny, Rules: []Rule{{Action: Allow, Extensions: []string{"png"}, MaxSize: 1 << 20}}}, File{Name: "a.pdf"}, "this type of file is not accepted"},
+		{"default deny after possible match", &Policy{Default: Deny, Rules: []Rule{{Action: Allow, Extensions: []string{"png"}, MaxSize: 1 << 20}}}, File{Name: "a.png"}, ""},
+		{"encrypted", testPolicy(), File{Category: "files"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorText(tt.policy.CheckName(tt.file)); got != tt.want {
+				t.Fatalf("CheckName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{"empty", `{}`, ""},
+		{"sizes", `{"default": "deny", "rules": [{"action": "allow", "minSize": 1024, "maxSize": "25MB"}]}`, ""},
+		{"unknown default", `{"default": "maybe"}`, `default: unknown action "maybe"`},
+		{"unknown action", `{"rules": [{"action": "allow"}, {"action": "block"}]}`, `rule 2: unknown action "block"`},
+		{"min above max", `{"rules": [{"action": "deny", "minSize": "2MB", "maxSize": "1MB"}]}`, "rule 1: minSize is above maxSize"},
+		{"bad size", `{"rules": [{"action": "deny", "maxSize": true}]}`, "size must be a number"},
+		{"not json", `rules`, "invalid character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Load(writePolicy(t, tt.json))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Default != Allow && p.Default != Deny {
+				t.Fatalf("Default = %q", p.Default)
+			}
+		})
+	}
+
+	p, err := Load(writePolicy(t, `{"rules": [{"action": "deny", "maxSize": "25MB"}], "allowEncrypted": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Default != Allow || p.Rules[0].MaxSize != 25<<20 || p.EncryptedAllowed() {
+		t.Fatalf("Load = %+v", p)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Fatalf("Load of a missing file = %v", err)
+	}
+}
+
+func writePolicy(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
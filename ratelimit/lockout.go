@@ -0,0 +1,191 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// LockoutPolicy controls how failed attempts are throttled.
+type LockoutPolicy struct {
+	// FreeAttempts is the number of failures allowed before backoff starts.
+	FreeAttempts int
+	// BaseDelay is the wait imposed after the first failure past FreeAttempts;
+	// it doubles with every further failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxFailures locks the key for LockoutDuration once reached.
+	MaxFailures     int
+	LockoutDuration time.Duration
+}
+
+// DefaultLockoutPolicy suits short numeric PINs.
+var DefaultLockoutPolicy = LockoutPolicy{
+	FreeAttempts:    3,
+	BaseDelay:       2 * time.Second,
+	MaxDelay:        2 * time.Minute,
+	MaxFailures:     10,
+	LockoutDuration: 30 * time.Minute,
+}
+
+// AttemptState describes the failures recorded for a key.
+type AttemptState struct {
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+	LockedOut    bool
+}
+
+// Lockout tracks failed attempts per key and applies exponential backoff
+// followed by a hard lockout.
+type Lockout struct {
+	mu        sync.Mutex
+	policy    LockoutPolicy
+	states    map[string]*AttemptState
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// NewLockout creates a tracker using policy.
+func NewLockout(policy LockoutPolicy) *Lockout {
+	return &Lockout{
+		policy: policy,
+		states: make(map[string]*AttemptState),
+		now:    time.Now,
+	}
+}
+
+// Check returns how long key must wait before its next attempt, or zero if
+// an attempt is allowed now.
+func (l *Lockout) Check(key string) time.Duration {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+	state, ok := l.states[key]
+	if !ok || !now.Before(state.BlockedUntil) {
+		return 0
+	}
+	return state.BlockedUntil.Sub(now)
+}
+
+// Attempt starts an attempt for all keys at once. When any of them must
+// still wait it returns the longest wait and records nothing. Otherwise the
+// attempt is counted as a failure right away, before the slow credential
+// check, so parallel guesses cannot all pass the check before any failure
+// is recorded; lockedOut reports whether it locked any key out. Call Reset
+// or Forgive for the keys when the attempt succeeds.
+func (l *Lockout) Attempt(keys ...string) (wait time.Duration, lockedOut bool) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+	for _, key := range keys {
+		if state, ok := l.states[key]; ok && now.Before(state.BlockedUntil) {
+			wait = max(wait, state.BlockedUntil.Sub(now))
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, key := range keys {
+		if l.failLocked(key, now).LockedOut {
+			lockedOut = true
+		}
+	}
+	return 0, lockedOut
+}
+
+// Fail records a failed attempt for key and returns the resulting state.
+func (l *Lockout) Fail(key string) AttemptState {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failLocked(key, now)
+}
+
+func (l *Lockout) failLocked(key string, now time.Time) AttemptState {
+	state, ok := l.states[key]
+	if !ok {
+		state = &AttemptState{}
+		l.states[key] = state
+	}
+	state.Failures++
+	state.LastFailure = now
+	l.blockLocked(state)
+	return *state
+}
+
+// blockLocked sets how long state is blocked after its last failure.
+func (l *Lockout) blockLocked(state *AttemptState) {
+	state.LockedOut = false
+	state.BlockedUntil = time.Time{}
+	switch over := state.Failures - l.policy.FreeAttempts; {
+	case l.policy.MaxFailures > 0 && state.Failures >= l.policy.MaxFailures:
+		state.LockedOut = true
+		state.BlockedUntil = state.LastFailure.Add(l.policy.LockoutDuration)
+	case over > 0:
+		delay := l.policy.BaseDelay << (over - 1)
+		if delay <= 0 || (l.policy.MaxDelay > 0 && delay > l.policy.MaxDelay) {
+			delay = l.policy.MaxDelay
+		}
+		state.BlockedUntil = state.LastFailure.Add(delay)
+	}
+}
+
+// Forgive takes back the failure Attempt counted for each key, for an
+// attempt that succeeded. Unlike Reset it keeps earlier failures, which
+// expire on their own.
+func (l *Lockout) Forgive(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		state, ok := l.states[key]
+		if !ok {
+			continue
+		}
+		if state.Failures--; state.Failures <= 0 {
+			delete(l.states, key)
+			continue
+		}
+		l.blockLocked(state)
+	}
+}
+
+// Reset forgets all failures recorded for the keys.
+func (l *Lockout) Reset(keys ...string) {
+	l.mu.Lock()
+	for _, key := range keys {
+		delete(l.states, key)
+	}
+	l.mu.Unlock()
+}
+
+// State returns the failures recorded for key.
+func (l *Lockout) State(key string) AttemptState {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, ok := l.states[key]
+	if !ok {
+		return AttemptState{}
+	}
+	out := *state
+	if !now.Before(out.BlockedUntil) {
+		out.LockedOut = false
+	}
+	return out
+}
+
+// pruneLocked drops keys whose block has expired and whose last failure is
+// older than the lockout duration.
+func (l *Lockout) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, state := range l.states {
+		if now.After(state.BlockedUntil) && now.Sub(state.LastFailure) > l.policy.LockoutDuration {
+			delete(l.states, key)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutForgiveKeepsEarlierFailures(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	l := NewLockout(DefaultLockoutPolicy)
+	l.now = func() time.Time { return now }
+
+	// Guesses on another transfer, each waited out.
+	for range DefaultLockoutPolicy.MaxFailures - 1 {
+		if wait, _ := l.Attempt("transfer:target", "ip:a"); wait > 0 {
+			t.Fatalf("attempt refused after waiting")
+		}
+		now = now.Add(DefaultLockoutPolicy.MaxDelay)
+	}
+	// Unlocking a transfer of its own gives the client this attempt back,
+	// not the earlier failures.
+	if wait, _ := l.Attempt("transfer:own", "ip:a"); wait > 0 {
+		t.Fatal("attempt refused")
+	}
+	l.Reset("transfer:own")
+	l.Forgive("ip:a")
+	if got := l.State("ip:a").Failures; got != DefaultLockoutPolicy.MaxFailures-1 {
+		t.Fatalf("failures after a success = %d, want %d", got, DefaultLockoutPolicy.MaxFailures-1)
+	}
+	now = now.Add(DefaultLockoutPolicy.MaxDelay)
+	if _, lockedOut := l.Attempt("transfer:target", "ip:a"); !lockedOut {
+		t.Fatal("next guess did not lock the client out")
+	}
+	if wait := l.Check("ip:a"); wait != DefaultLockoutPolicy.LockoutDuration {
+		t.Fatalf("wait = %v, want %v", wait, DefaultLockoutPolicy.LockoutDuration)
+	}
+
+	// A client without earlier failures is not slowed down by successes.
+	for range 2 * DefaultLockoutPolicy.MaxFailures {
+		if wait, _ := l.Attempt("transfer:other", "ip:b"); wait > 0 {
+			t.Fatalf("successful attempts slowed the client down: %v", wait)
+		}
+		l.Reset("transfer:other")
+		l.Forgive("ip:b")
+	}
+	if got := l.State("ip:b").Failures; got != 0 {
+		t.Fatalf("failures after successes = %d", got)
+	}
+}
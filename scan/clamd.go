@@ -0,0 +1,127 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks streamed to clamd. It must stay
+// below clamd's StreamMaxLength, which applies to the whole stream anyway.
+const clamdChunkSize = 64 << 10
+
+// Clamd scans files with a clamd daemon using the INSTREAM command.
+type Clamd struct {
+	// Network is "tcp" or "unix" and Address the daemon's host:port or
+	// socket path.
+	Network string
+	Address string
+	// Timeout bounds a whole scan, including streaming the file.
+	Timeout time.Duration
+}
+
+// ParseClamdAddress accepts "tcp://host:port", "unix:///path/clamd.sock",
+// a bare host:port or an absolute socket path.
+func ParseClamdAddress(addr string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", strings.TrimPrefix(addr, "tcp://"), nil
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix", strings.TrimPrefix(addr, "unix://"), nil
+	case strings.HasPrefix(addr, "/"):
+		return "unix", addr, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("clamd address %q: want host:port or a socket path", addr)
+	}
+	return "tcp", addr, nil
+}
+
+// Scan streams r to clamd and parses its verdict.
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// clamd closes the connection early when the stream exceeds its size
+	// limit, so a failed write is followed by reading the reason.
+	writeErr := stream(conn, r)
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if writeErr != nil {
+			return Result{}, fmt.Errorf("streaming to clamd: %w", writeErr)
+		}
+		return Result{}, fmt.Errorf("reading clamd reply: %w", err)
+	}
+	return parseClamdReply(reply)
+}
+
+func stream(conn net.Conn, r io.Reader) error {
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply understands "stream: OK", "stream: <name> FOUND" and
+// "<reason> ERROR".
+func parseClamdReply(reply string) (Result, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	verdict := reply
+	if _, rest, found := strings.Cut(reply, ": "); found {
+		verdict = rest
+	}
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	case strings.HasSuffix(verdict, " ERROR"):
+		return Result{}, errors.New("clamd: " + strings.TrimSuffix(verdict, " ERROR"))
+	}
+	return Result{}, fmt.Errorf("clamd: unexpected reply %q", truncate(reply))
+}
+
+func truncate(s string) string {
+	if b := []byte(s); len(b) > 120 {
+		return string(bytes.ToValidUTF8(b[:120], nil)) + "…"
+	}
+	return s
+}
@@ -0,0 +1,211 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubClamd accepts INSTREAM sessions like clamd and answers each with
+// reply(received), where received is the reassembled stream. With a
+// limit, it stops reading once more than limit bytes arrived and answers
+// the way clamd does when StreamMaxLength is exceeded.
+type stubClamd struct {
+	ln       net.Listener
+	reply    func(received []byte) string
+	limit    int
+	received chan []byte
+}
+
+func newStubClamd(t *testing.T, network string, reply func([]byte) string) *stubClamd {
+	t.Helper()
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "clamd.sock")
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubClamd{ln: ln, reply: reply, received: make(chan []byte, 1)}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *stubClamd) scanner() *Clamd {
+	return &Clamd{Network: s.ln.Addr().Network(), Address: s.ln.Addr().String(), Timeout: 5 * time.Second}
+}
+
+func (s *stubClamd) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *stubClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil || command != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+	var data []byte
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			break
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+		if s.limit > 0 && len(data) > s.limit {
+			// Like clamd, answer and hang up without reading the rest.
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+			return
+		}
+	}
+	s.received <- data
+	io.WriteString(conn, s.reply(data)+"\x00")
+}
+
+func TestClamdVerdicts(t *testing.T) {
+	eicar := []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	reply := func(data []byte) string {
+		switch {
+		case bytes.Contains(data, eicar):
+			return "stream: Eicar-Signature FOUND"
+		case bytes.HasPrefix(data, []byte("broken")):
+			return "stream: Can't allocate memory ERROR"
+		case bytes.HasPrefix(data, []byte("garbage")):
+			return "what?"
+		}
+		return "stream: OK"
+	}
+	for _, network := range []string{"tcp", "unix"} {
+		stub := newStubClamd(t, network, reply)
+		clamd := stub.scanner()
+
+		// Larger than a chunk, so the stream is split and must be put back
+		// together in order.
+		clean := bytes.Repeat([]byte("0123456789abcdef"), clamdChunkSize/8+3)
+		res, err := clamd.Scan(context.Background(), bytes.NewReader(clean))
+		if err != nil || res.Infected {
+			t.Fatalf("%s clean: %+v, %v", network, res, err)
+		}
+		if got := <-stub.received; !bytes.Equal(got, clean) {
+			t.Fatalf("%s: clamd received %d bytes, want the %d sent", network, len(got), len(clean))
+		}
+
+		res, err = clamd.Scan(context.Background(), bytes.NewReader(append(bytes.Repeat([]byte{0}, clamdChunkSize-10), eicar...)))
+		<-stub.received
+		if err != nil || !res.Infected || res.Signature != "Eicar-Signature" {
+			t.Fatalf("%s infected: %+v, %v", network, res, err)
+		}
+
+		_, err = clamd.Scan(context.Background(), strings.NewReader("broken file"))
+		<-stub.received
+		if err == nil || !strings.Contains(err.Error(), "Can't allocate memory") {
+			t.Fatalf("%s error reply: err = %v", network, err)
+		}
+
+		_, err = clamd.Scan(context.Background(), strings.NewReader("garbage"))
+		<-stub.received
+		if err == nil || !strings.Contains(err.Error(), "unexpected reply") {
+			t.Fatalf("%s unexpected reply: err = %v", network, err)
+		}
+
+		res, err = clamd.Scan(context.Background(), strings.NewReader(""))
+		if got := <-stub.received; err != nil || res.Infected || len(got) != 0 {
+			t.Fatalf("%s empty: %+v, %v, %d bytes", network, res, err, len(got))
+		}
+	}
+}
+
+func TestClamdSizeLimit(t *testing.T) {
+	stub := newStubClamd(t, "tcp", func([]byte) string { return "stream: OK" })
+	stub.limit = 100 << 10
+	res, err := stub.scanner().Scan(context.Background(), bytes.NewReader(make([]byte, 1<<20)))
+	if err == nil || res.Infected {
+		t.Fatalf("Scan = %+v, %v; want an error", res, err)
+	}
+	if !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Fatalf("err = %v, want the size limit reason", err)
+	}
+}
+
+func TestClamdUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	clamd := &Clamd{Network: "tcp", Address: addr, Timeout: time.Second}
+	if _, err := clamd.Scan(context.Background(), strings.NewReader("data")); err == nil {
+		t.Fatal("scan against a closed port succeeded")
+	}
+}
+
+func TestClamdTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// A daemon that accepts but never answers.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	clamd := &Clamd{Network: "tcp", Address: ln.Addr().String(), Timeout: 200 * time.Millisecond}
+	start := time.Now()
+	if _, err := clamd.Scan(context.Background(), strings.NewReader("data")); err == nil {
+		t.Fatal("scan without a reply succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("scan took %v despite the timeout", elapsed)
+	}
+}
+
+func TestParseClamdAddress(t *testing.T) {
+	tests := []struct {
+		addr, network, address string
+		ok                     bool
+	}{
+		{"tcp://clamav:3310", "tcp", "clamav:3310", true},
+		{"unix:///run/clamd.sock", "unix", "/run/clamd.sock", true},
+		{"/run/clamd.sock", "unix", "/run/clamd.sock", true},
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310", true},
+		{"clamav", "", "", false},
+	}
+	for _, tt := range tests {
+		network, address, err := ParseClamdAddress(tt.addr)
+		if (err == nil) != tt.ok || network != tt.network || address != tt.address {
+			t.Errorf("ParseClamdAddress(%q) = %q, %q, %v", tt.addr, network, address, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Command scans files with an external program that reads the file on
+// standard input and follows the clamscan convention for its exit status:
+// 0 when the file is clean, 1 when it is infected and anything else on
+// failure. The last line of its output is taken as the signature name.
+//
+// For example, "clamscan --no-summary -" or "clamdscan --no-summary -".
+type Command struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+// maxCommandOutput bounds how much of the scanner's output is kept.
+const maxCommandOutput = 4 << 10
+
+// Scan runs the command with r as its input.
+func (c *Command) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Stdin = r
+	out := &limitedBuffer{max: maxCommandOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return Result{}, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return Result{Infected: true, Signature: signature(out.String())}, nil
+	case ctx.Err() != nil:
+		return Result{}, fmt.Errorf("%s: %w", c.Path, ctx.Err())
+	}
+	if msg := lastLine(out.String()); msg != "" {
+		return Result{}, fmt.Errorf("%s: %w: %s", c.Path, err, truncate(msg))
+	}
+	return Result{}, fmt.Errorf("%s: %w", c.Path, err)
+}
+
+// signature extracts the name of what was found from output such as
+// "stdin: Eicar-Signature FOUND".
+func signature(output string) string {
+	line := lastLine(output)
+	if _, rest, found := strings.Cut(line, ": "); found {
+		line = rest
+	}
+	if line = strings.TrimSpace(strings.TrimSuffix(line, " FOUND")); line != "" {
+		return truncate(line)
+	}
+	return "unknown"
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,85 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func shell(t *testing.T, script string) *Command {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not installed")
+	}
+	return &Command{Path: sh, Args: []string{"-c", script}, Timeout: 5 * time.Second}
+}
+
+func TestCommandExitCodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		infected  bool
+		signature string
+		err       string
+	}{
+		{name: "clean", script: "cat >/dev/null; echo 'stdin: OK'"},
+		{name: "infected", script: "cat >/dev/null; echo 'stdin: Eicar-Signature FOUND'; exit 1",
+			infected: true, signature: "Eicar-Signature"},
+		{name: "infected after other output", script: "cat >/dev/null; echo 'Loading'; echo 'stdin: Win.Test.EICAR_HDB-1 FOUND'; exit 1",
+			infected: true, signature: "Win.Test.EICAR_HDB-1"},
+		{name: "infected without output", script: "cat >/dev/null; exit 1", infected: true, signature: "unknown"},
+		{name: "failed", script: "cat >/dev/null; echo 'ERROR: Can not open database' >&2; exit 2", err: "Can not open database"},
+		{name: "failed without output", script: "exit 40", err: "exit status 40"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := shell(t, tt.script).Scan(context.Background(), strings.NewReader("file contents"))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want one mentioning %q", err, tt.err)
+				}
+				if res.Infected {
+					t.Fatal("failed scan reported an infection")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Infected != tt.infected || res.Signature != tt.signature {
+				t.Fatalf("Scan = %+v, want infected %v, signature %q", res, tt.infected, tt.signature)
+			}
+		})
+	}
+}
+
+func TestCommandReadsStdin(t *testing.T) {
+	res, err := shell(t, `test "$(cat)" = "file contents" || exit 1`).Scan(context.Background(), strings.NewReader("file contents"))
+	if err != nil || res.Infected {
+		t.Fatalf("Scan = %+v, %v; the command did not get the file on stdin", res, err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	cmd := shell(t, "exec sleep 10")
+	cmd.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err := cmd.Scan(context.Background(), strings.NewReader(""))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("scan took %v despite the timeout", elapsed)
+	}
+}
+
+func TestCommandMissing(t *testing.T) {
+	cmd := &Command{Path: "/nonexistent/clamscan"}
+	if _, err := cmd.Scan(context.Background(), strings.NewReader("")); err == nil {
+		t.Fatal("scan with a missing command succeeded")
+	}
+}
@@ -0,0 +1,22 @@
+// Package scan checks uploaded files for malware, either through a clamd
+// daemon or an external command.
+package scan
+
+import (
+	"context"
+	"io"
+)
+
+// Result is the verdict of a scanner on one file.
+type Result struct {
+	Infected bool
+	// Signature names what was found in an infected file.
+	Signature string
+}
+
+// Scanner scans a file as it is streamed. Implementations must consume r
+// or return an error; errors mean the file could not be scanned, not that
+// it is infected.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
@@ -0,0 +1,110 @@
+package security
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"mime"
+	"net/http"
+
+	"share/logging"
+)
+
+const (
+	csrfCookieName = "share_csrf"
+
+	// FieldName is the form field carrying the CSRF token.
+	FieldName = "csrf_token"
+	// HeaderName is the request header carrying the CSRF token for fetch
+	// calls.
+	HeaderName = "X-CSRF-Token"
+)
+
+// CSRF protects state-changing requests with tokens bound to a per-browser
+// cookie. The token is an HMAC of the cookie value, so it cannot be derived
+// without the server key even if an attacker can plant cookies.
+type CSRF struct {
+	key []byte
+}
+
+// NewCSRF creates a CSRF guard with a random key. Forms rendered before a
+// restart must be reloaded.
+func NewCSRF() *CSRF {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &CSRF{key: key}
+}
+
+// Middleware issues the CSRF cookie, exposes the token through Token and
+// rejects POST, PUT, PATCH and DELETE requests without a valid token.
+//
+// Requests with no cookies, Origin or Sec-Fetch-Site header do not come from
+// a browser and carry no ambient credentials, so scripts and CLI clients can
+// keep using the upload and device APIs without a token.
+func (c *CSRF) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var id string
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && len(cookie.Value) >= 32 {
+			id = cookie.Value
+		} else {
+			id = randomString(32)
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    id,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		token := c.token(id)
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		default:
+			if !fromBrowser(r) {
+				break
+			}
+			if !hmac.Equal([]byte(requestToken(r)), []byte(token)) {
+				logging.FromContext(r.Context()).Warn("csrf check failed", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+				http.Error(w, "This form has expired. Go back, reload the page and try again.", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfTokenKey, token)))
+	})
+}
+
+func (c *CSRF) token(id string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns the CSRF token to embed in forms and pages of the request.
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(csrfTokenKey).(string)
+	return token
+}
+
+// requestToken reads the submitted token from the header, a urlencoded form
+// field, or for multipart uploads the query string so the upload body is not
+// parsed before the handler's own checks.
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get(HeaderName); token != "" {
+		return token
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		return r.PostFormValue(FieldName)
+	}
+	return r.URL.Query().Get(FieldName)
+}
+
+func fromBrowser(r *http.Request) bool {
+	return len(r.Cookies()) > 0 || r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != ""
+}
@@ -0,0 +1,71 @@
+// Package security provides the HTTP hardening middleware: a strict set of
+// response headers with per-request CSP nonces, and CSRF protection.
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+type contextKey int
+
+const (
+	nonceKey contextKey = iota
+	csrfTokenKey
+)
+
+// contentSecurityPolicy allows only same-origin resources. Inline scripts
+// must carry the request nonce; inline style attributes are still allowed
+// because the templates use them for layout tweaks.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'nonce-%s'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: blob:; " +
+	"media-src 'self' blob:; " +
+	"connect-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'none'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// Headers sets the security headers on every response and makes a fresh CSP
+// nonce available to templates through Nonce.
+func Headers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := randomString(16)
+		h := w.Header()
+		h.Set("Content-Security-Policy", fmt.Sprintf(contentSecurityPolicy, nonce))
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		h.Set("Cross-Origin-Opener-Policy", "same-origin")
+		h.Set("Permissions-Policy", "camera=(self), microphone=(), geolocation=()")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nonceKey, nonce)))
+	})
+}
+
+// NoReferrer marks a page as carrying transfer credentials in its URL so
+// browsers never send it as a Referer, not even to this origin.
+func NoReferrer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next(w, r)
+	}
+}
+
+// Nonce returns the CSP nonce of the request for inline scripts.
+func Nonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceKey).(string)
+	return nonce
+}
+
+func randomString(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -1,3 +1,13 @@
+// csrfHeaders adds the page's CSRF token to the headers of a state-changing
+// fetch request.
+function csrfHeaders(headers = {}) {
+  const meta = document.querySelector('meta[name="csrf-token"]');
+  if (meta && meta.content) {
+    headers["X-CSRF-Token"] = meta.content;
+  }
+  return headers;
+}
+
 const DeviceIdentity = (() => {
   const STORAGE_KEY = "fs_device_id";
   let deviceId = null;
@@ -46,7 +56,7 @@ const DeviceIdentity = (() => {
     if (existingId) payload.id = existingId;
     const res = await fetch("/api/devices/register", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers: csrfHeaders({ "Content-Type": "application/json" }),
       body: JSON.stringify(payload),
     });
     if (!res.ok) {
@@ -11,7 +11,7 @@ const DevicePage = (() => {
     if (!input.value.trim() || !state.deviceId) return;
     fetch("/api/devices/register", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers: csrfHeaders({ "Content-Type": "application/json" }),
       body: JSON.stringify({ id: state.deviceId, name: input.value.trim() }),
     })
       .then((res) => {
@@ -92,10 +92,10 @@ const DevicePage = (() => {
 
   function openTransfer() {
     if (!state.pending) return;
-    const target = `${window.location.origin}/incoming?id=${encodeURIComponent(state.pending.transferId)}&token=${encodeURIComponent(state.pending.token)}`;
+    const target = `${window.location.origin}/r/${encodeURIComponent(state.pending.transferId)}#${encodeURIComponent(state.pending.token)}`;
     fetch("/api/devices/clear", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers: csrfHeaders({ "Content-Type": "application/json" }),
       body: JSON.stringify({ deviceId: state.deviceId, transferId: state.pending.transferId }),
     }).finally(() => {
       hidePopup();
@@ -108,9 +108,12 @@ const DevicePage = (() => {
       hidePopup();
       return;
     }
+    if (!window.confirm("Dismiss this transfer? It will no longer be offered on this device.")) {
+      return;
+    }
     fetch("/api/devices/clear", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers: csrfHeaders({ "Content-Type": "application/json" }),
       body: JSON.stringify({ deviceId: state.deviceId, transferId: state.pending.transferId }),
     }).finally(() => hidePopup());
   }
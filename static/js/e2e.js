@@ -0,0 +1,377 @@
+// E2E implements the end-to-end encrypted transfer format of the Go e2e
+// package: files are sealed with AES-256-GCM in 64 KiB chunks under a key
+// that only ever travels in the share link's fragment.
+const E2E = (() => {
+  const MAGIC = [0x53, 0x47, 0x45, 0x31]; // "SGE1"
+  const HEADER_SIZE = 15;
+  const CHUNK_SIZE = 64 * 1024;
+  const MAX_CHUNK_SIZE = 4 * 1024 * 1024;
+  const TAG_SIZE = 16;
+  const META_AAD = new TextEncoder().encode("share-e2e-metadata-v1");
+
+  function toBase64Url(bytes) {
+    let binary = "";
+    bytes.forEach((b) => (binary += String.fromCharCode(b)));
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function fromBase64Url(text) {
+    const base64 = text.replace(/-/g, "+").replace(/_/g, "/") + "===".slice((text.length + 3) % 4);
+    const binary = atob(base64);
+    const bytes = new Uint8Array(binary.length);
+    for (let i = 0; i < binary.length; i++) bytes[i] = binary.charCodeAt(i);
+    return bytes;
+  }
+
+  function importKey(raw) {
+    return crypto.subtle.importKey("raw", raw, "AES-GCM", false, ["encrypt", "decrypt"]);
+  }
+
+  async function generateKey() {
+    const raw = crypto.getRandomValues(new Uint8Array(32));
+    return { encoded: toBase64Url(raw), key: await importKey(raw) };
+  }
+
+  async function decodeKey(text) {
+    const raw = fromBase64Url(text);
+    if (raw.length !== 32) throw new Error("invalid key");
+    return importKey(raw);
+  }
+
+  // Keys are kept per tab in sessionStorage so they survive the redirects
+  // between the open, share and receive pages without reaching the server.
+  function rememberKey(id, encoded) {
+    try {
+      window.sessionStorage.setItem(`share-e2e-${id}`, encoded);
+    } catch (err) {
+      console.warn("Unable to keep the decryption key", err);
+    }
+  }
+
+  function recallKey(id) {
+    try {
+      return window.sessionStorage.getItem(`share-e2e-${id}`);
+    } catch {
+      return null;
+    }
+  }
+
+  function chunkNonce(prefix, counter, last) {
+    const nonce = new Uint8Array(12);
+    nonce.set(prefix);
+    new DataView(nonce.buffer).setUint32(7, counter);
+    nonce[11] = last ? 1 : 0;
+    return nonce;
+  }
+
+  // sealChunks yields the ciphertext of file, header first, reading and
+  // sealing one chunk at a time.
+  async function* sealChunks(file, key, chunkSize, prefix) {
+    const header = new Uint8Array(HEADER_SIZE);
+    header.set(MAGIC);
+    new DataView(header.buffer).setUint32(4, chunkSize);
+    header.set(prefix, 8);
+    yield header;
+    for (let counter = 0, offset = 0; ; counter++, offset += chunkSize) {
+      const end = Math.min(offset + chunkSize, file.size);
+      const last = end >= file.size;
+      const plain = await file.slice(offset, end).arrayBuffer();
+      const sealed = await crypto.subtle.encrypt(
+        { name: "AES-GCM", iv: chunkNonce(prefix, counter, last) },
+        key,
+        plain,
+      );
+      yield new Uint8Array(sealed);
+      if (last) return;
+    }
+  }
+
+  // encryptFile returns the ciphertext of file as a Blob. The chunk size and
+  // nonce prefix are only given by the test vector check (e2e/testdata).
+  async function encryptFile(file, key, chunkSize = CHUNK_SIZE, prefix = crypto.getRandomValues(new Uint8Array(7))) {
+    const parts = [];
+    for await (const part of sealChunks(file, key, chunkSize, prefix)) parts.push(part);
+    return new Blob(parts, { type: "application/octet-stream" });
+  }
+
+  // decryptStream reads ciphertext from a ReadableStream and hands every
+  // authenticated plaintext chunk to onChunk, in order.
+  async function decryptStream(stream, key, onChunk) {
+    const reader = stream.getReader();
+    let buffer = new Uint8Array(0);
+    let done = false;
+    // fill reads until more than n bytes are buffered or the stream ends.
+    async function fill(n) {
+      while (!done && buffer.length <= n) {
+        const result = await reader.read();
+        if (result.done) {
+          done = true;
+          break;
+        }
+        const merged = new Uint8Array(buffer.length + result.value.length);
+        merged.set(buffer);
+        merged.set(result.value, buffer.length);
+        buffer = merged;
+      }
+    }
+
+    await fill(HEADER_SIZE);
+    if (buffer.length < HEADER_SIZE || !MAGIC.every((b, i) => buffer[i] === b)) {
+      throw new Error("not an encrypted file");
+    }
+    const chunkSize = new DataView(buffer.buffer, buffer.byteOffset).getUint32(4);
+    if (!chunkSize || chunkSize > MAX_CHUNK_SIZE) throw new Error("not an encrypted file");
+    const prefix = buffer.slice(8, HEADER_SIZE);
+    buffer = buffer.slice(HEADER_SIZE);
+    const sealedSize = chunkSize + TAG_SIZE;
+    for (let counter = 0; ; counter++) {
+      // A chunk is the last one when nothing follows it.
+      await fill(sealedSize);
+      const last = buffer.length <= sealedSize;
+      const sealed = buffer.slice(0, sealedSize);
+      buffer = buffer.slice(sealed.length);
+      let plain;
+      try {
+        plain = await crypto.subtle.decrypt({ name: "AES-GCM", iv: chunkNonce(prefix, counter, last) }, key, sealed);
+      } catch {
+        throw new Error("decryption failed: wrong key or damaged file");
+      }
+      await onChunk(new Uint8Array(plain));
+      if (last) return;
+    }
+  }
+
+  async function sealMetadata(meta, key) {
+    const nonce = crypto.getRandomValues(new Uint8Array(12));
+    const plain = new TextEncoder().encode(JSON.stringify(meta));
+    const sealed = new Uint8Array(
+      await crypto.subtle.encrypt({ name: "AES-GCM", iv: nonce, additionalData: META_AAD }, key, plain),
+    );
+    const out = new Uint8Array(nonce.length + sealed.length);
+    out.set(nonce);
+    out.set(sealed, nonce.length);
+    return toBase64Url(out);
+  }
+
+  async function openMetadata(text, key) {
+    const raw = fromBase64Url(text);
+    const plain = await crypto.subtle.decrypt(
+      { name: "AES-GCM", iv: raw.slice(0, 12), additionalData: META_AAD },
+      key,
+      raw.slice(12),
+    );
+    return JSON.parse(new TextDecoder().decode(plain));
+  }
+
+  // Browsers that can send a ReadableStream as a request body read the
+  // duplex option and leave the Content-Type unset. They only stream over
+  // HTTP/2, which they only speak over TLS.
+  function streamsUploads() {
+    if (location.protocol !== "https:" || !window.ReadableStream) return false;
+    let duplexAccessed = false;
+    try {
+      const hasContentType = new Request(location.href, {
+        method: "POST",
+        body: new ReadableStream(),
+        get duplex() {
+          duplexAccessed = true;
+          return "half";
+        },
+      }).headers.has("Content-Type");
+      return duplexAccessed && !hasContentType;
+    } catch {
+      return false;
+    }
+  }
+
+  // uploadFields returns the form fields of an encrypted upload, and for
+  // each file its sealed metadata.
+  async function uploadFields(form, files, key) {
+    const fields = [
+      ["encrypted", "1"],
+      ["category", form.elements.category.value],
+    ];
+    const pin = form.elements.pin;
+    if (pin && !pin.disabled && pin.value) fields.push(["pin", pin.value]);
+    const metas = [];
+    for (const file of files) {
+      const meta = { name: file.name, type: file.type || "application/octet-stream", size: file.size };
+      metas.push(await sealMetadata(meta, key));
+    }
+    return { fields, metas };
+  }
+
+  // multipartStream encodes the upload as a multipart/form-data body that
+  // encrypts each file as the request reads it, so no file is ever held in
+  // memory whole.
+  function multipartStream(boundary, fields, metas, files, key, onStatus) {
+    const encoder = new TextEncoder();
+    const field = (name, value) =>
+      encoder.encode(`--${boundary}\r\nContent-Disposition: form-data; name="${name}"\r\n\r\n${value}\r\n`);
+    async function* parts() {
+      for (const [name, value] of fields) yield field(name, value);
+      for (const [index, file] of files.entries()) {
+        onStatus(`Encrypting and uploading file ${index + 1} of ${files.length}…`);
+        yield field("meta", metas[index]);
+        yield encoder.encode(
+          `--${boundary}\r\nContent-Disposition: form-data; name="files"; filename="file-${index + 1}.sge"\r\n` +
+            "Content-Type: application/octet-stream\r\n\r\n",
+        );
+        yield* sealChunks(file, key, CHUNK_SIZE, crypto.getRandomValues(new Uint8Array(7)));
+        yield encoder.encode("\r\n");
+      }
+      yield encoder.encode(`--${boundary}--\r\n`);
+    }
+    const iterator = parts();
+    return new ReadableStream({
+      async pull(controller) {
+        const { value, done } = await iterator.next();
+        if (done) {
+          controller.close();
+        } else {
+          controller.enqueue(value);
+        }
+      },
+      cancel() {
+        iterator.return();
+      },
+    });
+  }
+
+  // multipartBlob encodes the upload as FormData, which needs the
+  // ciphertext of every file before the request starts.
+  async function multipartBlob(fields, metas, files, key, onStatus) {
+    const body = new FormData();
+    for (const [name, value] of fields) body.append(name, value);
+    for (const [index, file] of files.entries()) {
+      onStatus(`Encrypting file ${index + 1} of ${files.length} in memory…`);
+      body.append("meta", metas[index]);
+      body.append("files", await encryptFile(file, key), `file-${index + 1}.sge`);
+    }
+    return body;
+  }
+
+  // upload encrypts the files chosen in form and posts the ciphertext with
+  // the sealed metadata. Where the browser can stream request bodies the
+  // files are encrypted as they are sent; elsewhere, or when the connection
+  // refuses a streamed body, each file is encrypted in memory first. The key
+  // is remembered for the share page.
+  async function upload(form, onStatus) {
+    const { encoded, key } = await generateKey();
+    const files = Array.from(form.querySelector('input[type="file"]').files);
+    const { fields, metas } = await uploadFields(form, files, key);
+    let res = null;
+    if (streamsUploads()) {
+      const boundary = `----share-e2e-${toBase64Url(crypto.getRandomValues(new Uint8Array(12)))}`;
+      try {
+        res = await fetch(form.action, {
+          method: "POST",
+          headers: csrfHeaders({
+            Accept: "application/json",
+            "Content-Type": `multipart/form-data; boundary=${boundary}`,
+          }),
+          body: multipartStream(boundary, fields, metas, files, key, onStatus),
+          duplex: "half",
+        });
+      } catch (err) {
+        // An HTTP/1.1 connection rejects streamed bodies before sending
+        // anything; anything else fails again below.
+        if (!(err instanceof TypeError)) throw err;
+      }
+    }
+    if (!res) {
+      const body = await multipartBlob(fields, metas, files, key, onStatus);
+      onStatus("Uploading…");
+      res = await fetch(form.action, {
+        method: "POST",
+        headers: csrfHeaders({ Accept: "application/json" }),
+        body,
+      });
+    }
+    if (!res.ok) {
+      const type = res.headers.get("Content-Type") || "";
+      throw new Error(type.startsWith("text/plain") ? (await res.text()).trim() : `Upload failed (${res.status}).`);
+    }
+    const transfer = await res.json();
+    rememberKey(transfer.id, encoded);
+    return transfer;
+  }
+
+  // revealFiles decrypts the metadata of every [data-e2e-meta] row on the
+  // page and shows the real file names, sizes and types.
+  async function revealFiles(key) {
+    const rows = document.querySelectorAll("[data-e2e-meta]");
+    for (const row of rows) {
+      try {
+        const meta = await openMetadata(row.dataset.e2eMeta, key);
+        row.e2eMeta = meta;
+        const name = row.querySelector("[data-e2e-name]");
+        const info = row.querySelector("[data-e2e-info]");
+        if (name) name.textContent = meta.name;
+        if (info) info.textContent = `${(meta.size / (1024 * 1024)).toFixed(2)} MB · ${meta.type}`;
+      } catch (err) {
+        row.classList.add("e2e-broken");
+      }
+    }
+  }
+
+  // Only browsers with the File System Access API can write a download to
+  // disk as it is decrypted.
+  function streamsDownloads() {
+    return Boolean(window.showSaveFilePicker);
+  }
+
+  // download fetches an encrypted file and saves its plaintext. Where
+  // streamsDownloads() the plaintext streams straight to disk; elsewhere the
+  // whole file is collected into a Blob in memory first.
+  async function download(url, key, meta, onProgress) {
+    let writable = null;
+    if (streamsDownloads()) {
+      const handle = await window.showSaveFilePicker({ suggestedName: meta.name });
+      writable = await handle.createWritable();
+    }
+    const parts = [];
+    let received = 0;
+    try {
+      const res = await fetch(url);
+      if (!res.ok || !res.body) throw new Error(`Download failed (${res.status}).`);
+      await decryptStream(res.body, key, async (chunk) => {
+        received += chunk.length;
+        if (writable) {
+          await writable.write(chunk);
+        } else {
+          parts.push(chunk);
+        }
+        onProgress && onProgress(received, meta.size);
+      });
+    } catch (err) {
+      if (writable) await writable.abort();
+      throw err;
+    }
+    if (writable) {
+      await writable.close();
+      return;
+    }
+    const blobUrl = URL.createObjectURL(new Blob(parts, { type: meta.type || "application/octet-stream" }));
+    const link = document.createElement("a");
+    link.href = blobUrl;
+    link.download = meta.name;
+    document.body.appendChild(link);
+    link.click();
+    link.remove();
+    setTimeout(() => URL.revokeObjectURL(blobUrl), 60000);
+  }
+
+  return {
+    decodeKey,
+    encryptFile,
+    decryptStream,
+    openMetadata,
+    rememberKey,
+    recallKey,
+    upload,
+    revealFiles,
+    download,
+    streamsDownloads,
+  };
+})();
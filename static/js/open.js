@@ -0,0 +1,42 @@
+const OpenPage = (() => {
+  function fail() {
+    document.getElementById("open-status").classList.add("hidden");
+    document.getElementById("open-error").classList.remove("hidden");
+  }
+
+  async function open() {
+    const root = document.getElementById("open-transfer");
+    const id = root.dataset.id;
+    const file = root.dataset.file;
+    // End-to-end encrypted transfers carry "<token>.<key>"; the key stays in
+    // this tab and is never sent to the server.
+    const [token, key] = decodeURIComponent(window.location.hash.replace(/^#/, "")).split(".");
+    // Drop the token and key from the address bar and history right away.
+    window.history.replaceState(null, "", window.location.pathname + window.location.search);
+    if (!id || !token) {
+      fail();
+      return;
+    }
+    try {
+      const res = await fetch("/api/transfers/open", {
+        method: "POST",
+        headers: csrfHeaders({ "Content-Type": "application/json" }),
+        body: JSON.stringify({ id, token }),
+      });
+      if (!res.ok) throw new Error("open failed");
+    } catch (err) {
+      fail();
+      return;
+    }
+    if (key) E2E.rememberKey(id, key);
+    // Encrypted files are decrypted on the receive page, not downloaded as is.
+    const target = file && !key
+      ? `/file?id=${encodeURIComponent(id)}&file=${encodeURIComponent(file)}`
+      : `/incoming?id=${encodeURIComponent(id)}`;
+    window.location.replace(target);
+  }
+
+  return { open };
+})();
+
+document.addEventListener("DOMContentLoaded", () => OpenPage.open());
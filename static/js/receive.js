@@ -14,9 +14,80 @@ const ReceivePage = (() => {
     });
   }
 
+  function setStatus(row, text) {
+    const status = row.querySelector("[data-e2e-status]");
+    status.textContent = text;
+    status.classList.toggle("hidden", !text);
+  }
+
+  // initEncrypted decrypts file names with the key the open page kept for
+  // this tab and decrypts downloads as they stream in.
+  async function initEncrypted(root) {
+    const encoded = E2E.recallKey(root.dataset.transfer);
+    let key = null;
+    try {
+      key = encoded && (await E2E.decodeKey(encoded));
+    } catch {
+      key = null;
+    }
+    if (!key) {
+      document.getElementById("e2e-missing-key").classList.remove("hidden");
+      return;
+    }
+    await E2E.revealFiles(key);
+    root.querySelectorAll("[data-e2e-download]").forEach((button) => {
+      const row = button.closest("[data-e2e-meta]");
+      if (!row.e2eMeta) {
+        setStatus(row, "This file cannot be decrypted with the key from your link.");
+        return;
+      }
+      button.disabled = false;
+      // Without a way to write to disk the whole file is decrypted in
+      // memory, which large files may not fit in.
+      const label = E2E.streamsDownloads()
+        ? "Decrypting…"
+        : "This browser cannot save straight to disk, so the whole file is decrypted in memory first. Decrypting…";
+      button.addEventListener("click", async () => {
+        button.disabled = true;
+        try {
+          await E2E.download(button.dataset.e2eDownload, key, row.e2eMeta, (done, total) => {
+            setStatus(row, `${label} ${total ? Math.floor((done / total) * 100) : 100}%`);
+          });
+          setStatus(row, "Downloaded.");
+        } catch (err) {
+          setStatus(row, err.name === "AbortError" ? "" : err.message);
+        } finally {
+          button.disabled = false;
+        }
+      });
+    });
+  }
+
+  // Thumbnails are made in the background after the upload, so retry the
+  // ones that were not ready yet when the page loaded.
+  function bindGallery() {
+    document.querySelectorAll("img[data-thumbnail]").forEach((img) => {
+      let attempts = 0;
+      img.addEventListener("error", () => {
+        if (attempts >= 5) {
+          img.closest(".gallery-tile").classList.add("gallery-missing");
+          return;
+        }
+        attempts += 1;
+        const src = img.src.replace(/&retry=\d+$/, "");
+        setTimeout(() => {
+          img.src = `${src}&retry=${attempts}`;
+        }, attempts * 2000);
+      });
+    });
+  }
+
   return {
     init() {
       bindScanner();
+      bindGallery();
+      const encrypted = document.getElementById("e2e-files");
+      if (encrypted) initEncrypted(encrypted);
     },
   };
 })();
@@ -71,7 +71,7 @@ const SharePage = (() => {
       const item = document.createElement("div");
       item.className = "device-item";
       const details = document.createElement("div");
-      details.innerHTML = `<div class="device-name">${device.name}</div><div class="device-meta">ID: ${device.id}</div>`;
+      details.innerHTML = `<div class="device-name">${device.name}</div><div class="device-meta">ID: ${device.id}${device.owner ? ` · ${device.owner}` : ""}</div>`;
       const actions = document.createElement("div");
       actions.className = "device-actions";
       const button = document.createElement("button");
@@ -90,9 +90,9 @@ const SharePage = (() => {
     try {
       const res = await fetch("/api/devices/notify", {
         method: "POST",
-        headers: {
+        headers: csrfHeaders({
           "Content-Type": "application/json",
-        },
+        }),
         body: JSON.stringify({
           deviceId,
           transferId: state.transferId,
@@ -111,7 +111,46 @@ const SharePage = (() => {
     }
   }
 
+  // copyOnceLink mints a download link for one file that stops working
+  // after the first download.
+  async function copyOnceLink(button) {
+    const original = button.textContent;
+    button.disabled = true;
+    try {
+      const res = await fetch("/api/transfers/links", {
+        method: "POST",
+        headers: csrfHeaders({
+          "Content-Type": "application/json",
+          "X-Share-Token": state.token,
+        }),
+        body: JSON.stringify({
+          id: state.transferId,
+          file: button.dataset.onceLink,
+          singleUse: true,
+        }),
+      });
+      if (!res.ok) throw new Error("failed");
+      const link = await res.json();
+      if (navigator.clipboard) {
+        await navigator.clipboard.writeText(link.url);
+      } else {
+        window.prompt("One-time download link", link.url);
+      }
+      button.textContent = "Copied!";
+    } catch (err) {
+      button.textContent = "Try again";
+    } finally {
+      setTimeout(() => {
+        button.textContent = original;
+        button.disabled = false;
+      }, 1800);
+    }
+  }
+
   function bindEvents() {
+    document.querySelectorAll("[data-once-link]").forEach((button) => {
+      button.addEventListener("click", () => copyOnceLink(button));
+    });
     const copyBtn = document.getElementById("copy-link");
     copyBtn && copyBtn.addEventListener("click", copyLink);
     const openScanner = document.getElementById("open-scanner");
@@ -128,11 +167,32 @@ const SharePage = (() => {
       );
   }
 
+  // attachKey completes the share link of an end-to-end encrypted transfer
+  // with the key kept by the tab that uploaded it.
+  function attachKey() {
+    const encoded = E2E.recallKey(state.transferId);
+    if (!encoded) {
+      document.getElementById("e2e-missing-key").classList.remove("hidden");
+      return;
+    }
+    state.shareLink = `${state.shareLink}.${encoded}`;
+    document.getElementById("share-link").textContent = state.shareLink;
+    E2E.decodeKey(encoded).then(E2E.revealFiles, () => {});
+  }
+
   return {
     init(config) {
       state.shareLink = config.shareLink;
       state.transferId = config.transferId;
       state.token = config.token;
+      if (config.encrypted) {
+        // Devices are notified through the server, which must never see the
+        // key, so encrypted transfers are shared by link only.
+        attachKey();
+        renderQR();
+        bindEvents();
+        return;
+      }
       renderQR();
       bindEvents();
       fetchDevices();
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// File contents live in a content-addressed blob area, so transfers that
+// share identical files store them only once. Blobs are reference counted
+// and deleted when the last transfer using them is removed.
+const blobsDir = "blobs"
+
+type blob struct {
+	refs int
+	// size is the length of the blob on disk.
+	size int64
+
+	thumb     thumbState
+	thumbSize int64
+}
+
+func (s *Store) blobPath(address string) string {
+	return filepath.Join(s.dir, blobsDir, address)
+}
+
+// blobAddress returns the address of the blob holding content with the
+// given SHA-256. With encryption at rest the checksum is keyed by a subkey
+// of the master key, so blob names do not reveal which well-known files are
+// stored.
+func (s *Store) blobAddress(sha string) string {
+	if s.opts.MasterKey == nil {
+		return sha
+	}
+	mac := hmac.New(sha256.New, s.addressKey)
+	mac.Write([]byte(sha))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// commitBlob takes a reference to the blob at address. When no such blob
+// exists the staged file becomes it, together with its data key if it was
+// encrypted; otherwise the staged copy is dropped.
+func (s *Store) commitBlob(staged, address string, key []byte, size int64) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	if b, ok := s.blobs[address]; ok {
+		b.refs++
+		_ = os.Remove(staged)
+		return nil
+	}
+	if key != nil {
+		if err := s.saveDataKey(address, key); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(staged, s.blobPath(address)); err != nil {
+		s.shredDataKey(address)
+		return err
+	}
+	stored := s.storedSize(size)
+	s.blobs[address] = &blob{refs: 1, size: stored}
+	s.mu.Lock()
+	s.used += stored
+	s.mu.Unlock()
+	return nil
+}
+
+// releaseBlob drops a reference to a blob and deletes it, shredding its
+// data key first, once no transfer uses it any more.
+func (s *Store) releaseBlob(address string) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	b, ok := s.blobs[address]
+	if !ok {
+		return
+	}
+	if b.refs--; b.refs > 0 {
+		return
+	}
+	delete(s.blobs, address)
+	s.shredDataKey(address)
+	_ = os.Remove(s.blobPath(address))
+	_ = os.Remove(s.blobPath(address) + thumbSuffix)
+	s.mu.Lock()
+	s.used -= b.size
+	s.mu.Unlock()
+}
+
+// releaseFiles drops the blob references of a transfer's files.
+func (s *Store) releaseFiles(files []StoredFile) {
+	for _, f := range files {
+		s.releaseBlob(f.Blob)
+	}
+}
+
+// BlobStats returns the number of blobs and how many file references they
+// serve; the difference is the number of copies deduplication saved.
+func (s *Store) BlobStats() (blobs, refs int) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	for _, b := range s.blobs {
+		refs += b.refs
+	}
+	return len(s.blobs), refs
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"share/scan"
+)
+
+// flagScanner reports files containing marker as infected, or every file
+// while all is set.
+type flagScanner struct {
+	marker []byte
+	all    atomic.Bool
+}
+
+func (f *flagScanner) Scan(ctx context.Context, r io.Reader) (scan.Result, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return scan.Result{}, err
+	}
+	if f.all.Load() || bytes.Contains(data, f.marker) {
+		return scan.Result{Infected: true, Signature: "Test-Signature"}, nil
+	}
+	return scan.Result{}, nil
+}
+
+func newTestStore(t *testing.T, opts Options) *Store {
+	t.Helper()
+	s, err := NewStore(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func save(t *testing.T, s *Store, contents ...[]byte) *Transfer {
+	t.Helper()
+	transfer, err := s.SaveFiles(SaveOptions{Category: "mixed"}, filesOf(contents...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transfer
+}
+
+func checkBlobs(t *testing.T, s *Store, wantBlobs, wantRefs int, wantUsed int64) {
+	t.Helper()
+	blobs, refs := s.BlobStats()
+	_, used := s.Stats()
+	if blobs != wantBlobs || refs != wantRefs || used != wantUsed {
+		t.Fatalf("blobs, refs, used = %d, %d, %d; want %d, %d, %d", blobs, refs, used, wantBlobs, wantRefs, wantUsed)
+	}
+	entries, err := os.ReadDir(filepath.Join(s.dir, blobsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := 0
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == "" {
+			files++
+		}
+	}
+	if files != wantBlobs {
+		t.Fatalf("%d blob files on disk, want %d", files, wantBlobs)
+	}
+}
+
+func readFile(t *testing.T, s *Store, transfer *Transfer, i int) []byte {
+	t.Helper()
+	f, err := s.Open(transfer, &transfer.Files[i])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSharedBlobOutlivesRemovedTransfer(t *testing.T) {
+	for _, opts := range []Options{{}, {MasterKey: testMasterKey()}} {
+		s := newTestStore(t, opts)
+		shared, other := pattern(1000), pattern(300)
+		size := s.storedSize(1000)
+
+		first := save(t, s, shared)
+		second := save(t, s, shared, other)
+		if first.Files[0].Blob != second.Files[0].Blob {
+			t.Fatal("identical files got different blobs")
+		}
+		checkBlobs(t, s, 2, 3, size+s.storedSize(300))
+
+		// Revoking the first transfer leaves the blob to the second.
+		s.Remove(first.ID)
+		checkBlobs(t, s, 2, 2, size+s.storedSize(300))
+		if !bytes.Equal(readFile(t, s, second, 0), shared) {
+			t.Fatal("shared file changed after the first transfer was removed")
+		}
+		if opts.MasterKey != nil {
+			if _, err := os.Stat(second.Files[0].Path + dataKeySuffix); err != nil {
+				t.Fatalf("data key of a blob in use was shredded: %v", err)
+			}
+		}
+
+		s.Remove(second.ID)
+		checkBlobs(t, s, 0, 0, 0)
+		// Removing twice must not drop references of other transfers.
+		s.Remove(second.ID)
+		checkBlobs(t, s, 0, 0, 0)
+	}
+}
+
+func TestSharedBlobOutlivesExpiredTransfer(t *testing.T) {
+	s := newTestStore(t, Options{})
+	content := pattern(500)
+	old := save(t, s, content)
+	s.mu.Lock()
+	old.CreatedAt = old.CreatedAt.Add(-2 * time.Hour)
+	s.mu.Unlock()
+	recent := save(t, s, content)
+
+	if removed := s.CleanupOlderThan(time.Hour); removed != 1 {
+		t.Fatalf("CleanupOlderThan removed %d transfers, want 1", removed)
+	}
+	checkBlobs(t, s, 1, 1, 500)
+	if !bytes.Equal(readFile(t, s, recent, 0), content) {
+		t.Fatal("shared file changed after the older transfer expired")
+	}
+	if removed := s.CleanupOlderThan(-time.Hour); removed != 1 {
+		t.Fatalf("CleanupOlderThan removed %d transfers, want 1", removed)
+	}
+	checkBlobs(t, s, 0, 0, 0)
+}
+
+func TestQuarantinedFilesTakeNoBlob(t *testing.T) {
+	scanner := &flagScanner{marker: []byte("EICAR")}
+	s := newTestStore(t, Options{Scanner: scanner})
+	clean := pattern(400)
+	infected := append([]byte("EICAR"), pattern(100)...)
+
+	owner := save(t, s, clean)
+	mixed := save(t, s, clean, infected)
+	if mixed.Files[1].Scan != ScanInfected || mixed.Files[1].Blob != "" {
+		t.Fatalf("infected file = %+v", mixed.Files[1])
+	}
+	// Quarantined files count towards the quota, outside the blob area.
+	checkBlobs(t, s, 1, 2, 400+105)
+
+	// A verdict that changes with new signatures quarantines the new copy
+	// but leaves the blob of the earlier, clean one alone.
+	scanner.all.Store(true)
+	flagged := save(t, s, clean)
+	if flagged.Files[0].Scan != ScanInfected {
+		t.Fatal("file not quarantined")
+	}
+	checkBlobs(t, s, 1, 2, 400+105+400)
+
+	s.Remove(mixed.ID)
+	s.Remove(flagged.ID)
+	checkBlobs(t, s, 1, 1, 400+105+400)
+	if !bytes.Equal(readFile(t, s, owner, 0), clean) {
+		t.Fatal("clean file changed after quarantined copies were removed")
+	}
+	s.pruneQuarantine(time.Now().Add(time.Minute))
+	checkBlobs(t, s, 1, 1, 400)
+	s.Remove(owner.ID)
+	checkBlobs(t, s, 0, 0, 0)
+}
+
+func TestQuarantineCountsAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Scanner: &flagScanner{marker: []byte("EICAR")}, MasterKey: testMasterKey()}
+	s, err := NewStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	save(t, s, append([]byte("EICAR"), pattern(100)...))
+	stored := s.storedSize(105)
+	checkBlobs(t, s, 0, 0, stored)
+	s.Close()
+
+	// Quarantined files are kept across restarts, and so is their share of
+	// the quota.
+	s, err = NewStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkBlobs(t, s, 0, 0, stored)
+	s.pruneQuarantine(time.Now().Add(time.Minute))
+	checkBlobs(t, s, 0, 0, 0)
+	if entries, _ := os.ReadDir(filepath.Join(dir, quarantineDir)); len(entries) != 0 {
+		t.Fatalf("%d files left in quarantine", len(entries))
+	}
+}
+
+func TestBlobsAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir, Options{MasterKey: testMasterKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	save(t, s, pattern(100))
+	save(t, s, pattern(100), pattern(200))
+	checkBlobs(t, s, 2, 3, s.storedSize(100)+s.storedSize(200))
+	s.Close()
+
+	// Transfers are only held in memory, so nothing refers to the old
+	// blobs once the server restarts.
+	s, err = NewStore(dir, Options{MasterKey: testMasterKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkBlobs(t, s, 0, 0, 0)
+	if entries, _ := os.ReadDir(filepath.Join(dir, blobsDir)); len(entries) != 0 {
+		t.Fatalf("%d files left in the blob area", len(entries))
+	}
+	transfer := save(t, s, pattern(100))
+	checkBlobs(t, s, 1, 1, s.storedSize(100))
+	if !bytes.Equal(readFile(t, s, transfer, 0), pattern(100)) {
+		t.Fatal("file stored after a restart differs")
+	}
+}
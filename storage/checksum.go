@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// checksummer computes the checksums of a file while it is streamed to
+// disk.
+type checksummer struct {
+	sha256 hash.Hash
+	blake3 hash.Hash
+}
+
+func newChecksummer(withBLAKE3 bool) *checksummer {
+	c := &checksummer{sha256: sha256.New()}
+	if withBLAKE3 {
+		c.blake3 = blake3.New(32, nil)
+	}
+	return c
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	c.sha256.Write(p)
+	if c.blake3 != nil {
+		c.blake3.Write(p)
+	}
+	return len(p), nil
+}
+
+// sums returns the hex-encoded SHA-256 and, when computed, BLAKE3 checksums.
+func (c *checksummer) sums() (sha, b3 string) {
+	sha = hex.EncodeToString(c.sha256.Sum(nil))
+	if c.blake3 != nil {
+		b3 = hex.EncodeToString(c.blake3.Sum(nil))
+	}
+	return sha, b3
+}
+
+// verify compares the checksums with those the sender expected.
+func (c *checksummer) verify(payload FilePayload) error {
+	sha, b3 := c.sums()
+	if payload.ExpectedSHA256 != "" && !strings.EqualFold(payload.ExpectedSHA256, sha) {
+		return fmt.Errorf("%s: SHA-256 is %s: %w", payload.Name, sha, ErrChecksumMismatch)
+	}
+	if payload.ExpectedBLAKE3 != "" && !strings.EqualFold(payload.ExpectedBLAKE3, b3) {
+		return fmt.Errorf("%s: BLAKE3 is %s: %w", payload.Name, b3, ErrChecksumMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Files are encrypted at rest when the store has a master key. Every blob
+// gets a random data key, stored next to it wrapped by a subkey of the
+// master key. Another subkey names the blobs, so no key serves two
+// purposes.
+//
+// The data key belongs to the blob, not to a transfer: transfers that share
+// deduplicated content share its key, and the key is only shredded once the
+// last of them is removed. Removing one transfer therefore leaves its
+// content readable while another transfer still holds the same file.
+// Files are split into chunks sealed with AES-256-GCM under a per-file
+// nonce prefix and the chunk index, so any byte range can be read without
+// decrypting what precedes it.
+const (
+	dataKeySuffix   = ".key"
+	cryptMagic      = "SGR1"
+	cryptChunkSize  = 64 << 10
+	cryptPrefixSize = 8
+	cryptHeaderSize = len(cryptMagic) + cryptPrefixSize
+	cryptTagSize    = 16
+)
+
+// ErrCorrupt indicates an encrypted file or data key that fails to decrypt.
+var ErrCorrupt = errors.New("stored data is corrupt or the key is wrong")
+
+// deriveKey returns a purpose-specific subkey of the master key.
+func deriveKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newDataKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// wrapKey seals a data key with the key-wrapping subkey. The name of the file it
+// belongs to is bound to the wrapped key so it cannot be moved to another.
+func (s *Store) wrapKey(key []byte, name string) ([]byte, error) {
+	master, err := newGCM(s.wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return master.Seal(nonce, nonce, key, []byte(name)), nil
+}
+
+// saveDataKey stores the data key of a blob, wrapped.
+func (s *Store) saveDataKey(address string, key []byte) error {
+	wrapped, err := s.wrapKey(key, address)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.blobPath(address)+dataKeySuffix, wrapped, 0o600)
+}
+
+// dataKey unwraps the data key of a blob.
+func (s *Store) dataKey(address string) ([]byte, error) {
+	wrapped, err := os.ReadFile(s.blobPath(address) + dataKeySuffix)
+	if err != nil {
+		return nil, err
+	}
+	master, err := newGCM(s.wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < master.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	key, err := master.Open(nil, wrapped[:master.NonceSize()], wrapped[master.NonceSize():], []byte(address))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return key, nil
+}
+
+// shredDataKey overwrites and deletes a blob's data key, which leaves the
+// blob unreadable even if it survives on disk or in backups.
+func (s *Store) shredDataKey(address string) {
+	path := s.blobPath(address) + dataKeySuffix
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	if info, err := f.Stat(); err == nil {
+		_, _ = f.WriteAt(make([]byte, info.Size()), 0)
+		_ = f.Sync()
+	}
+	f.Close()
+	_ = os.Remove(path)
+}
+
+func cryptNonce(prefix []byte, chunk int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptPrefixSize:], uint32(chunk))
+	return nonce
+}
+
+// encryptedSize returns the length on disk of a file of size plaintext bytes.
+func encryptedSize(size int64) int64 {
+	chunks := (size + cryptChunkSize - 1) / cryptChunkSize
+	return int64(cryptHeaderSize) + size + chunks*cryptTagSize
+}
+
+// storedSize returns the length on disk of a file of size bytes.
+func (s *Store) storedSize(size int64) int64 {
+	if s.opts.MasterKey == nil {
+		return size
+	}
+	return encryptedSize(size)
+}
+
+// encryptWriter seals everything written to it into w chunk by chunk.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	chunk  int64
+	out    []byte
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, cryptHeaderSize)
+	copy(header, cryptMagic)
+	prefix := header[len(cryptMagic):]
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, cryptChunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), cryptChunkSize-len(e.buf))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(e.buf) == cryptChunkSize {
+			if err := e.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) flush() error {
+	if e.chunk > int64(^uint32(0)) {
+		return errors.New("file too large to encrypt")
+	}
+	e.out = e.aead.Seal(e.out[:0], cryptNonce(e.prefix, e.chunk), e.buf, nil)
+	e.chunk++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// Close seals the final partial chunk. It does not close the underlying
+// writer.
+func (e *encryptWriter) Close() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	return e.flush()
+}
+
+// decryptReader gives random access to the plaintext of an encrypted file.
+type decryptReader struct {
+	f      *os.File
+	aead   cipher.AEAD
+	prefix []byte
+	size   int64
+	off    int64
+
+	chunk  int64 // index of the chunk held in plain, or -1
+	plain  []byte
+	sealed []byte
+}
+
+func openEncrypted(path string, key []byte, size int64) (*decryptReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, cryptHeaderSize)
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.ReadFull(f, header)
+	}
+	if err != nil || string(header[:len(cryptMagic)]) != cryptMagic || info.Size() != encryptedSize(size) {
+		f.Close()
+		return nil, ErrCorrupt
+	}
+	return &decryptReader{
+		f:      f,
+		aead:   aead,
+		prefix: header[len(cryptMagic):],
+		size:   size,
+		chunk:  -1,
+		sealed: make([]byte, cryptChunkSize+cryptTagSize),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.off >= d.size {
+		return 0, io.EOF
+	}
+	chunk := d.off / cryptChunkSize
+	if chunk != d.chunk {
+		if err := d.load(chunk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.off-chunk*cryptChunkSize:])
+	d.off += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) load(chunk int64) error {
+	plainLen := min(int64(cryptChunkSize), d.size-chunk*cryptChunkSize)
+	sealed := d.sealed[:plainLen+cryptTagSize]
+	offset := int64(cryptHeaderSize) + chunk*(cryptChunkSize+cryptTagSize)
+	if _, err := d.f.ReadAt(sealed, offset); err != nil {
+		return fmt.Errorf("reading chunk %d: %w", chunk, err)
+	}
+	plain, err := d.aead.Open(d.plain[:0], cryptNonce(d.prefix, chunk), sealed, nil)
+	if err != nil {
+		d.chunk = -1
+		return ErrCorrupt
+	}
+	d.plain = plain
+	d.chunk = chunk
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.off
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.off = offset
+	return offset, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.f.Close()
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// payloads hands files to SaveFiles as an upload would.
+type payloads struct {
+	files []*FilePayload
+}
+
+func filesOf(contents ...[]byte) *payloads {
+	p := &payloads{}
+	for i, c := range contents {
+		p.files = append(p.files, &FilePayload{Name: string(rune('a'+i)) + ".bin", Content: io.NopCloser(bytes.NewReader(c))})
+	}
+	return p
+}
+
+func (p *payloads) Next() (*FilePayload, error) {
+	if len(p.files) == 0 {
+		return nil, io.EOF
+	}
+	f := p.files[0]
+	p.files = p.files[1:]
+	return f, nil
+}
+
+func testMasterKey() []byte {
+	return bytes.Repeat([]byte{7}, 32)
+}
+
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/cryptChunkSize)
+	}
+	return b
+}
+
+// writeEncrypted stores plain encrypted under key and returns the path.
+func writeEncrypted(t *testing.T, key, plain []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blob")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := newEncryptWriter(f, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDecryptReaderSeek(t *testing.T) {
+	key := newDataKey()
+	const c = cryptChunkSize
+	for _, size := range []int{0, 1, c - 1, c, c + 1, 2*c + 100, 3 * c} {
+		plain := pattern(size)
+		path := writeEncrypted(t, key, plain)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != encryptedSize(int64(size)) {
+			t.Fatalf("size %d: stored %d bytes, want %d", size, info.Size(), encryptedSize(int64(size)))
+		}
+		r, err := openEncrypted(path, key, int64(size))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		all, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(all, plain) {
+			t.Fatalf("size %d: ReadAll = %d bytes, %v", size, len(all), err)
+		}
+
+		// Reads start before, at and after chunk boundaries and run across
+		// them, into the final partial chunk and past the end.
+		for _, off := range []int{0, 1, c - 1, c, c + 1, 2*c - 3, 2 * c, 2*c + 99, size - 1, size} {
+			if off < 0 || off > size {
+				continue
+			}
+			for _, n := range []int{1, 5, c, c + 10, 2 * c} {
+				if _, err := r.Seek(int64(off), io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, n)
+				got, err := io.ReadFull(r, buf)
+				want := min(n, size-off)
+				if got != want || (got < n && err != io.ErrUnexpectedEOF && err != io.EOF) {
+					t.Fatalf("size %d: read %d at %d = %d, %v; want %d", size, n, off, got, err, want)
+				}
+				if !bytes.Equal(buf[:got], plain[off:off+got]) {
+					t.Fatalf("size %d: read %d at %d returned wrong bytes", size, n, off)
+				}
+			}
+		}
+
+		if size > 10 {
+			pos, err := r.Seek(-10, io.SeekEnd)
+			if err != nil || pos != int64(size-10) {
+				t.Fatalf("size %d: Seek(-10, end) = %d, %v", size, pos, err)
+			}
+			if pos, err = r.Seek(3, io.SeekCurrent); err != nil || pos != int64(size-7) {
+				t.Fatalf("size %d: Seek(3, current) = %d, %v", size, pos, err)
+			}
+			rest, _ := io.ReadAll(r)
+			if !bytes.Equal(rest, plain[size-7:]) {
+				t.Fatalf("size %d: tail differs", size)
+			}
+		}
+		if _, err := r.Seek(-1, io.SeekStart); err == nil {
+			t.Errorf("size %d: seeking before the start succeeded", size)
+		}
+		if _, err := r.Seek(int64(size+5), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("size %d: read past the end = %d, %v", size, n, err)
+		}
+		r.Close()
+	}
+}
+
+func TestDecryptReaderDetectsDamage(t *testing.T) {
+	key := newDataKey()
+	size := 2*cryptChunkSize + 100
+	path := writeEncrypted(t, key, pattern(size))
+
+	// The header carries no key check, so a wrong key shows on reading.
+	r, err := openEncrypted(path, newDataKey(), int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("wrong key: err = %v, want ErrCorrupt", err)
+	}
+	r.Close()
+	if _, err := openEncrypted(path, key, int64(size-1)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("wrong size: err = %v, want ErrCorrupt", err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A flipped bit in the final partial chunk only fails reads of that
+	// chunk.
+	raw[len(raw)-20] ^= 1
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err = openEncrypted(path, key, int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Seek(cryptChunkSize, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, cryptChunkSize)); err != nil {
+		t.Errorf("intact chunk: %v", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("damaged chunk: err = %v, want ErrCorrupt", err)
+	}
+
+	if err := os.WriteFile(path, raw[:len(raw)-1], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openEncrypted(path, key, int64(size)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("truncated: err = %v, want ErrCorrupt", err)
+	}
+}
+
+func TestQuotaCountsEncryptedSize(t *testing.T) {
+	size := cryptChunkSize + 10
+	quota := encryptedSize(int64(size))
+	s, err := NewStore(t.TempDir(), Options{MasterKey: testMasterKey(), Quota: quota})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The plaintext fits the quota, its ciphertext does not.
+	if err := s.CheckCapacity(quota - 1); !errors.Is(err, ErrInsufficientStorage) {
+		t.Errorf("CheckCapacity = %v, want ErrInsufficientStorage", err)
+	}
+	if _, err := s.SaveFiles(SaveOptions{}, filesOf(pattern(size+1))); !errors.Is(err, ErrInsufficientStorage) {
+		t.Fatalf("SaveFiles over quota = %v, want ErrInsufficientStorage", err)
+	}
+	transfer, err := s.SaveFiles(SaveOptions{}, filesOf(pattern(size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, used := s.Stats(); used != quota {
+		t.Errorf("used = %d, want %d", used, quota)
+	}
+	info, err := os.Stat(transfer.Files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != quota {
+		t.Errorf("blob takes %d bytes, want %d", info.Size(), quota)
+	}
+	s.Remove(transfer.ID)
+	if _, used := s.Stats(); used != 0 {
+		t.Errorf("used after remove = %d", used)
+	}
+}
+
+func TestMasterKeyIsNotUsedDirectly(t *testing.T) {
+	s, err := NewStore(t.TempDir(), Options{MasterKey: testMasterKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if bytes.Equal(s.addressKey, s.wrappingKey) || bytes.Equal(s.addressKey, testMasterKey()) || bytes.Equal(s.wrappingKey, testMasterKey()) {
+		t.Fatal("blob names and data keys share a key")
+	}
+
+	transfer, err := s.SaveFiles(SaveOptions{}, filesOf(pattern(10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := transfer.Files[0].Blob
+	if _, err := s.dataKey(address); err != nil {
+		t.Fatal(err)
+	}
+	// A data key wrapped by the master key itself is refused.
+	s.wrappingKey = testMasterKey()
+	if _, err := s.dataKey(address); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("dataKey under the master key = %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffSize is how much of each file is kept for content type detection.
+// It is more than http.DetectContentType looks at because ZIP based
+// document formats only reveal themselves in their first entries.
+const sniffSize = 4 << 10
+
+// ErrCategoryMismatch indicates that uploaded files do not match the
+// category the sender chose.
+var ErrCategoryMismatch = errors.New("files do not match the chosen category")
+
+// CategoryError lists the files of an upload that do not belong to its
+// category.
+type CategoryError struct {
+	Category string
+	Files    []MismatchedFile
+}
+
+// MismatchedFile is a file whose detected type is outside its transfer's
+// category.
+type MismatchedFile struct {
+	Name string `json:"name"`
+	Mime string `json:"mime"`
+}
+
+func (e *CategoryError) Error() string {
+	parts := make([]string, len(e.Files))
+	for i, f := range e.Files {
+		parts[i] = fmt.Sprintf("%s is %s", f.Name, f.Mime)
+	}
+	return fmt.Sprintf("not %s: %s", e.Category, strings.Join(parts, ", "))
+}
+
+func (e *CategoryError) Is(target error) bool {
+	return target == ErrCategoryMismatch
+}
+
+// headWriter keeps the first sniffSize bytes written to it.
+type headWriter struct {
+	buf []byte
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if n := min(len(p), sniffSize-len(h.buf)); n > 0 {
+		h.buf = append(h.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// DetectMIME returns the content type of a file from its first bytes. It
+// knows the common media, document and archive formats that
+// http.DetectContentType does not, and only falls back to the file name to
+// tell apart formats that share a container, like the old Office formats.
+func DetectMIME(head []byte, name string) string {
+	if t := detectSignature(head, name); t != "" {
+		return t
+	}
+	detected := http.DetectContentType(head)
+	switch {
+	case detected == "application/zip":
+		return detectZip(head)
+	case strings.HasPrefix(detected, "text/plain"), strings.HasPrefix(detected, "text/xml"):
+		return detectText(head, name, detected)
+	}
+	return detected
+}
+
+func detectSignature(head []byte, name string) string {
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return detectISOMedia(head)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return detectOgg(head)
+	case bytes.HasPrefix(head, []byte("#!AMR")):
+		return "audio/amr"
+	case bytes.HasPrefix(head, []byte("MAC ")):
+		return "audio/x-ape"
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		if bytes.Contains(head[:min(len(head), 64)], []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		return "video/x-msvideo"
+	case bytes.HasPrefix(head, []byte{0x30, 0x26, 0xb2, 0x75, 0x8e, 0x66, 0xcf, 0x11}):
+		return "video/x-ms-asf"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xf6 == 0xf0:
+		return "audio/aac"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0 && head[1]&0x06 != 0:
+		return "audio/mpeg"
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "image/tiff"
+	case bytes.HasPrefix(head, []byte("8BPS")):
+		return "image/vnd.adobe.photoshop"
+	case bytes.HasPrefix(head, []byte{0xff, 0x0a}),
+		bytes.HasPrefix(head, []byte("\x00\x00\x00\x0cJXL \r\n\x87\n")):
+		return "image/jxl"
+	case bytes.HasPrefix(head, []byte("{\\rtf")):
+		return "application/rtf"
+	case bytes.HasPrefix(head, []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}):
+		return detectOLE(name)
+	case isPE(head):
+		return "application/vnd.microsoft.portable-executable"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	case bytes.HasPrefix(head, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}):
+		return "application/x-7z-compressed"
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return "application/x-xz"
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return "application/x-bzip2"
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "application/zstd"
+	}
+	return ""
+}
+
+// isPE recognizes Windows executables and libraries by the PE header the
+// DOS stub points to.
+func isPE(head []byte) bool {
+	if len(head) < 64 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+	offset := int(binary.LittleEndian.Uint32(head[0x3c:]))
+	return offset+4 <= len(head) && string(head[offset:offset+4]) == "PE\x00\x00"
+}
+
+// detectISOMedia tells apart the formats built on ISO base media files by
+// their major brand.
+func detectISOMedia(head []byte) string {
+	switch brand := string(head[8:12]); brand {
+	case "heic", "heix", "heim", "heis":
+		return "image/heic"
+	case "mif1", "msf1":
+		return "image/heif"
+	case "avif", "avis":
+		return "image/avif"
+	case "M4A ", "M4B ", "M4P ":
+		return "audio/mp4"
+	case "qt  ":
+		return "video/quicktime"
+	case "crx ":
+		return "image/x-canon-cr3"
+	default:
+		if strings.HasPrefix(brand, "3g2") {
+			return "video/3gpp2"
+		}
+		if strings.HasPrefix(brand, "3gp") {
+			return "video/3gpp"
+		}
+		return "video/mp4"
+	}
+}
+
+func detectOgg(head []byte) string {
+	first := head[:min(len(head), 64)]
+	switch {
+	case bytes.Contains(first, []byte("theora")):
+		return "video/ogg"
+	case bytes.Contains(first, []byte("OpusHead")):
+		return "audio/opus"
+	case bytes.Contains(first, []byte("vorbis")), bytes.Contains(first, []byte("FLAC")):
+		return "audio/ogg"
+	}
+	return "application/ogg"
+}
+
+// detectOLE names the pre-2007 Office formats, which share one container
+// format that only their contents tell apart.
+func detectOLE(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".doc", ".dot":
+		return "application/msword"
+	case ".xls", ".xlt":
+		return "application/vnd.ms-excel"
+	case ".ppt", ".pps", ".pot":
+		return "application/vnd.ms-powerpoint"
+	case ".msg":
+		return "application/vnd.ms-outlook"
+	case ".msi":
+		return "application/x-msi"
+	}
+	return "application/x-ole-storage"
+}
+
+// detectZip recognizes the document formats stored as ZIP archives.
+// OpenDocument and EPUB files start with an uncompressed "mimetype" entry
+// naming their type; Office Open XML files have their parts listed early.
+func detectZip(head []byte) string {
+	const nameOffset = 30
+	if len(head) > nameOffset+8 && string(head[nameOffset:nameOffset+8]) == "mimetype" {
+		rest := head[nameOffset+8:]
+		end := bytes.IndexFunc(rest, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("./+-", r))
+		})
+		if end >= 0 {
+			rest = rest[:end]
+		}
+		if t := string(rest); t == "application/epub+zip" || strings.HasPrefix(t, "application/vnd.oasis.opendocument.") {
+			return t
+		}
+	}
+	switch {
+	case bytes.Contains(head, []byte("word/")):
+		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case bytes.Contains(head, []byte("xl/")):
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case bytes.Contains(head, []byte("ppt/")):
+		return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	}
+	return "application/zip"
+}
+
+// detectText refines plain text and XML. SVG images, contacts and
+// calendars are recognized by their contents; other plain text keeps a text
+// type suggested by its extension, such as CSV or Markdown, but never one a
+// browser would render as a page.
+func detectText(head []byte, name, detected string) string {
+	upper := bytes.ToUpper(bytes.TrimLeft(head, "\ufeff \t\r\n"))
+	switch {
+	case bytes.HasPrefix(upper, []byte("<SVG")),
+		bytes.HasPrefix(upper, []byte("<?XML")) && bytes.Contains(upper, []byte("<SVG")):
+		return "image/svg+xml"
+	case bytes.HasPrefix(upper, []byte("BEGIN:VCARD")):
+		return "text/vcard"
+	case bytes.HasPrefix(upper, []byte("BEGIN:VCALENDAR")):
+		return "text/calendar"
+	case !strings.HasPrefix(detected, "text/plain"):
+		return detected
+	}
+	byExt, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(name))))
+	switch byExt {
+	case "text/csv", "text/markdown", "text/tab-separated-values", "text/x-markdown":
+		return byExt + strings.TrimPrefix(detected, "text/plain")
+	}
+	return detected
+}
+
+// CategoryMatches reports whether a file of type mimeType belongs in a
+// transfer of the given category. Everything belongs in "any".
+func CategoryMatches(category, mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = mimeType
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	switch category {
+	case "audio":
+		return major == "audio"
+	case "photos":
+		return major == "image"
+	case "videos":
+		return major == "video"
+	case "contacts":
+		return mediaType == "text/vcard" || mediaType == "text/x-vcard"
+	case "documents":
+		switch {
+		case mediaType == "text/html", mediaType == "text/vcard", mediaType == "text/calendar",
+			mediaType == "text/x-shellscript":
+			return false
+		case major == "text",
+			mediaType == "application/pdf",
+			mediaType == "application/rtf",
+			mediaType == "application/msword",
+			mediaType == "application/epub+zip",
+			strings.HasPrefix(mediaType, "application/vnd.ms-"),
+			strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument."),
+			strings.HasPrefix(mediaType, "application/vnd.oasis.opendocument."):
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// MismatchedFiles returns the files of transfer whose detected type is
+// outside its category. End-to-end encrypted transfers are never checked.
+func MismatchedFiles(transfer *Transfer) []MismatchedFile {
+	if transfer.Encrypted {
+		return nil
+	}
+	var mismatched []MismatchedFile
+	for _, f := range transfer.Files {
+		if !CategoryMatches(transfer.Category, f.Mime) {
+			mismatched = append(mismatched, MismatchedFile{Name: f.Name, Mime: f.Mime})
+		}
+	}
+	return mismatched
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"share/utils"
+)
+
+// HashPin returns a salted argon2id hash of the trimmed PIN in PHC string
+// format, or an empty string when no PIN is set.
+func HashPin(pin string) string {
+	pin = strings.TrimSpace(pin)
+	if pin == "" {
+		return ""
+	}
+	return utils.HashArgon2id(pin)
+}
+
+// VerifyPin reports whether pin matches hash in constant time. It accepts
+// argon2id hashes produced by HashPin as well as the unsalted SHA-256 hex
+// digests stored by earlier versions.
+func VerifyPin(pin, hash string) bool {
+	pin = strings.TrimSpace(pin)
+	if hash == "" {
+		return true
+	}
+	if pin == "" {
+		return false
+	}
+	if utils.IsArgon2id(hash) {
+		return utils.VerifyArgon2id(pin, hash)
+	}
+	return verifyLegacySHA256(pin, hash)
+}
+
+func verifyLegacySHA256(pin, hash string) bool {
+	want, err := hex.DecodeString(hash)
+	if err != nil || len(want) != sha256.Size {
+		return false
+	}
+	got := sha256.Sum256([]byte(pin))
+	return subtle.ConstantTimeCompare(got[:], want) == 1
+}
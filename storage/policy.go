@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrRejected indicates files refused by the instance's upload policy.
+var ErrRejected = errors.New("files rejected by the upload policy")
+
+// PolicyError lists every file of an upload the policy refused and why.
+// Nothing of the upload is stored.
+type PolicyError struct {
+	Files []RejectedFile
+}
+
+// RejectedFile is a file the upload policy refused.
+type RejectedFile struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func (e *PolicyError) Error() string {
+	parts := make([]string, len(e.Files))
+	for i, f := range e.Files {
+		parts[i] = fmt.Sprintf("%s: %s", f.Name, f.Reason)
+	}
+	return fmt.Sprintf("%s: %s", ErrRejected, strings.Join(parts, "; "))
+}
+
+func (e *PolicyError) Is(target error) bool {
+	return target == ErrRejected
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"share/policy"
+)
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestPolicyRefusesByNameBeforeStoring(t *testing.T) {
+	s := newTestStore(t, Options{Policy: &policy.Policy{
+		Default: policy.Allow,
+		Rules: []policy.Rule{
+			{Action: policy.Deny, Extensions: []string{"exe"}},
+			{Action: policy.Deny, MinSize: 100},
+		},
+	}})
+	exe := &countingReader{r: bytes.NewReader(pattern(50))}
+	big := &countingReader{r: bytes.NewReader(pattern(200))}
+	_, err := s.SaveFiles(SaveOptions{Category: "files"}, &payloads{files: []*FilePayload{
+		{Name: "setup.exe", Content: io.NopCloser(exe)},
+		{Name: "big.bin", Content: io.NopCloser(big)},
+		{Name: "small.bin", Content: io.NopCloser(bytes.NewReader(pattern(10)))},
+	}})
+
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) || len(policyErr.Files) != 2 {
+		t.Fatalf("SaveFiles = %v, want two refused files", err)
+	}
+	if policyErr.Files[0].Name != "setup.exe" || policyErr.Files[1].Name != "big.bin" {
+		t.Fatalf("refused %+v", policyErr.Files)
+	}
+	// The extension rule decides without the contents, the size rule
+	// needs them.
+	if exe.n != 0 {
+		t.Fatalf("read %d bytes of a file refused by its name", exe.n)
+	}
+	if big.n != 200 {
+		t.Fatalf("read %d bytes of a file refused by its size, want 200", big.n)
+	}
+	checkUsed(t, s, 0)
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"share/metrics"
+)
+
+// ScanStatus is the malware scanner's verdict on a stored file.
+type ScanStatus string
+
+const (
+	// ScanUnscanned marks files the scanner cannot look at, which are the
+	// files of end-to-end encrypted transfers.
+	ScanUnscanned ScanStatus = "unscanned"
+	ScanClean     ScanStatus = "clean"
+	// ScanInfected marks files the scanner flagged. They are quarantined
+	// and never served.
+	ScanInfected ScanStatus = "infected"
+	// ScanFailed marks files that could not be scanned, for example because
+	// the scanner was unreachable or the file exceeded its size limit.
+	ScanFailed ScanStatus = "failed"
+)
+
+// Infected files are moved out of the blob area into quarantineDir, where
+// they stay for inspection until they expire like any transfer. With
+// encryption at rest they remain encrypted, their data key next to them.
+// They count towards the storage quota until they are deleted.
+const quarantineDir = "quarantine"
+
+// ErrQuarantined indicates a file the scanner found to be infected.
+var ErrQuarantined = errors.New("file is quarantined")
+
+// scanJob feeds a file to the scanner while it is being uploaded.
+type scanJob struct {
+	w      *io.PipeWriter
+	done   chan struct{}
+	result scanResult
+}
+
+type scanResult struct {
+	infected bool
+	threat   string
+	err      error
+}
+
+func (s *Store) startScan() *scanJob {
+	r, w := io.Pipe()
+	job := &scanJob{w: w, done: make(chan struct{})}
+	go func() {
+		defer close(job.done)
+		res, err := s.opts.Scanner.Scan(context.Background(), r)
+		job.result = scanResult{infected: res.Infected, threat: res.Signature, err: err}
+		// A scanner may give up before the end of the file; keep draining
+		// so the upload is never stalled by it.
+		_, _ = io.Copy(io.Discard, r)
+	}()
+	return job
+}
+
+// Write passes p on to the scanner. It never fails: a scanner error only
+// affects the verdict, not the upload.
+func (j *scanJob) Write(p []byte) (int, error) {
+	_, _ = j.w.Write(p)
+	return len(p), nil
+}
+
+// finish ends the stream, with err when the upload failed, and waits for
+// the verdict.
+func (j *scanJob) finish(err error) scanResult {
+	j.w.CloseWithError(err)
+	<-j.done
+	return j.result
+}
+
+// status records the verdict in metrics and the log and turns it into the
+// file's scan status.
+func (r scanResult) status(transferID, name string) ScanStatus {
+	status := ScanClean
+	switch {
+	case r.err != nil:
+		status = ScanFailed
+		slog.Warn("scanning file failed", "transfer_id", transferID, "file", name, "error", r.err)
+	case r.infected:
+		status = ScanInfected
+		slog.Warn("infected file quarantined", "transfer_id", transferID, "file", name, "threat", r.threat)
+	}
+	metrics.ScannedFilesTotal.With(string(status)).Inc()
+	return status
+}
+
+// quarantine moves an infected staged file out of the blob area under the
+// given name, keeping its data key when it is encrypted.
+func (s *Store) quarantine(staged, name string, key []byte) error {
+	path := filepath.Join(s.dir, quarantineDir, name)
+	if key != nil {
+		wrapped, err := s.wrapKey(key, name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path+dataKeySuffix, wrapped, 0o600); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(staged, path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		s.mu.Lock()
+		s.used += info.Size()
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// quarantineUsage returns the bytes held by the quarantined files in dir,
+// which are kept across restarts.
+func quarantineUsage(dir string) int64 {
+	entries, err := os.ReadDir(filepath.Join(dir, quarantineDir))
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() && filepath.Ext(entry.Name()) != dataKeySuffix {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// pruneQuarantine deletes quarantined files older than cutoff.
+func (s *Store) pruneQuarantine(cutoff time.Time) {
+	dir := filepath.Join(s.dir, quarantineDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var freed int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if os.Remove(filepath.Join(dir, entry.Name())) == nil && filepath.Ext(entry.Name()) != dataKeySuffix {
+			freed += info.Size()
+		}
+	}
+	s.mu.Lock()
+	s.used -= freed
+	s.mu.Unlock()
+}
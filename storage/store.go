@@ -3,17 +3,21 @@ package storage
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
+
+	"share/metrics"
+	"share/policy"
+	"share/scan"
+	"share/utils"
 )
 
 var (
@@ -21,118 +25,475 @@ var (
 	ErrNotFound = errors.New("transfer not found")
 	// ErrUnauthorized indicates that the provided token does not match the transfer.
 	ErrUnauthorized = errors.New("invalid access token")
+	// ErrClosed indicates that the store is shutting down and rejects new uploads.
+	ErrClosed = errors.New("store is closed")
+	// ErrInsufficientStorage indicates that an upload would exceed the storage
+	// quota or eat into the free disk space reserve.
+	ErrInsufficientStorage = errors.New("insufficient storage")
+	// ErrOwnerQuotaExceeded indicates that an upload would exceed the
+	// uploading user's personal quota.
+	ErrOwnerQuotaExceeded = errors.New("user storage quota exceeded")
+	// ErrChecksumMismatch indicates that an uploaded file does not match the
+	// checksum the sender supplied for it.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrNoFiles indicates an upload without any files.
+	ErrNoFiles = errors.New("no files provided")
 )
 
+// SaveOptions describes a transfer being created.
+type SaveOptions struct {
+	Category string
+	Pin      string
+	// Owner is the account that created the transfer, if any.
+	Owner string
+	// OwnerQuota caps the bytes held by all of Owner's active transfers.
+	// Zero disables it.
+	OwnerQuota int64
+	// Encrypted marks a transfer whose files were end-to-end encrypted by
+	// the sender; the store only ever holds their ciphertext.
+	Encrypted bool
+	// EnforceCategory rejects the upload with a *CategoryError when the
+	// detected type of a file is outside Category. It has no effect on
+	// end-to-end encrypted transfers, whose contents cannot be inspected.
+	EnforceCategory bool
+	// StripMetadata removes EXIF, XMP and IPTC metadata from JPEG and PNG
+	// files before they are stored. Files it cannot be removed from are
+	// refused with a *PolicyError. It has no effect on end-to-end encrypted
+	// transfers.
+	StripMetadata bool
+}
+
+// Options configures storage limits.
+type Options struct {
+	// Quota caps the total bytes held by all transfers. Zero disables it.
+	Quota int64
+	// FreeReserve is the free disk space, in bytes, that uploads must leave
+	// untouched. Zero disables it.
+	FreeReserve int64
+	// BLAKE3 also computes a BLAKE3 checksum of every file next to the
+	// SHA-256 one.
+	BLAKE3 bool
+	// MasterKey enables encryption at rest. It wraps the random data key
+	// each blob is encrypted with and must be 32 bytes long.
+	MasterKey []byte
+	// Scanner checks every file that is not end-to-end encrypted for
+	// malware while it is uploaded. Nil disables scanning.
+	Scanner scan.Scanner
+	// Policy decides which files are accepted. Nil accepts everything.
+	Policy *policy.Policy
+}
+
 // Transfer holds information about an uploaded bundle.
 type Transfer struct {
-	ID        string
-	Token     string
-	Category  string
-	PinHash   string
+	ID    string
+	Token string
+	// ManageToken grants the sender access to the management view.
+	ManageToken string
+	Owner       string
+	Category    string
+	PinHash     string
+	// Encrypted is set for end-to-end encrypted transfers. File names and
+	// types are then placeholders and the real ones are in EncryptedMeta.
+	Encrypted bool
 	Files     []StoredFile
 	CreatedAt time.Time
 }
 
+// TotalSize returns the combined size of all files in the transfer.
+func (t *Transfer) TotalSize() int64 {
+	var total int64
+	for _, f := range t.Files {
+		total += f.Size
+	}
+	return total
+}
+
 // StoredFile represents a file inside a transfer bundle.
 type StoredFile struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
+	// Mime is detected from the file's contents, except for end-to-end
+	// encrypted files.
 	Mime string `json:"mime"`
 	Size int64  `json:"size"`
-	Path string
+	// SHA256 and BLAKE3 are hex-encoded checksums of the file's contents,
+	// computed while it was uploaded. BLAKE3 is only set when enabled.
+	SHA256 string `json:"sha256"`
+	BLAKE3 string `json:"blake3,omitempty"`
+	// EncryptedMeta is the sender's sealed name, type and size of an end-to-end
+	// encrypted file. The server cannot read it.
+	EncryptedMeta string `json:"encryptedMeta,omitempty"`
+	// Scan is the malware scanner's verdict, empty when scanning is off, and
+	// Threat what it found in an infected file.
+	Scan   ScanStatus `json:"scan,omitempty"`
+	Threat string     `json:"threat,omitempty"`
+	// Sanitized marks an image whose metadata was stripped before it was
+	// stored, and StrippedBytes is how much smaller that made it. Size and
+	// the checksums describe the stored copy.
+	Sanitized     bool  `json:"sanitized,omitempty"`
+	StrippedBytes int64 `json:"strippedBytes,omitempty"`
+	// Blob is the address of the content-addressed blob holding the file
+	// and Path its location on disk. Both are empty for quarantined files.
+	Blob string `json:"-"`
+	Path string `json:"-"`
 }
 
 // FilePayload represents an uploaded file stream.
 type FilePayload struct {
-	Name    string
-	MIME    string
-	Content io.ReadCloser
+	Name string
+	// MIME is the type the client claimed. It is only kept for end-to-end
+	// encrypted files; the type of others is detected from their contents.
+	MIME          string
+	EncryptedMeta string
+	// ExpectedSHA256 and ExpectedBLAKE3 are optional hex checksums supplied
+	// by the sender. SaveFiles rejects the upload when they do not match.
+	ExpectedSHA256 string
+	ExpectedBLAKE3 string
+	Content        io.ReadCloser
 }
 
 // Store manages transfer metadata and the upload directory.
 type Store struct {
 	mu        sync.RWMutex
 	dir       string
+	opts      Options
 	transfers map[string]*Transfer
+	partial   map[string]struct{}
+	closed    bool
+
+	// addressKey and wrappingKey are the subkeys of the master key that
+	// name blobs and wrap their data keys. Both are nil without one.
+	addressKey  []byte
+	wrappingKey []byte
+
+	// blobMu guards blobs and the files in the blob area. It is taken
+	// before mu when both are needed.
+	blobMu sync.Mutex
+	blobs  map[string]*blob
+
+	thumbQueue chan thumbJob
+
+	// variantMu guards variants, the resized photos made or being made.
+	variantMu  sync.Mutex
+	variants   map[string]*variantEntry
+	variantSem chan struct{}
+
+	// used counts the bytes of all blobs on disk, so shared content is
+	// counted once, and inflight those of uploads in progress.
+	used     int64
+	inflight int64
+	// variantsUsed counts the bytes of each transfer's cached variants,
+	// which are part of used.
+	variantsUsed map[string]int64
+	// ownerUsed and ownerInflight count the file sizes of each user's
+	// transfers and of their uploads in progress, for personal quotas.
+	ownerUsed     map[string]int64
+	ownerInflight map[string]int64
+
+	cleanupRunning  bool
+	cleanupInterval time.Duration
+	cleanupLastRun  time.Time
+}
+
+// CleanupStatus describes the state of the background cleanup loop.
+type CleanupStatus struct {
+	Running  bool
+	Interval time.Duration
+	LastRun  time.Time
 }
 
 // NewStore creates a Store that persists files under dir.
-func NewStore(dir string) (*Store, error) {
+func NewStore(dir string, opts Options) (*Store, error) {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, err
 	}
-	return &Store{
+	// Transfers are only held in memory, so blobs left behind by a previous
+	// run are not referenced by anything.
+	if err := os.RemoveAll(filepath.Join(dir, blobsDir)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, blobsDir), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(filepath.Join(dir, variantsDir)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, quarantineDir), 0o700); err != nil {
+		return nil, err
+	}
+	s := &Store{
 		dir:       dir,
+		opts:      opts,
+		used:      quarantineUsage(dir),
 		transfers: make(map[string]*Transfer),
-	}, nil
+		partial:   make(map[string]struct{}),
+		blobs:     make(map[string]*blob),
+
+		ownerUsed:     make(map[string]int64),
+		ownerInflight: make(map[string]int64),
+		variantsUsed:  make(map[string]int64),
+
+		thumbQueue: make(chan thumbJob, thumbQueueSize),
+		variants:   make(map[string]*variantEntry),
+		variantSem: make(chan struct{}, variantWorkers),
+	}
+	if opts.MasterKey != nil {
+		s.addressKey = deriveKey(opts.MasterKey, "blob-address")
+		s.wrappingKey = deriveKey(opts.MasterKey, "key-wrap")
+	}
+	return s, nil
+}
+
+// Payloads yields the files of an upload in order, so they can be stored
+// while the request body is still arriving. Next returns io.EOF after the
+// last file; the content of each payload is read before Next is called
+// again.
+type Payloads interface {
+	Next() (*FilePayload, error)
 }
 
 // SaveFiles stores multiple files under a single transfer.
-func (s *Store) SaveFiles(category, pin string, payloads []FilePayload) (*Transfer, error) {
-	if len(payloads) == 0 {
-		return nil, errors.New("no files provided")
-	}
-	defer func() {
-		for _, payload := range payloads {
-			if payload.Content != nil {
-				payload.Content.Close()
+func (s *Store) SaveFiles(opts SaveOptions, payloads Payloads) (*Transfer, error) {
+	if opts.Encrypted && s.opts.Policy != nil && !s.opts.Policy.EncryptedAllowed() {
+		perr := &PolicyError{}
+		for {
+			payload, err := payloads.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
 			}
+			payload.Content.Close()
+			perr.Files = append(perr.Files, RejectedFile{Name: payload.Name, Reason: "end-to-end encrypted files are not accepted"})
 		}
-	}()
+		if len(perr.Files) == 0 {
+			return nil, ErrNoFiles
+		}
+		return nil, perr
+	}
 	id := randomString(12)
 	token := randomString(32)
+	manageToken := randomString(32)
 	dir := filepath.Join(s.dir, id)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	s.partial[id] = struct{}{}
+	s.mu.Unlock()
+	var reserved, ownerReserved int64
+	defer func() {
+		s.mu.Lock()
+		delete(s.partial, id)
+		s.inflight -= reserved
+		if opts.Owner != "" {
+			if s.ownerInflight[opts.Owner] -= ownerReserved; s.ownerInflight[opts.Owner] == 0 {
+				delete(s.ownerInflight, opts.Owner)
+			}
+		}
+		s.mu.Unlock()
+	}()
+
+	// Files are staged in a directory of their own and only move to the
+	// blob area once they are complete and verified.
 	if err := os.MkdirAll(dir, 0o700); err != nil {
 		return nil, err
 	}
+	defer s.cleanupDir(dir)
 
 	transfer := &Transfer{
-		ID:        id,
-		Token:     token,
-		Category:  category,
-		PinHash:   HashPin(pin),
-		CreatedAt: time.Now().UTC(),
+		ID:          id,
+		Token:       token,
+		ManageToken: manageToken,
+		Owner:       opts.Owner,
+		Category:    opts.Category,
+		PinHash:     HashPin(opts.Pin),
+		Encrypted:   opts.Encrypted,
+		CreatedAt:   time.Now().UTC(),
 	}
+	committed := false
+	defer func() {
+		if !committed {
+			s.releaseFiles(transfer.Files)
+		}
+	}()
+
+	var rejected []RejectedFile
 
-	for idx, payload := range payloads {
-		if payload.Content == nil {
-			continue
+	idx := 0
+	for ; ; idx++ {
+		payload, err := payloads.Next()
+		if err == io.EOF {
+			break
 		}
-		safe := sanitizeFilename(payload.Name)
-		filename := fmt.Sprintf("%02d_%s", idx, safe)
-		path := filepath.Join(dir, filename)
-		out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
 		if err != nil {
-			s.cleanupDir(dir)
 			return nil, err
 		}
-		size, err := io.Copy(out, payload.Content)
-		out.Close()
+		// Rules about the name and category are applied before the file
+		// is stored, those about its type and size once it is.
+		if s.opts.Policy != nil {
+			checked := policy.File{Category: opts.Category}
+			if !opts.Encrypted {
+				checked.Name = payload.Name
+			}
+			if reason := s.opts.Policy.CheckName(checked); reason != nil {
+				payload.Content.Close()
+				rejected = append(rejected, RejectedFile{Name: payload.Name, Reason: reason.Error()})
+				continue
+			}
+		}
+		staged := filepath.Join(dir, fmt.Sprintf("%02d.part", idx))
+		out, err := os.OpenFile(staged, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
 		if err != nil {
-			_ = os.Remove(path)
-			s.cleanupDir(dir)
+			payload.Content.Close()
 			return nil, err
 		}
-		transfer.Files = append(transfer.Files, StoredFile{
-			ID:   fmt.Sprintf("%s-%02d", id, idx),
-			Name: payload.Name,
-			Mime: payload.MIME,
-			Size: size,
-			Path: path,
-		})
+		budget, err := s.diskBudget()
+		if err != nil {
+			out.Close()
+			payload.Content.Close()
+			return nil, err
+		}
+		var w io.Writer = out
+		var dataKey []byte
+		var enc *encryptWriter
+		if s.opts.MasterKey != nil {
+			dataKey = newDataKey()
+			if enc, err = newEncryptWriter(out, dataKey); err != nil {
+				out.Close()
+				payload.Content.Close()
+				return nil, err
+			}
+			w = enc
+		}
+		qw := &quotaWriter{store: s, w: w, diskBudget: budget, owner: opts.Owner, ownerQuota: opts.OwnerQuota}
+		sums := newChecksummer(s.opts.BLAKE3 || payload.ExpectedBLAKE3 != "")
+		head := &headWriter{}
+		inspect := io.MultiWriter(sums, head)
+		var job *scanJob
+		if s.opts.Scanner != nil && !opts.Encrypted {
+			job = s.startScan()
+			inspect = io.MultiWriter(sums, head, job)
+		}
+		size, err := io.Copy(qw, io.TeeReader(payload.Content, inspect))
+		payload.Content.Close()
+		reserved += qw.reserved
+		ownerReserved += qw.written
+		if enc != nil && err == nil {
+			err = enc.Close()
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = sums.verify(*payload)
+		}
+		var scanned scanResult
+		if job != nil {
+			scanned = job.finish(err)
+		}
+		sha, b3 := sums.sums()
+		file := StoredFile{
+			ID:            fmt.Sprintf("%s-%02d", id, idx),
+			Name:          payload.Name,
+			Mime:          payload.MIME,
+			Size:          size,
+			SHA256:        sha,
+			BLAKE3:        b3,
+			EncryptedMeta: payload.EncryptedMeta,
+		}
+		if !opts.Encrypted {
+			file.Mime = DetectMIME(head.buf, payload.Name)
+		}
+		switch {
+		case err != nil:
+		case job != nil:
+			file.Scan = scanned.status(id, payload.Name)
+		case s.opts.Scanner != nil:
+			file.Scan = ScanUnscanned
+		}
+		if err == nil && s.opts.Policy != nil {
+			checked := policy.File{Size: size, Category: opts.Category}
+			if !opts.Encrypted {
+				checked.Name, checked.MIME = file.Name, file.Mime
+			}
+			if reason := s.opts.Policy.Check(checked); reason != nil {
+				rejected = append(rejected, RejectedFile{Name: payload.Name, Reason: reason.Error()})
+				_ = os.Remove(staged)
+				clear(dataKey)
+				continue
+			}
+		}
+		if err == nil && opts.StripMetadata && !opts.Encrypted && file.Scan != ScanInfected && Strippable(file.Mime) {
+			cleanKey, serr := s.stripMetadata(staged, dataKey, &file)
+			if serr != nil {
+				slog.Warn("stripping metadata failed", "transfer_id", id, "file", payload.Name, "error", serr)
+				rejected = append(rejected, RejectedFile{Name: payload.Name, Reason: "its metadata could not be removed"})
+				_ = os.Remove(staged)
+				clear(dataKey)
+				continue
+			}
+			clear(dataKey)
+			dataKey = cleanKey
+		}
+		if err == nil && file.Scan == ScanInfected {
+			file.Threat = scanned.threat
+			err = s.quarantine(staged, file.ID, dataKey)
+		} else if err == nil {
+			file.Blob = s.blobAddress(file.SHA256)
+			file.Path = s.blobPath(file.Blob)
+			err = s.commitBlob(staged, file.Blob, dataKey, file.Size)
+		}
+		clear(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		transfer.Files = append(transfer.Files, file)
 	}
 
+	if idx == 0 {
+		return nil, ErrNoFiles
+	}
+	if len(rejected) > 0 {
+		return nil, &PolicyError{Files: rejected}
+	}
 	if len(transfer.Files) == 0 {
-		s.cleanupDir(dir)
 		return nil, errors.New("unable to store files")
 	}
+	if opts.EnforceCategory && !opts.Encrypted {
+		if mismatched := MismatchedFiles(transfer); len(mismatched) > 0 {
+			return nil, &CategoryError{Category: opts.Category, Files: mismatched}
+		}
+	}
 
 	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
 	s.transfers[id] = transfer
+	if transfer.Owner != "" {
+		s.ownerUsed[transfer.Owner] += transfer.TotalSize()
+	}
 	s.mu.Unlock()
+	committed = true
+	s.queueThumbnails(transfer)
 	return transfer, nil
 }
 
+// Open returns a reader for the contents of a file in transfer, decrypting
+// it when the store encrypts at rest. The reader supports seeking so byte
+// ranges can be served.
+func (s *Store) Open(transfer *Transfer, file *StoredFile) (io.ReadSeekCloser, error) {
+	if file.Scan == ScanInfected {
+		return nil, ErrQuarantined
+	}
+	return s.openBlobFile(file.Path, file.Blob, file.Size)
+}
+
 // Authorize returns the transfer if both the id and token are valid.
 func (s *Store) Authorize(id, token string) (*Transfer, error) {
 	s.mu.RLock()
@@ -147,70 +508,259 @@ func (s *Store) Authorize(id, token string) (*Transfer, error) {
 	return transfer, nil
 }
 
-// Remove deletes the transfer metadata and file from disk.
+// AuthorizeManage returns the transfer if the id and management token are valid.
+func (s *Store) AuthorizeManage(id, manageToken string) (*Transfer, error) {
+	s.mu.RLock()
+	transfer, ok := s.transfers[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if manageToken == "" || subtle.ConstantTimeCompare([]byte(manageToken), []byte(transfer.ManageToken)) != 1 {
+		return nil, ErrUnauthorized
+	}
+	return transfer, nil
+}
+
+// Remove deletes the transfer metadata and releases its files, deleting
+// those no other transfer shares.
 func (s *Store) Remove(id string) {
 	s.mu.Lock()
-	_, ok := s.transfers[id]
+	transfer, ok := s.transfers[id]
 	if ok {
-		delete(s.transfers, id)
+		s.deleteTransferLocked(transfer)
 	}
 	s.mu.Unlock()
 	if ok {
-		s.cleanupDir(filepath.Join(s.dir, id))
+		s.removeVariants(id)
+		s.releaseFiles(transfer.Files)
+	}
+}
+
+// Stats returns the number of active transfers and the bytes they occupy.
+func (s *Store) Stats() (transfers int, bytes int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.transfers), s.used
+}
+
+// OwnerUsage returns the bytes held by the active transfers of owner.
+func (s *Store) OwnerUsage(owner string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ownerUsed[owner]
+}
+
+// deleteTransferLocked forgets a transfer; s.mu must be held.
+func (s *Store) deleteTransferLocked(transfer *Transfer) {
+	delete(s.transfers, transfer.ID)
+	s.used -= s.variantsUsed[transfer.ID]
+	delete(s.variantsUsed, transfer.ID)
+	if transfer.Owner == "" {
+		return
+	}
+	if s.ownerUsed[transfer.Owner] -= transfer.TotalSize(); s.ownerUsed[transfer.Owner] <= 0 {
+		delete(s.ownerUsed, transfer.Owner)
+	}
+}
+
+// Lookup returns the transfer with the given id without checking tokens. It
+// is meant for owners listing their own transfers.
+func (s *Store) Lookup(id string) (*Transfer, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	transfer, ok := s.transfers[id]
+	return transfer, ok
+}
+
+// CheckCapacity reports ErrInsufficientStorage when storing size more bytes
+// would exceed the quota or the free space reserve. Uploads are still
+// checked while streaming, so this is only an early rejection.
+func (s *Store) CheckCapacity(size int64) error {
+	size = s.storedSize(size)
+	s.mu.RLock()
+	committed := s.used + s.inflight
+	s.mu.RUnlock()
+	if s.opts.Quota > 0 && committed+size > s.opts.Quota {
+		return ErrInsufficientStorage
+	}
+	budget, err := s.diskBudget()
+	if err != nil {
+		return err
+	}
+	if budget >= 0 && size > budget {
+		return ErrInsufficientStorage
+	}
+	return nil
+}
+
+// diskBudget returns how many bytes may still be written before the free
+// space reserve is reached, or -1 when no reserve is configured.
+func (s *Store) diskBudget() (int64, error) {
+	if s.opts.FreeReserve <= 0 {
+		return -1, nil
 	}
+	free, err := utils.DiskFree(s.dir)
+	if err != nil {
+		if errors.Is(err, utils.ErrDiskFreeUnsupported) {
+			return -1, nil
+		}
+		return 0, err
+	}
+	budget := int64(free) - s.opts.FreeReserve
+	if budget < 0 {
+		return 0, ErrInsufficientStorage
+	}
+	return budget, nil
+}
+
+// reserve claims disk bytes of the quota for an in-flight upload, and
+// plain bytes of owner's quota.
+func (s *Store) reserve(disk, plain int64, owner string, ownerQuota int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner != "" && ownerQuota > 0 && s.ownerUsed[owner]+s.ownerInflight[owner]+plain > ownerQuota {
+		return ErrOwnerQuotaExceeded
+	}
+	if s.opts.Quota > 0 && s.used+s.inflight+disk > s.opts.Quota {
+		return ErrInsufficientStorage
+	}
+	s.inflight += disk
+	if owner != "" {
+		s.ownerInflight[owner] += plain
+	}
+	return nil
+}
+
+// quotaWriter enforces the storage quota, the owner's quota and the disk
+// reserve while a file is being streamed to disk. It sits in front of the
+// encryption at rest, so written counts plaintext and reserved the bytes
+// they take on disk.
+type quotaWriter struct {
+	store      *Store
+	w          io.Writer
+	diskBudget int64
+	owner      string
+	ownerQuota int64
+	written    int64
+	reserved   int64
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	disk := q.store.storedSize(q.written+n) - q.reserved
+	if q.diskBudget >= 0 && q.reserved+disk > q.diskBudget {
+		return 0, ErrInsufficientStorage
+	}
+	if err := q.store.reserve(disk, n, q.owner, q.ownerQuota); err != nil {
+		return 0, err
+	}
+	q.written += n
+	q.reserved += disk
+	return q.w.Write(p)
 }
 
 // CleanupOlderThan removes any transfer that is older than ttl.
 func (s *Store) CleanupOlderThan(ttl time.Duration) int {
 	cutoff := time.Now().UTC().Add(-ttl)
-	var removed int
-	var paths []string
+	var removed []*Transfer
 
 	s.mu.Lock()
-	for id, transfer := range s.transfers {
+	for _, transfer := range s.transfers {
 		if transfer.CreatedAt.Before(cutoff) {
-			delete(s.transfers, id)
-			removed++
-			paths = append(paths, id)
+			s.deleteTransferLocked(transfer)
+			removed = append(removed, transfer)
 		}
 	}
 	s.mu.Unlock()
-	for _, id := range paths {
-		s.cleanupDir(filepath.Join(s.dir, id))
+	for _, transfer := range removed {
+		s.removeVariants(transfer.ID)
+		s.releaseFiles(transfer.Files)
+		slog.Info("transfer expired", "transfer_id", transfer.ID)
 	}
-	return removed
+	s.pruneQuarantine(cutoff)
+	metrics.CleanupRunsTotal.Inc()
+	metrics.CleanupRemovedTotal.Add(float64(len(removed)))
+	return len(removed)
 }
 
 // StartCleanup periodically removes expired transfers until the context is done.
 func (s *Store) StartCleanup(ctx context.Context, ttl, interval time.Duration) {
+	s.mu.Lock()
+	s.cleanupRunning = true
+	s.cleanupInterval = interval
+	s.cleanupLastRun = time.Now().UTC()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cleanupRunning = false
+		s.mu.Unlock()
+	}()
+
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			s.CleanupOlderThan(ttl)
+			s.mu.Lock()
+			s.cleanupLastRun = time.Now().UTC()
+			s.mu.Unlock()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func sanitizeFilename(name string) string {
-	base := filepath.Base(name)
-	base = strings.Map(func(r rune) rune {
-		switch {
-		case r == '\\' || r == '/' || r == ':' || r == 0:
-			return -1
-		case r < 32:
-			return -1
-		}
-		return r
-	}, base)
-	base = strings.TrimSpace(base)
-	if base == "" {
-		return "file.bin"
+// CleanupStatus reports whether the cleanup loop is running and when it last
+// completed a sweep.
+func (s *Store) CleanupStatus() CleanupStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return CleanupStatus{
+		Running:  s.cleanupRunning,
+		Interval: s.cleanupInterval,
+		LastRun:  s.cleanupLastRun,
+	}
+}
+
+// Dir returns the directory holding transfer files.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// CheckWritable verifies that files can be created in the upload directory.
+func (s *Store) CheckWritable() error {
+	f, err := os.CreateTemp(s.dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
 	}
-	return base
+	return err
+}
+
+// Close stops the store from accepting new uploads and removes the directories
+// of transfers that were still being written. It returns the number of partial
+// transfers that were discarded.
+func (s *Store) Close() int {
+	s.mu.Lock()
+	s.closed = true
+	ids := make([]string, 0, len(s.partial))
+	for id := range s.partial {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		s.cleanupDir(filepath.Join(s.dir, id))
+	}
+	return len(ids)
 }
 
 func randomString(length int) string {
@@ -221,16 +771,6 @@ func randomString(length int) string {
 	return hex.EncodeToString(bytes)[:length]
 }
 
-// HashPin returns the SHA-256 hash of a trimmed PIN or empty string.
-func HashPin(pin string) string {
-	pin = strings.TrimSpace(pin)
-	if pin == "" {
-		return ""
-	}
-	sum := sha256.Sum256([]byte(pin))
-	return hex.EncodeToString(sum[:])
-}
-
 func (s *Store) cleanupDir(dir string) {
 	_ = os.RemoveAll(dir)
 }
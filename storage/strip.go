@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"io"
+	"os"
+
+	"share/imaging"
+)
+
+// Strippable reports whether metadata can be stripped from files of the
+// given detected type.
+func Strippable(mimeType string) bool {
+	switch mediaType(mimeType) {
+	case "image/jpeg", "image/png":
+		return true
+	}
+	return false
+}
+
+// stripMetadata rewrites a staged JPEG or PNG file without its EXIF, XMP
+// and IPTC metadata and updates file's size and checksums to those of the
+// cleaned copy. With encryption at rest the copy gets a fresh data key,
+// which is returned.
+func (s *Store) stripMetadata(staged string, key []byte, file *StoredFile) ([]byte, error) {
+	var src io.ReadCloser
+	var err error
+	if key != nil {
+		src, err = openEncrypted(staged, key, file.Size)
+	} else {
+		src, err = os.Open(staged)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	cleaned := staged + ".clean"
+	out, err := os.OpenFile(cleaned, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	var w io.Writer = out
+	var cleanKey []byte
+	var enc *encryptWriter
+	if key != nil {
+		cleanKey = newDataKey()
+		if enc, err = newEncryptWriter(out, cleanKey); err != nil {
+			out.Close()
+			_ = os.Remove(cleaned)
+			return nil, err
+		}
+		w = enc
+	}
+	sums := newChecksummer(file.BLAKE3 != "")
+	removed, err := imaging.StripMetadata(io.MultiWriter(w, sums), src)
+	if enc != nil && err == nil {
+		err = enc.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(cleaned, staged)
+	}
+	if err != nil {
+		_ = os.Remove(cleaned)
+		clear(cleanKey)
+		return nil, err
+	}
+	file.Size -= removed
+	file.SHA256, file.BLAKE3 = sums.sums()
+	file.Sanitized = true
+	file.StrippedBytes = removed
+	return cleanKey, nil
+}
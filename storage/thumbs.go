@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+
+	"share/imaging"
+	"share/metrics"
+)
+
+// Thumbnails of images are generated in the background once a transfer is
+// stored and kept next to the image's blob, encrypted with its data key
+// when encryption at rest is on, so they are removed and shredded with it.
+const (
+	thumbSuffix    = ".thumb"
+	thumbMaxSide   = 320
+	thumbQuality   = 80
+	thumbQueueSize = 256
+	// maxImagePixels keeps decompression bombs from exhausting memory.
+	maxImagePixels = 50_000_000
+)
+
+var (
+	// ErrNoThumbnail indicates a file without a thumbnail, because it is
+	// not an image or its thumbnail could not be generated.
+	ErrNoThumbnail = errors.New("no thumbnail for this file")
+	// ErrThumbnailPending indicates a thumbnail that is still being made.
+	ErrThumbnailPending = errors.New("thumbnail is not ready yet")
+)
+
+type thumbState int
+
+const (
+	thumbNone thumbState = iota
+	thumbPending
+	thumbReady
+	thumbFailed
+)
+
+type thumbJob struct {
+	address string
+	size    int64
+	mime    string
+}
+
+// Thumbnailable reports whether thumbnails are made for file: JPEG, PNG
+// and GIF images that are held in storage. End-to-end encrypted files never
+// qualify since their type is a placeholder.
+func Thumbnailable(file *StoredFile) bool {
+	if file.Blob == "" {
+		return false
+	}
+	switch mediaType(file.Mime) {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+func mediaType(mimeType string) string {
+	t, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return mimeType
+	}
+	return t
+}
+
+// queueThumbnails schedules thumbnails for the images of a new transfer
+// whose blobs do not have one yet.
+func (s *Store) queueThumbnails(transfer *Transfer) {
+	for i := range transfer.Files {
+		file := &transfer.Files[i]
+		if !Thumbnailable(file) {
+			continue
+		}
+		s.blobMu.Lock()
+		b, ok := s.blobs[file.Blob]
+		queue := ok && b.thumb == thumbNone
+		if queue {
+			b.thumb = thumbPending
+		}
+		s.blobMu.Unlock()
+		if !queue {
+			continue
+		}
+		select {
+		case s.thumbQueue <- thumbJob{address: file.Blob, size: file.Size, mime: file.Mime}:
+		default:
+			s.setThumbState(file.Blob, thumbNone, 0)
+			slog.Warn("thumbnail queue full", "transfer_id", transfer.ID, "file_id", file.ID)
+		}
+	}
+}
+
+func (s *Store) setThumbState(address string, state thumbState, size int64) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	if b, ok := s.blobs[address]; ok {
+		b.thumb = state
+		b.thumbSize = size
+	}
+}
+
+// RunThumbnails generates queued thumbnails until the context is done.
+func (s *Store) RunThumbnails(ctx context.Context) {
+	for {
+		select {
+		case job := <-s.thumbQueue:
+			if err := s.makeThumbnail(job); err != nil {
+				s.setThumbState(job.address, thumbFailed, 0)
+				metrics.ThumbnailsTotal.With("failed").Inc()
+				slog.Warn("generating thumbnail failed", "mime", job.mime, "bytes", job.size, "error", err)
+				continue
+			}
+			metrics.ThumbnailsTotal.With("generated").Inc()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Store) makeThumbnail(job thumbJob) error {
+	img, orientation, err := s.decodeBlobImage(job.address, job.size)
+	if err != nil {
+		return err
+	}
+	thumb := imaging.Orient(imaging.Fit(img, thumbMaxSide, thumbMaxSide), orientation)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, imaging.Flatten(thumb, color.White), &jpeg.Options{Quality: thumbQuality}); err != nil {
+		return err
+	}
+
+	path := s.blobPath(job.address) + thumbSuffix
+	if err := s.writeDerived(path+".part", job.address, buf.Bytes()); err != nil {
+		_ = os.Remove(path + ".part")
+		return err
+	}
+	// The blob may have been released in the meantime; only keep the
+	// thumbnail while it exists.
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	b, ok := s.blobs[job.address]
+	if !ok {
+		_ = os.Remove(path + ".part")
+		return nil
+	}
+	if err := os.Rename(path+".part", path); err != nil {
+		return err
+	}
+	b.thumb = thumbReady
+	b.thumbSize = int64(buf.Len())
+	return nil
+}
+
+// decodeBlobImage decodes the image held in a blob and returns it with its
+// EXIF orientation, refusing images too large to decode safely.
+func (s *Store) decodeBlobImage(address string, size int64) (image.Image, int, error) {
+	src, err := s.openBlobFile(s.blobPath(address), address, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer src.Close()
+	head := make([]byte, 64<<10)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, 0, err
+	}
+	head = head[:n]
+	config, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return nil, 0, err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, 0, fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	img, _, err := image.Decode(bufio.NewReader(src))
+	if err != nil {
+		return nil, 0, err
+	}
+	return img, imaging.JPEGOrientation(head), nil
+}
+
+// writeDerived writes data derived from the blob at address to path,
+// encrypted with the blob's data key when encryption at rest is on.
+func (s *Store) writeDerived(path, address string, data []byte) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = out
+	var enc *encryptWriter
+	if s.opts.MasterKey != nil {
+		key, err := s.dataKey(address)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		enc, err = newEncryptWriter(out, key)
+		clear(key)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		w = enc
+	}
+	_, err = w.Write(data)
+	if enc != nil && err == nil {
+		err = enc.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Thumbnail returns the JPEG thumbnail of an image file.
+func (s *Store) Thumbnail(file *StoredFile) (io.ReadSeekCloser, error) {
+	if !Thumbnailable(file) {
+		return nil, ErrNoThumbnail
+	}
+	s.blobMu.Lock()
+	b, ok := s.blobs[file.Blob]
+	var state thumbState
+	var size int64
+	if ok {
+		state, size = b.thumb, b.thumbSize
+	}
+	s.blobMu.Unlock()
+	switch state {
+	case thumbPending:
+		return nil, ErrThumbnailPending
+	case thumbReady:
+		return s.openBlobFile(s.blobPath(file.Blob)+thumbSuffix, file.Blob, size)
+	}
+	return nil, ErrNoThumbnail
+}
+
+// openBlobFile opens a blob, or a file derived from it, decrypting it with
+// the blob's data key when the store encrypts at rest.
+func (s *Store) openBlobFile(path, address string, size int64) (io.ReadSeekCloser, error) {
+	if s.opts.MasterKey == nil {
+		return os.Open(path)
+	}
+	key, err := s.dataKey(address)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	return openEncrypted(path, key, size)
+}
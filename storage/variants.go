@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"share/imaging"
+	"share/metrics"
+)
+
+// Photos transfers offer smaller JPEG copies of their images, so receivers
+// on slow or metered connections need not fetch the originals. Variants are
+// made on first request and cached under variantsDir/<transfer id> until
+// the transfer is removed, encrypted with the image blob's data key when
+// encryption at rest is on. The cache counts towards the storage quota and
+// the free space reserve; when they leave no room, the original is served.
+const (
+	variantsDir = "variants"
+	// variantWorkers bounds how many images are resized at once; each
+	// decoded photo can take hundreds of megabytes.
+	variantWorkers = 2
+)
+
+// ErrNoVariant indicates a file that is not offered in smaller sizes.
+var ErrNoVariant = errors.New("no resized copies of this file")
+
+// Variant describes a resized copy of photos.
+type Variant struct {
+	// Name identifies the variant in URLs.
+	Name  string
+	Label string
+	// Width and Height bound landscape images; portrait ones are fitted
+	// into the same box turned upright.
+	Width, Height int
+	Quality       int
+}
+
+// Variants lists the sizes photos are offered in, largest first.
+var Variants = []Variant{
+	{Name: "2048", Label: "2048 px", Width: 2048, Height: 2048, Quality: 85},
+	{Name: "1080p", Label: "1080p", Width: 1920, Height: 1080, Quality: 80},
+}
+
+// LookupVariant returns the variant with the given name.
+func LookupVariant(name string) (Variant, bool) {
+	for _, v := range Variants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variant{}, false
+}
+
+// HasVariants reports whether resized copies of file are offered: JPEG and
+// PNG images of photos transfers. Animated GIFs would lose their animation.
+func HasVariants(transfer *Transfer, file *StoredFile) bool {
+	if transfer.Category != "photos" || file.Blob == "" || file.Scan == ScanInfected {
+		return false
+	}
+	switch mediaType(file.Mime) {
+	case "image/jpeg", "image/png":
+		return true
+	}
+	return false
+}
+
+// VariantName returns the file name of a variant of the file called name.
+func VariantName(name string, v Variant) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + "-" + v.Name + ".jpg"
+}
+
+// VariantFile is an open variant of a stored file. When the original is no
+// larger than the variant would be, it is the original itself.
+type VariantFile struct {
+	io.ReadSeekCloser
+	Name    string
+	Mime    string
+	Size    int64
+	Resized bool
+}
+
+// variantEntry tracks the making of one variant. done is closed once size
+// and err are set; a size of -1 means the original is served instead.
+type variantEntry struct {
+	done chan struct{}
+	size int64
+	err  error
+}
+
+func variantKey(transferID, fileID, name string) string {
+	return transferID + "/" + fileID + "/" + name
+}
+
+func (s *Store) variantPath(transferID, fileID, name string) string {
+	return filepath.Join(s.dir, variantsDir, transferID, fileID+"-"+name+".jpg")
+}
+
+// OpenVariant opens a resized copy of an image file, making it first when
+// it has not been requested before. Concurrent requests for the same
+// variant wait for a single resize.
+func (s *Store) OpenVariant(transfer *Transfer, file *StoredFile, v Variant) (*VariantFile, error) {
+	if !HasVariants(transfer, file) {
+		return nil, ErrNoVariant
+	}
+	key := variantKey(transfer.ID, file.ID, v.Name)
+	s.variantMu.Lock()
+	entry, ok := s.variants[key]
+	if !ok {
+		entry = &variantEntry{done: make(chan struct{})}
+		s.variants[key] = entry
+	}
+	s.variantMu.Unlock()
+
+	if !ok {
+		s.variantSem <- struct{}{}
+		entry.size, entry.err = s.makeVariant(transfer, file, v)
+		<-s.variantSem
+		if entry.err != nil {
+			// Forget failures so the next request tries again.
+			s.variantMu.Lock()
+			if s.variants[key] == entry {
+				delete(s.variants, key)
+			}
+			s.variantMu.Unlock()
+		}
+		switch {
+		case errors.Is(entry.err, ErrInsufficientStorage):
+			metrics.VariantsTotal.With("original").Inc()
+			slog.Warn("no room to cache resized photo, serving the original", "transfer_id", transfer.ID, "file_id", file.ID, "variant", v.Name)
+		case entry.err != nil:
+			metrics.VariantsTotal.With("failed").Inc()
+			slog.Warn("resizing photo failed", "transfer_id", transfer.ID, "file_id", file.ID, "variant", v.Name, "error", entry.err)
+		case entry.size < 0:
+			metrics.VariantsTotal.With("original").Inc()
+		default:
+			metrics.VariantsTotal.With("generated").Inc()
+		}
+		close(entry.done)
+	} else {
+		<-entry.done
+	}
+	if entry.size < 0 || errors.Is(entry.err, ErrInsufficientStorage) {
+		f, err := s.Open(transfer, file)
+		if err != nil {
+			return nil, err
+		}
+		return &VariantFile{ReadSeekCloser: f, Name: file.Name, Mime: file.Mime, Size: file.Size}, nil
+	}
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	f, err := s.openBlobFile(s.variantPath(transfer.ID, file.ID, v.Name), file.Blob, entry.size)
+	if err != nil {
+		return nil, err
+	}
+	return &VariantFile{ReadSeekCloser: f, Name: VariantName(file.Name, v), Mime: "image/jpeg", Size: entry.size, Resized: true}, nil
+}
+
+// makeVariant resizes an image file and caches the result, returning its
+// size, or -1 when the original is small enough already. It returns
+// ErrInsufficientStorage when the cached copy would not fit.
+func (s *Store) makeVariant(transfer *Transfer, file *StoredFile, v Variant) (int64, error) {
+	img, orientation, err := s.decodeBlobImage(file.Blob, file.Size)
+	if err != nil {
+		return 0, err
+	}
+	// The box is fitted to the image as it is displayed, which is turned a
+	// quarter for orientations 5 to 8.
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	boxW, boxH := v.Width, v.Height
+	if w < h {
+		boxW, boxH = boxH, boxW
+	}
+	if w <= boxW && h <= boxH {
+		return -1, nil
+	}
+	if orientation >= 5 {
+		boxW, boxH = boxH, boxW
+	}
+	resized := imaging.Orient(imaging.Fit(img, boxW, boxH), orientation)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, imaging.Flatten(resized, color.White), &jpeg.Options{Quality: v.Quality}); err != nil {
+		return 0, err
+	}
+	if int64(buf.Len()) >= file.Size {
+		return -1, nil
+	}
+
+	disk := s.storedSize(int64(buf.Len()))
+	budget, err := s.diskBudget()
+	if err != nil {
+		return 0, err
+	}
+	if budget >= 0 && disk > budget {
+		return 0, ErrInsufficientStorage
+	}
+	if err := s.reserve(disk, 0, "", 0); err != nil {
+		return 0, err
+	}
+	reserved := disk
+	defer func() {
+		s.mu.Lock()
+		s.inflight -= reserved
+		s.mu.Unlock()
+	}()
+
+	dest := s.variantPath(transfer.ID, file.ID, v.Name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o700); err != nil {
+		return 0, err
+	}
+	if err := s.writeDerived(dest+".part", file.Blob, buf.Bytes()); err != nil {
+		_ = os.Remove(dest + ".part")
+		return 0, err
+	}
+	// The transfer may have been removed in the meantime; only keep the
+	// variant while it exists, so removing it releases the bytes.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.transfers[transfer.ID]; !ok {
+		_ = os.Remove(dest + ".part")
+		_ = os.Remove(filepath.Dir(dest))
+		return 0, ErrNotFound
+	}
+	if err := os.Rename(dest+".part", dest); err != nil {
+		_ = os.Remove(dest + ".part")
+		return 0, err
+	}
+	s.inflight -= disk
+	reserved = 0
+	s.used += disk
+	s.variantsUsed[transfer.ID] += disk
+	return int64(buf.Len()), nil
+}
+
+// removeVariants deletes the cached variants of a removed transfer.
+func (s *Store) removeVariants(transferID string) {
+	s.variantMu.Lock()
+	prefix := transferID + "/"
+	for key := range s.variants {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.variants, key)
+		}
+	}
+	s.variantMu.Unlock()
+	_ = os.RemoveAll(filepath.Join(s.dir, variantsDir, transferID))
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// noisyPNG returns a PNG too wide for the largest variant that compresses
+// badly, so its resized JPEG copy is smaller than the original.
+func noisyPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 2200, 120))
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rng.Uint32())
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func savePhoto(t *testing.T, s *Store, content []byte) *Transfer {
+	t.Helper()
+	transfer, err := s.SaveFiles(SaveOptions{Category: "photos"}, filesOf(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HasVariants(transfer, &transfer.Files[0]) {
+		t.Fatalf("no variants for %s", transfer.Files[0].Mime)
+	}
+	return transfer
+}
+
+func openVariant(t *testing.T, s *Store, transfer *Transfer) *VariantFile {
+	t.Helper()
+	f, err := s.OpenVariant(transfer, &transfer.Files[0], Variants[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return f
+}
+
+func checkUsed(t *testing.T, s *Store, want int64) {
+	t.Helper()
+	if _, used := s.Stats(); used != want {
+		t.Fatalf("used = %d, want %d", used, want)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.inflight != 0 {
+		t.Fatalf("%d bytes still reserved", s.inflight)
+	}
+}
+
+func TestVariantsCountTowardsQuota(t *testing.T) {
+	content := noisyPNG(t)
+	for _, opts := range []Options{{}, {MasterKey: testMasterKey()}} {
+		s := newTestStore(t, opts)
+		original := s.storedSize(int64(len(content)))
+		transfer := savePhoto(t, s, content)
+		checkUsed(t, s, original)
+
+		f := openVariant(t, s, transfer)
+		if !f.Resized || f.Size >= int64(len(content)) {
+			t.Fatalf("variant = %+v, want a smaller resized copy", f)
+		}
+		variant := s.storedSize(f.Size)
+		checkUsed(t, s, original+variant)
+		// The cached copy is counted once, however often it is served.
+		openVariant(t, s, transfer)
+		checkUsed(t, s, original+variant)
+
+		s.Remove(transfer.ID)
+		checkUsed(t, s, 0)
+		if _, err := os.Stat(filepath.Join(s.dir, variantsDir, transfer.ID)); !os.IsNotExist(err) {
+			t.Fatalf("variants left after removal: %v", err)
+		}
+
+		// Without room for the copy the original is served, and the
+		// variant is made once room is freed.
+		s.opts.Quota = original + variant - 1
+		transfer = savePhoto(t, s, content)
+		if f := openVariant(t, s, transfer); f.Resized || f.Size != int64(len(content)) {
+			t.Fatalf("variant over quota = %+v, want the original", f)
+		}
+		checkUsed(t, s, original)
+		if entries, _ := os.ReadDir(filepath.Join(s.dir, variantsDir, transfer.ID)); len(entries) != 0 {
+			t.Fatalf("%d variant files cached over quota", len(entries))
+		}
+		s.opts.Quota = original + variant
+		if f := openVariant(t, s, transfer); !f.Resized {
+			t.Fatal("variant not made after the quota was raised")
+		}
+		checkUsed(t, s, original+variant)
+
+		// Expiry releases the cached copies too.
+		if removed := s.CleanupOlderThan(-1); removed != 1 {
+			t.Fatalf("CleanupOlderThan removed %d transfers, want 1", removed)
+		}
+		checkUsed(t, s, 0)
+	}
+}
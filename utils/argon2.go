@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for new hashes. They are encoded in every hash so they
+// can be raised later without invalidating existing ones.
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024 // KiB
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+const argonPrefix = "$argon2id$"
+
+var argonB64 = base64.RawStdEncoding
+
+// HashArgon2id returns a salted argon2id hash of secret in PHC string format.
+func HashArgon2id(secret string) string {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	key := argon2.IDKey([]byte(secret), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argonPrefix, argon2.Version, argonMemory, argonTime, argonThreads,
+		argonB64.EncodeToString(salt), argonB64.EncodeToString(key))
+}
+
+// IsArgon2id reports whether hash was produced by HashArgon2id.
+func IsArgon2id(hash string) bool {
+	return strings.HasPrefix(hash, argonPrefix)
+}
+
+// VerifyArgon2id reports in constant time whether secret matches hash.
+func VerifyArgon2id(secret, hash string) bool {
+	// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || !IsArgon2id(hash) {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := argonB64.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := argonB64.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got := argon2.IDKey([]byte(secret), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
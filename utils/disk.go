@@ -0,0 +1,6 @@
+package utils
+
+import "errors"
+
+// ErrDiskFreeUnsupported is returned where free space cannot be queried.
+var ErrDiskFreeUnsupported = errors.New("disk free space not supported on this platform")
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package utils
+
+// DiskFree returns the bytes available on the filesystem holding path.
+func DiskFree(path string) (uint64, error) {
+	return 0, ErrDiskFreeUnsupported
+}